@@ -0,0 +1,432 @@
+package crossclues
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Role is what a set of credentials allows on the operator endpoints.
+type Role int
+
+const (
+	// RoleViewer can list and inspect games.
+	RoleViewer Role = iota + 1
+	// RoleAdmin can also end, delete and expire games, broadcast
+	// notices, and use the checkpoint, replication and webhook
+	// endpoints.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Credential is a username and password for the operator endpoints.
+// An empty username accepts any username with the password.
+type Credential struct {
+	Username string
+	Password string
+	Role     Role
+}
+
+// passwordCredential returns a credential giving anyone with
+// password the admin role.
+func passwordCredential(password string) Credential {
+	return Credential{Password: password, Role: RoleAdmin}
+}
+
+// ParseCredentials parses a comma-separated list of
+// username:password:role entries, where role is viewer or admin.
+func ParseCredentials(spec string) ([]Credential, error) {
+	var creds []Credential
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("credential for %q isn't of the form username:password:role", parts[0])
+		}
+		c := Credential{Username: parts[0], Password: parts[1]}
+		switch parts[2] {
+		case "viewer":
+			c.Role = RoleViewer
+		case "admin":
+			c.Role = RoleAdmin
+		default:
+			return nil, fmt.Errorf("credential for %q has unknown role %q", parts[0], parts[2])
+		}
+		creds = append(creds, c)
+	}
+	return creds, nil
+}
+
+// adminCredentials returns the credentials accepted by the /admin
+// endpoints: s.AdminCredentials, and the bootstrap password as an
+// admin.
+func (s *Server) adminCredentials(bootstrapPW string) []Credential {
+	creds := append([]Credential(nil), s.AdminCredentials...)
+	if bootstrapPW != "" {
+		creds = append(creds, passwordCredential(bootstrapPW))
+	}
+	return creds
+}
+
+// adminGameSummary describes a game in the /admin/games list.
+type adminGameSummary struct {
+	ID string `json:"id"`
+	// Started is false for placeholders players have joined before
+	// the game was created.
+	Started bool `json:"started"`
+	// Connected is the number of players connected over websockets,
+	// and Joined the number with sessions.
+	Connected    int       `json:"connected"`
+	Joined       int       `json:"joined"`
+	Host         string    `json:"host,omitempty"`
+	Private      bool      `json:"private,omitempty"`
+	Won          bool      `json:"won,omitempty"`
+	Score        int       `json:"score"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	WordSetBytes int64     `json:"word_set_bytes,omitempty"`
+}
+
+// GET /admin/games
+//
+// handleAdminGames lists the games in memory on this server, most
+// recently active first.
+func (s *Server) handleAdminGames(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	games := []adminGameSummary{}
+	s.games.each(func(id string, gh *GameHandle) {
+		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		sum := adminGameSummary{
+			ID:        id,
+			Connected: len(gh.websockets),
+			Joined:    len(gh.pendingSessions),
+			Host:      gh.pendingHost,
+		}
+		if g := gh.g; g != nil {
+			sum.Started = true
+			sum.Joined = len(g.Sessions)
+			sum.Host = g.Host
+			sum.Private = g.PasscodeHash != ""
+			sum.Won = g.Won
+			sum.Score = g.Score
+			sum.CreatedAt = g.CreatedAt
+			sum.UpdatedAt = g.UpdatedAt
+			sum.WordSetBytes = s.wordSetBytes(gh)
+		}
+		games = append(games, sum)
+	})
+	s.mu.Unlock()
+
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].UpdatedAt.After(games[j].UpdatedAt)
+	})
+	writeJSON(rw, struct {
+		Games []adminGameSummary `json:"games"`
+	}{games})
+}
+
+// adminGameDetail is a game's full server state.
+type adminGameDetail struct {
+	Game             *Game             `json:"game"`
+	Connected        []string          `json:"connected"`
+	PendingSessions  map[string]string `json:"pending_sessions,omitempty"`
+	PendingHost      string            `json:"pending_host,omitempty"`
+	StateID          string            `json:"state_id,omitempty"`
+	WordSetBytes     int64             `json:"word_set_bytes,omitempty"`
+	RetainedUntilUTC time.Time         `json:"retained_until_utc,omitempty"`
+}
+
+// GET /admin/game?id=...
+//
+// handleAdminGame returns everything the server holds for a game,
+// including what isn't sent to players.
+func (s *Server) handleAdminGame(rw http.ResponseWriter, req *http.Request) {
+	id, err := ParseGameID(req.URL.Query().Get("id"))
+	if err != nil {
+		writeError(rw, 400, err.Error())
+		return
+	}
+	gh := s.getGame(id)
+	if gh == nil {
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	defer s.releaseGame(gh)
+
+	gh.mu.Lock()
+	detail := adminGameDetail{
+		Connected:       gh.getPlayerIDs(),
+		PendingSessions: copySessions(gh.pendingSessions),
+		PendingHost:     gh.pendingHost,
+	}
+	if gh.g != nil {
+		detail.Game = gh.g.clone()
+		detail.StateID = gh.g.StateID()
+		detail.WordSetBytes = s.wordSetBytes(gh)
+		detail.RetainedUntilUTC = gh.g.UpdatedAt.Add(s.retention()).UTC()
+	}
+	gh.mu.Unlock()
+	sort.Strings(detail.Connected)
+	writeJSON(rw, detail)
+}
+
+// adminGameRequest names the game an admin request acts on.
+type adminGameRequest struct {
+	GameID GameID `json:"game_id"`
+}
+
+// POST /admin/end-game
+//
+// handleAdminEndGame ends a game as if it had been finished, so its
+// players see it's over and can only start the next one.
+func (s *Server) handleAdminEndGame(rw http.ResponseWriter, req *http.Request) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+	var request adminGameRequest
+	if !decodeJSON(rw, req, &request) {
+		return
+	}
+	gh := s.getGame(request.GameID)
+	if gh == nil {
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	defer s.releaseGame(gh)
+
+	var started bool
+	gh.update(req.Context(), func(g *Game) bool {
+		if g == nil || g.Won {
+			started = g != nil
+			return false
+		}
+		started = true
+		g.Won = true
+		g.UpdatedAt = time.Now()
+		s.metrics.checkFinished(g, false)
+		return true
+	})
+	if !started {
+		writeError(rw, 400, "The game hasn't started yet")
+		return
+	}
+	loggerFrom(req.Context()).Info("admin ended game", "game_id", request.GameID, "operator", operator(req))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/delete-game
+//
+// handleAdminDeleteGame removes a game from memory and the store and
+// disconnects its players.
+func (s *Server) handleAdminDeleteGame(rw http.ResponseWriter, req *http.Request) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+	var request adminGameRequest
+	if !decodeJSON(rw, req, &request) {
+		return
+	}
+
+	// The game is removed from memory under the server lock, and
+	// lookups don't load it again until it's gone from the store.
+	id := string(request.GameID)
+	g, found := func() (*Game, bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		gh := s.lookupLocked(request.GameID)
+		if gh == nil {
+			return nil, false
+		}
+		s.deleting[id] = true
+		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		gh.expired = true
+		s.games.remove(id)
+		for playerID, c := range gh.websockets {
+			closeWebsocket(c, "The game was deleted by an administrator")
+			delete(gh.websockets, playerID)
+		}
+		return gh.g, true
+	}()
+	if !found {
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	err := s.Store.Delete(g)
+	s.mu.Lock()
+	delete(s.deleting, id)
+	s.mu.Unlock()
+	if err != nil {
+		loggerFrom(req.Context()).Error("unable to delete game from store", "game_id", request.GameID, "err", err)
+		writeError(rw, 500, "Unable to delete the game from the store")
+		return
+	}
+	loggerFrom(req.Context()).Info("admin deleted game", "game_id", request.GameID, "operator", operator(req))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/broadcast
+//
+// handleAdminBroadcast sends a notice, such as upcoming maintenance,
+// to every player connected to this server over a websocket.
+func (s *Server) handleAdminBroadcast(rw http.ResponseWriter, req *http.Request) {
+	var request struct {
+		Message string `json:"message"`
+	}
+	if !decodeJSON(rw, req, &request) {
+		return
+	}
+	if strings.TrimSpace(request.Message) == "" {
+		writeError(rw, 400, "message is required")
+		return
+	}
+
+	var gameIDs []string
+	var websockets int
+	s.mu.Lock()
+	s.games.each(func(id string, gh *GameHandle) {
+		gh.mu.Lock()
+		if n := len(gh.websockets); n > 0 {
+			gameIDs = append(gameIDs, id)
+			websockets += n
+		}
+		gh.mu.Unlock()
+	})
+	s.mu.Unlock()
+
+	// Notices go through the broker like game updates, so each
+	// websocket still has a single writer.
+	for _, id := range gameIDs {
+		s.broker.Publish(GameEvent{Type: GameNotice, GameID: id, Notice: request.Message})
+	}
+	loggerFrom(req.Context()).Info("admin broadcast notice", "games", len(gameIDs), "websockets", websockets, "operator", operator(req))
+	writeJSON(rw, struct {
+		Games      int `json:"games"`
+		Websockets int `json:"websockets"`
+	}{len(gameIDs), websockets})
+}
+
+// POST /admin/expire
+//
+// handleAdminExpire removes expired games now instead of waiting for
+// the next periodic expiry.
+func (s *Server) handleAdminExpire(rw http.ResponseWriter, req *http.Request) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+	if err := s.expireGames(time.Now()); err != nil {
+		loggerFrom(req.Context()).Error("expire games", "err", err)
+		writeError(rw, 500, "Unable to expire games: "+err.Error())
+		return
+	}
+	s.mu.Lock()
+	n := s.games.len()
+	s.mu.Unlock()
+	loggerFrom(req.Context()).Info("admin expired games", "games_in_memory", n, "operator", operator(req))
+	writeJSON(rw, struct {
+		GamesInMemory int `json:"games_in_memory"`
+	}{n})
+}
+
+// operator returns the username an admin request authenticated with.
+func operator(req *http.Request) string {
+	user, _, _ := req.BasicAuth()
+	return user
+}
+
+// basicAuth only lets requests through to handler if they carry one
+// of creds with at least role need. Requests with valid credentials
+// for a lesser role get a 403.
+func basicAuth(handler http.Handler, realm string, need Role, creds ...Credential) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		var role Role
+		if ok {
+			// Check every credential so the time taken doesn't
+			// reveal which one matched.
+			for _, c := range creds {
+				userOK := c.Username == "" || subtle.ConstantTimeCompare([]byte(user), []byte(c.Username)) == 1
+				passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(c.Password)) == 1
+				if userOK && passOK && c.Role > role {
+					role = c.Role
+				}
+			}
+		}
+		if role == 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			w.WriteHeader(401)
+			io.WriteString(w, "Unauthorized\n")
+			return
+		}
+		if role < need {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "Forbidden\n")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// setupAdmin registers the /admin endpoints, if any credentials are
+// configured for them.
+func (s *Server) setupAdmin(creds []Credential) {
+	if len(creds) == 0 {
+		return
+	}
+	s.Log.Info("/admin endpoints enabled")
+	view := func(name string, h http.HandlerFunc) http.Handler {
+		return basicAuth(s.instrument(name, getOnly(h)), "admin", RoleViewer, creds...)
+	}
+	act := func(name string, h http.HandlerFunc) http.Handler {
+		return basicAuth(s.instrument(name, jsonEndpoint(maxRequestBodyBytes, h)), "admin", RoleAdmin, creds...)
+	}
+	s.mux.Handle("/admin/games", view("admin_games", s.handleAdminGames))
+	s.mux.Handle("/admin/game", view("admin_game", s.handleAdminGame))
+	s.mux.Handle("/admin/end-game", act("admin_end_game", s.handleAdminEndGame))
+	s.mux.Handle("/admin/delete-game", act("admin_delete_game", s.handleAdminDeleteGame))
+	s.mux.Handle("/admin/broadcast", act("admin_broadcast", s.handleAdminBroadcast))
+	// Expiry takes no body, but is POSTed like the other actions.
+	s.mux.Handle("/admin/expire", basicAuth(s.instrument("admin_expire", postOnly(s.handleAdminExpire)), "admin", RoleAdmin, creds...))
+}
+
+func getOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.Header().Set("Allow", "GET")
+			writeError(rw, http.StatusMethodNotAllowed, "Method not allowed; use GET")
+			return
+		}
+		h(rw, req)
+	}
+}
+
+func postOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			writeError(rw, http.StatusMethodNotAllowed, "Method not allowed; use POST")
+			return
+		}
+		h(rw, req)
+	}
+}
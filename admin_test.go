@@ -0,0 +1,186 @@
+package crossclues
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseCredentials(t *testing.T) {
+	creds, err := ParseCredentials("ops:hunter2:admin, support:letmein:viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Credential{
+		{Username: "ops", Password: "hunter2", Role: RoleAdmin},
+		{Username: "support", Password: "letmein", Role: RoleViewer},
+	}
+	if !reflect.DeepEqual(creds, want) {
+		t.Errorf("got %+v, want %+v", creds, want)
+	}
+	for _, bad := range []string{"ops:hunter2", "ops:hunter2:root", ":hunter2:admin", "ops::admin"} {
+		if _, err := ParseCredentials(bad); err == nil {
+			t.Errorf("ParseCredentials(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestBasicAuthRoles(t *testing.T) {
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	creds := []Credential{
+		{Username: "support", Password: "letmein", Role: RoleViewer},
+		{Username: "ops", Password: "hunter2", Role: RoleAdmin},
+		passwordCredential("bootstrap"),
+	}
+	for _, tc := range []struct {
+		user, pass string
+		need       Role
+		want       int
+	}{
+		{"", "", RoleViewer, 401},
+		{"support", "wrong", RoleViewer, 401},
+		{"ops", "letmein", RoleViewer, 401},
+		{"support", "letmein", RoleViewer, 200},
+		{"support", "letmein", RoleAdmin, 403},
+		{"ops", "hunter2", RoleAdmin, 200},
+		{"anyone", "bootstrap", RoleAdmin, 200},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		rw := httptest.NewRecorder()
+		basicAuth(ok, "admin", tc.need, creds...).ServeHTTP(rw, req)
+		if rw.Code != tc.want {
+			t.Errorf("%s:%s for %s returned %d, want %d", tc.user, tc.pass, tc.need, rw.Code, tc.want)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	store := newMemStore()
+	s := &Server{Store: store, AdminCredentials: []Credential{
+		{Username: "support", Password: "letmein", Role: RoleViewer},
+		{Username: "ops", Password: "hunter2", Role: RoleAdmin},
+	}}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	admin := func(method, path, user, pass string, body interface{}, out interface{}) int {
+		t.Helper()
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(user, pass)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode == 200 {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	alice := join(t, ts.URL, "live", "alice")
+	start := map[string]interface{}{"game_id": "live", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize}
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, start, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/websocket/live/alice?session=" + alice
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var g Game
+	if err := conn.ReadJSON(&g); err != nil {
+		t.Fatal(err)
+	}
+
+	var list struct {
+		Games []adminGameSummary `json:"games"`
+	}
+	if code := admin("GET", "/admin/games", "support", "letmein", nil, &list); code != 200 {
+		t.Fatalf("/admin/games returned %d", code)
+	}
+	if len(list.Games) != 1 || list.Games[0].ID != "live" || list.Games[0].Connected != 1 || list.Games[0].Joined != 1 || !list.Games[0].Started {
+		t.Errorf("/admin/games listed %+v", list.Games)
+	}
+	var detail adminGameDetail
+	if code := admin("GET", "/admin/game?id=live", "support", "letmein", nil, &detail); code != 200 {
+		t.Fatalf("/admin/game returned %d", code)
+	}
+	if detail.Game == nil || detail.Game.Host != "alice" || len(detail.Game.Sessions) != 1 || !reflect.DeepEqual(detail.Connected, []string{"alice"}) {
+		t.Errorf("/admin/game returned %+v", detail)
+	}
+	if code := admin("GET", "/admin/game?id=missing", "support", "letmein", nil, nil); code != 404 {
+		t.Errorf("/admin/game for a missing game returned %d", code)
+	}
+
+	live := map[string]interface{}{"game_id": "live"}
+	if code := admin("POST", "/admin/end-game", "support", "letmein", live, nil); code != http.StatusForbidden {
+		t.Errorf("/admin/end-game as a viewer returned %d, want 403", code)
+	}
+	if code := admin("POST", "/admin/end-game", "ops", "hunter2", live, nil); code != http.StatusNoContent {
+		t.Fatalf("/admin/end-game returned %d", code)
+	}
+	if err := conn.ReadJSON(&g); err != nil || !g.Won {
+		t.Errorf("after /admin/end-game, the websocket got %+v, %v", g, err)
+	}
+	if n := atomic.LoadUint64(&s.metrics.gamesFinished); n != 1 {
+		t.Errorf("after /admin/end-game, %d games were counted finished, want 1", n)
+	}
+
+	var broadcast struct{ Games, Websockets int }
+	notice := map[string]interface{}{"message": "Restarting in 5 minutes"}
+	if code := admin("POST", "/admin/broadcast", "ops", "hunter2", notice, &broadcast); code != 200 || broadcast.Websockets != 1 {
+		t.Fatalf("/admin/broadcast returned %d, %+v", code, broadcast)
+	}
+	var msg noticeMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Notice != "Restarting in 5 minutes" {
+		t.Errorf("websocket got notice %+v, %v", msg, err)
+	}
+
+	if code := admin("POST", "/admin/delete-game", "ops", "hunter2", live, nil); code != http.StatusNoContent {
+		t.Fatalf("/admin/delete-game returned %d", code)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("websocket of a deleted game got %v", err)
+	}
+	if code := admin("GET", "/admin/game?id=live", "support", "letmein", nil, nil); code != 404 {
+		t.Errorf("/admin/game for a deleted game returned %d", code)
+	}
+	if _, ok := store.games["live"]; ok {
+		t.Errorf("deleted game is still in the store")
+	}
+
+	var expired struct {
+		GamesInMemory int `json:"games_in_memory"`
+	}
+	if code := admin("POST", "/admin/expire", "ops", "hunter2", nil, &expired); code != 200 || expired.GamesInMemory != 0 {
+		t.Errorf("/admin/expire returned %d, %+v", code, expired)
+	}
+	if code := admin("GET", "/admin/expire", "ops", "hunter2", nil, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/expire returned %d", code)
+	}
+}
@@ -0,0 +1,59 @@
+package crossclues
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/jbowens/dictionary"
+)
+
+// The word lists, the page template and the built frontend are
+// compiled into the binary so it runs from any directory. Until the
+// frontend is built, frontend/dist only holds a placeholder.
+var (
+	//go:embed assets/game-id-words.txt assets/original.txt assets/index.html
+	embeddedAssets embed.FS
+
+	//go:embed frontend/dist/*
+	embeddedStatic embed.FS
+
+	// The word sets players pick from in the frontend.
+	//go:embed frontend/words.json
+	embeddedWordSets []byte
+)
+
+// assets returns the files in AssetsDir, or the embedded ones.
+func (s *Server) assets() fs.FS {
+	if s.AssetsDir != "" {
+		return os.DirFS(s.AssetsDir)
+	}
+	sub, err := fs.Sub(embeddedAssets, "assets")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// static returns the built frontend in StaticDir, or the embedded one.
+func (s *Server) static() fs.FS {
+	if s.StaticDir != "" {
+		return os.DirFS(s.StaticDir)
+	}
+	sub, err := fs.Sub(embeddedStatic, "frontend/dist")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// loadDictionary reads a file of newline separated words, like
+// dictionary.Load but from fsys.
+func loadDictionary(fsys fs.FS, name string) (dictionary.Interface, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return dictionary.WithWords(strings.Split(strings.TrimSpace(string(b)), "\n")...), nil
+}
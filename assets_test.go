@@ -0,0 +1,98 @@
+package crossclues
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getBody(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestEmbeddedAssets(t *testing.T) {
+	// The server shouldn't need anything from the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tempDir(t, "cwd")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.gameIDWords) == 0 || len(s.defaultWords) == 0 {
+		t.Fatalf("loaded %d game ID words and %d words", len(s.gameIDWords), len(s.defaultWords))
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	code, body := getBody(t, ts.URL+"/some-game")
+	if code != 200 || !strings.Contains(body, `data-selected-game-id="some-game"`) {
+		t.Fatalf("GET /some-game returned %d:\n%s", code, body)
+	}
+	if code, _ := getBody(t, ts.URL+"/static/missing.js"); code != 404 {
+		t.Fatalf("GET /static/missing.js returned %d, want 404", code)
+	}
+}
+
+func TestAssetOverrides(t *testing.T) {
+	assets := tempDir(t, "assets")
+	files := map[string]string{
+		"game-id-words.txt": "alpha\nbravo\ncharlie\n",
+		"original.txt":      "one\ntwo\nthree\n",
+		"index.html":        "<p>{{.SelectedGameID}} in development</p>",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(assets, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	static := tempDir(t, "static")
+	if err := ioutil.WriteFile(filepath.Join(static, "app.js"), []byte("// development build"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Store: newMemStore(), AssetsDir: assets, StaticDir: static, GameIDEntropy: 3}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.gameIDWords) != 3 || len(s.defaultWords) != 3 {
+		t.Fatalf("loaded game ID words %q and words %q", s.gameIDWords, s.defaultWords)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if code, body := getBody(t, ts.URL+"/some-game"); code != 200 || body != "<p>some-game in development</p>" {
+		t.Fatalf("GET /some-game returned %d: %q", code, body)
+	}
+	if code, body := getBody(t, ts.URL+"/static/app.js"); code != 200 || body != "// development build" {
+		t.Fatalf("GET /static/app.js returned %d: %q", code, body)
+	}
+
+	// An override directory replaces the embedded files entirely.
+	if err := os.Remove(filepath.Join(assets, "original.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Server{Store: newMemStore(), AssetsDir: assets}).setup(); err == nil {
+		t.Fatal("setup succeeded without original.txt")
+	}
+}
@@ -0,0 +1,543 @@
+package crossclues
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup stream is a gzipped sequence of gob values: a
+// BackupManifest describing every file in a Pebble checkpoint,
+// followed by the contents of the files the receiver doesn't already
+// have, split into BackupChunks. Files are identified by the SHA-256
+// of their contents, so a receiver that lists the checksums it holds
+// only gets the files that changed since its last backup, and one
+// that was interrupted can resume without downloading completed
+// files again.
+//
+// Backups are stored in a directory laid out as
+//
+//	objects/<sha256>          file contents, by checksum
+//	manifests/<created>.json  one BackupManifest per completed backup
+//
+// so that successive incremental backups share unchanged files. Only
+// the newest backupsKept backups are kept.
+
+// BackupFormatVersion is the version of the backup stream and
+// manifest format.
+const BackupFormatVersion = 1
+
+const backupChunkSize = 1 << 20
+
+// backupsKept is how many completed backups a backup directory
+// keeps. Older ones are removed after each backup, along with the
+// objects only they used.
+const backupsKept = 10
+
+// BackupManifest lists the files that make up a backup.
+type BackupManifest struct {
+	Version   int
+	CreatedAt time.Time
+	Files     []BackupFile
+}
+
+// BackupFile is a file in a Pebble checkpoint.
+type BackupFile struct {
+	Name   string // relative to the checkpoint directory
+	Size   int64
+	SHA256 string // hex encoded
+}
+
+// validate checks that the manifest's checksums and file names are
+// safe to build paths from: checksums are 64 lowercase hex digits,
+// and names are clean paths inside the checkpoint directory.
+func (m *BackupManifest) validate() error {
+	for _, f := range m.Files {
+		if len(f.SHA256) != 2*sha256.Size || strings.Trim(f.SHA256, "0123456789abcdef") != "" {
+			return fmt.Errorf("backup file %q has an invalid checksum %q", f.Name, f.SHA256)
+		}
+		if f.Size < 0 {
+			return fmt.Errorf("backup file %q has a negative size", f.Name)
+		}
+		if f.Name == "" || f.Name == "." || path.Clean(f.Name) != f.Name || path.IsAbs(f.Name) ||
+			f.Name == ".." || strings.HasPrefix(f.Name, "../") || strings.Contains(f.Name, `\`) {
+			return fmt.Errorf("backup file name %q isn't a clean relative path", f.Name)
+		}
+	}
+	return nil
+}
+
+// BackupChunk is a piece of a file's contents. The chunks of a file
+// are sent in order and aren't interleaved with other files'.
+type BackupChunk struct {
+	SHA256 string
+	Data   []byte
+}
+
+// writeBackup streams the checkpoint in dir to w, omitting the
+// contents of files whose checksums are in have.
+func writeBackup(w io.Writer, dir string, have map[string]bool, l *Logger) error {
+	manifest := BackupManifest{Version: BackupFormatVersion, CreatedAt: time.Now().UTC()}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name:   filepath.ToSlash(relPath),
+			Size:   info.Size(),
+			SHA256: sum,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name })
+
+	gzipWriter := gzip.NewWriter(w)
+	enc := gob.NewEncoder(gzipWriter)
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+
+	buf := make([]byte, backupChunkSize)
+	sent := make(map[string]bool)
+	for _, f := range manifest.Files {
+		if have[f.SHA256] || sent[f.SHA256] {
+			continue
+		}
+		sent[f.SHA256] = true
+		l.Debug("checkpoint sending file", "file", f.Name, "bytes", f.Size)
+		if err := sendBackupFile(enc, filepath.Join(dir, filepath.FromSlash(f.Name)), f.SHA256, buf); err != nil {
+			return err
+		}
+	}
+	return gzipWriter.Close()
+}
+
+func sendBackupFile(enc *gob.Encoder, path, sum string, buf []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Always send at least one chunk, so empty files arrive too.
+	for first := true; ; first = false {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF && !first {
+			return nil
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if encErr := enc.Encode(BackupChunk{SHA256: sum, Data: buf[:n]}); encErr != nil {
+			return encErr
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// BackupChecksums returns the checksums of files already stored in
+// the backup directory dir that the next backup is likely to share.
+// It's sent to the server so it can omit them. Those are the files
+// of the latest backup, which change little between backups, and
+// ones left by an interrupted backup since, but not the files only
+// older backups have, so the list stays the size of one backup.
+func BackupChecksums(dir string) (map[string]bool, error) {
+	manifests, err := readManifests(dir)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	for _, m := range manifests {
+		for _, f := range m.Files {
+			listed[f.SHA256] = true
+		}
+	}
+	have := make(map[string]bool)
+	if len(manifests) > 0 {
+		for _, f := range manifests[len(manifests)-1].Files {
+			have[f.SHA256] = true
+		}
+	}
+	ls, err := ioutil.ReadDir(filepath.Join(dir, "objects"))
+	if os.IsNotExist(err) {
+		return have, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, fi := range ls {
+		if !strings.HasSuffix(fi.Name(), ".partial") && !listed[fi.Name()] {
+			have[fi.Name()] = true
+		}
+	}
+	return have, nil
+}
+
+// ReadBackup reads a backup stream into the backup directory dir.
+// Each file is checked against the manifest as it completes, and the
+// manifest is only written once every file it lists is present, so
+// an interrupted backup can be resumed by passing BackupChecksums to
+// the server again.
+func ReadBackup(r io.Reader, dir string, l *Logger) (*BackupManifest, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := gob.NewDecoder(gzr)
+
+	var manifest BackupManifest
+	if err := dec.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	if manifest.Version != BackupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version %d", manifest.Version)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(manifest.Files))
+	for _, f := range manifest.Files {
+		sizes[f.SHA256] = f.Size
+	}
+
+	objects := filepath.Join(dir, "objects")
+	if err := os.MkdirAll(objects, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	var cur *partialObject
+	defer func() {
+		if cur != nil {
+			cur.f.Close()
+		}
+	}()
+	for {
+		var chunk BackupChunk
+		err := dec.Decode(&chunk)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if cur == nil || cur.sum != chunk.SHA256 {
+			if cur != nil {
+				return nil, fmt.Errorf("file %s ended after %d bytes", cur.sum, cur.n)
+			}
+			size, ok := sizes[chunk.SHA256]
+			if !ok {
+				return nil, fmt.Errorf("file %s isn't in the manifest", chunk.SHA256)
+			}
+			cur, err = createPartialObject(objects, chunk.SHA256, size)
+			if err != nil {
+				return nil, err
+			}
+		}
+		done, err := cur.write(chunk.Data)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			l.Info("downloaded backup object", "sha256", cur.sum, "bytes", cur.n)
+			cur = nil
+		}
+	}
+	if cur != nil {
+		return nil, fmt.Errorf("file %s ended after %d bytes", cur.sum, cur.n)
+	}
+
+	if err := checkBackupObjects(dir, &manifest, false); err != nil {
+		return nil, err
+	}
+	if err := writeManifest(dir, &manifest); err != nil {
+		return nil, err
+	}
+	if err := pruneBackups(dir, l); err != nil {
+		return nil, fmt.Errorf("pruning old backups: %w", err)
+	}
+	return &manifest, nil
+}
+
+type partialObject struct {
+	f    *os.File
+	path string
+	sum  string
+	size int64
+	n    int64
+	h    hash.Hash
+}
+
+func createPartialObject(objects, sum string, size int64) (*partialObject, error) {
+	path := filepath.Join(objects, sum)
+	f, err := os.Create(path + ".partial")
+	if err != nil {
+		return nil, err
+	}
+	return &partialObject{f: f, path: path, sum: sum, size: size, h: sha256.New()}, nil
+}
+
+// write appends data to the object and reports whether it's
+// complete. Complete objects are verified and moved into place.
+func (po *partialObject) write(data []byte) (bool, error) {
+	po.n += int64(len(data))
+	if po.n > po.size {
+		return false, fmt.Errorf("file %s is larger than the %d bytes in the manifest", po.sum, po.size)
+	}
+	if _, err := po.f.Write(data); err != nil {
+		return false, err
+	}
+	po.h.Write(data)
+	if po.n < po.size {
+		return false, nil
+	}
+
+	if got := hex.EncodeToString(po.h.Sum(nil)); got != po.sum {
+		po.f.Close()
+		return false, fmt.Errorf("file %s has checksum %s", po.sum, got)
+	}
+	if err := po.f.Sync(); err != nil {
+		po.f.Close()
+		return false, err
+	}
+	if err := po.f.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(po.path+".partial", po.path)
+}
+
+func writeManifest(dir string, m *BackupManifest) error {
+	manifests := filepath.Join(dir, "manifests")
+	if err := os.MkdirAll(manifests, os.ModePerm); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(manifests, fmt.Sprintf("%019d.json", m.CreatedAt.UnixNano()))
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// manifestPaths returns the paths of the manifests in dir, oldest
+// first.
+func manifestPaths(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "manifests", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func readManifest(path string) (*BackupManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// readManifests returns the manifests of the completed backups in
+// dir, oldest first.
+func readManifests(dir string) ([]*BackupManifest, error) {
+	paths, err := manifestPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ms []*BackupManifest
+	for _, path := range paths {
+		m, err := readManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// LatestBackup returns the manifest of the most recent completed
+// backup in dir.
+func LatestBackup(dir string) (*BackupManifest, error) {
+	paths, err := manifestPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no completed backups in %q", dir)
+	}
+	return readManifest(paths[len(paths)-1])
+}
+
+// pruneBackups removes all but the newest backupsKept backups from
+// dir, then every object that the remaining ones don't list,
+// including any left by interrupted backups.
+func pruneBackups(dir string, l *Logger) error {
+	paths, err := manifestPaths(dir)
+	if err != nil {
+		return err
+	}
+	if len(paths) > backupsKept {
+		for _, path := range paths[:len(paths)-backupsKept] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	manifests, err := readManifests(dir)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, m := range manifests {
+		for _, f := range m.Files {
+			listed[f.SHA256] = true
+		}
+	}
+	objects := filepath.Join(dir, "objects")
+	ls, err := ioutil.ReadDir(objects)
+	if err != nil {
+		return err
+	}
+	var n int
+	for _, fi := range ls {
+		if listed[strings.TrimSuffix(fi.Name(), ".partial")] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(objects, fi.Name())); err != nil {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		l.Info("removed unused backup objects", "objects", n)
+	}
+	return nil
+}
+
+// checkBackupObjects checks that every file in the manifest is in
+// the backup directory with the right size and, if rehash is set,
+// the right checksum.
+func checkBackupObjects(dir string, m *BackupManifest, rehash bool) error {
+	for _, f := range m.Files {
+		path := filepath.Join(dir, "objects", f.SHA256)
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("backup file %s: %w", f.Name, err)
+		}
+		if info.Size() != f.Size {
+			return fmt.Errorf("backup file %s has %d bytes, want %d", f.Name, info.Size(), f.Size)
+		}
+		if !rehash {
+			continue
+		}
+		sum, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+		if sum != f.SHA256 {
+			return fmt.Errorf("backup file %s is corrupt: checksum %s, want %s", f.Name, sum, f.SHA256)
+		}
+	}
+	return nil
+}
+
+// RestoreBackup verifies the most recent backup in backupDir and
+// writes its files into dbDir, which must be empty. Nothing is
+// written unless every file passes its checksum.
+func RestoreBackup(backupDir, dbDir string) (*BackupManifest, error) {
+	m, err := LatestBackup(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if err := checkBackupObjects(backupDir, m, true); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dbDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	ls, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(ls) > 0 {
+		return nil, fmt.Errorf("directory %q is not empty: aborting", dbDir)
+	}
+
+	for _, f := range m.Files {
+		dst := filepath.Join(dbDir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err := copyFile(filepath.Join(backupDir, "objects", f.SHA256), dst); err != nil {
+			return nil, fmt.Errorf("restoring %s: %w", f.Name, err)
+		}
+	}
+	return m, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,361 @@
+package crossclues
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func tempDir(t *testing.T, pattern string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func openStore(t *testing.T, dir string) *PebbleStore {
+	t.Helper()
+	db, err := pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &PebbleStore{DB: db}
+}
+
+func saveGames(t *testing.T, ps *PebbleStore, games map[string]*Game) {
+	t.Helper()
+	for _, g := range games {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ps.DB.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRestored(t *testing.T, dbDir string, games map[string]*Game) {
+	t.Helper()
+	ps := openStore(t, dbDir)
+	for id := range games {
+		g, err := ps.Load(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g == nil {
+			t.Errorf("game %q missing from restored store", id)
+		}
+	}
+}
+
+func TestBackupIncrementalRestore(t *testing.T) {
+	ps := openStore(t, tempDir(t, "test-backup-src-*"))
+	backupDir := tempDir(t, "test-backup-*")
+
+	games := randomGames(5)
+	saveGames(t, ps, games)
+
+	var full bytes.Buffer
+	if err := ps.Checkpoint(&full, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadBackup(&full, backupDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) == 0 {
+		t.Fatal("backup has no files")
+	}
+
+	// Add more games, then take an incremental backup.
+	more := randomGames(10)
+	saveGames(t, ps, more)
+	have, err := BackupChecksums(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var incremental bytes.Buffer
+	if err := ps.Checkpoint(&incremental, have); err != nil {
+		t.Fatal(err)
+	}
+	var fullAgain bytes.Buffer
+	if err := ps.Checkpoint(&fullAgain, nil); err != nil {
+		t.Fatal(err)
+	}
+	if incremental.Len() >= fullAgain.Len() {
+		t.Errorf("incremental backup is %d bytes, full backup is %d", incremental.Len(), fullAgain.Len())
+	}
+	if _, err := ReadBackup(&incremental, backupDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir := filepath.Join(tempDir(t, "test-restore-*"), "db")
+	if _, err := RestoreBackup(backupDir, dbDir); err != nil {
+		t.Fatal(err)
+	}
+	checkRestored(t, dbDir, more)
+
+	// Restoring again into a non-empty directory is refused.
+	if _, err := RestoreBackup(backupDir, dbDir); err == nil {
+		t.Errorf("restore into a non-empty directory succeeded")
+	}
+}
+
+func TestBackupResume(t *testing.T) {
+	ps := openStore(t, tempDir(t, "test-backup-src-*"))
+	backupDir := tempDir(t, "test-backup-*")
+	games := randomGames(5)
+	saveGames(t, ps, games)
+
+	var full bytes.Buffer
+	if err := ps.Checkpoint(&full, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the stream off partway through.
+	truncated := bytes.NewReader(full.Bytes()[:full.Len()*2/3])
+	if _, err := ReadBackup(truncated, backupDir, nil); err == nil {
+		t.Fatal("reading a truncated backup succeeded")
+	}
+	if _, err := LatestBackup(backupDir); err == nil {
+		t.Fatal("an incomplete backup left a manifest")
+	}
+
+	have, err := BackupChecksums(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rest bytes.Buffer
+	if err := ps.Checkpoint(&rest, have); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBackup(&rest, backupDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	dbDir := tempDir(t, "test-restore-*")
+	if _, err := RestoreBackup(backupDir, dbDir); err != nil {
+		t.Fatal(err)
+	}
+	checkRestored(t, dbDir, games)
+}
+
+func TestBackupPrunesOldBackups(t *testing.T) {
+	ps := openStore(t, tempDir(t, "test-backup-src-*"))
+	backupDir := tempDir(t, "test-backup-*")
+
+	// An object left by an interrupted backup is offered to the
+	// server until a backup completes, and removed if it isn't used.
+	objects := filepath.Join(backupDir, "objects")
+	if err := os.MkdirAll(objects, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	orphan := strings.Repeat("0", 64)
+	if err := ioutil.WriteFile(filepath.Join(objects, orphan), []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := BackupChecksums(backupDir); err != nil || !have[orphan] {
+		t.Fatalf("BackupChecksums = %v, %v; want the interrupted backup's object", have, err)
+	}
+
+	for i := 0; i < backupsKept+2; i++ {
+		saveGames(t, ps, randomGames(5))
+		have, err := BackupChecksums(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := ps.Checkpoint(&b, have); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadBackup(&b, backupDir, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifests, err := readManifests(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != backupsKept {
+		t.Errorf("%d backups kept, want %d", len(manifests), backupsKept)
+	}
+	listed := make(map[string]bool)
+	for _, m := range manifests {
+		for _, f := range m.Files {
+			listed[f.SHA256] = true
+		}
+	}
+	ls, err := ioutil.ReadDir(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range ls {
+		if !listed[fi.Name()] {
+			t.Errorf("object %s isn't used by any kept backup", fi.Name())
+		}
+	}
+
+	// Only the latest backup's files are offered to the server.
+	have, err := BackupChecksums(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := manifests[len(manifests)-1]
+	if len(have) > len(latest.Files) {
+		t.Errorf("BackupChecksums lists %d files; the latest backup has %d", len(have), len(latest.Files))
+	}
+	for _, f := range latest.Files {
+		if !have[f.SHA256] {
+			t.Errorf("BackupChecksums is missing %s from the latest backup", f.Name)
+		}
+	}
+	dbDir := tempDir(t, "test-restore-*")
+	if _, err := RestoreBackup(backupDir, dbDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreChecksIntegrity(t *testing.T) {
+	ps := openStore(t, tempDir(t, "test-backup-src-*"))
+	backupDir := tempDir(t, "test-backup-*")
+	saveGames(t, ps, randomGames(5))
+
+	var full bytes.Buffer
+	if err := ps.Checkpoint(&full, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadBackup(&full, backupDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte in the largest file without changing its size.
+	var largest BackupFile
+	for _, f := range m.Files {
+		if f.Size > largest.Size {
+			largest = f
+		}
+	}
+	path := filepath.Join(backupDir, "objects", largest.SHA256)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xFF
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir := tempDir(t, "test-restore-*")
+	if _, err := RestoreBackup(backupDir, dbDir); err == nil {
+		t.Fatal("restoring a corrupt backup succeeded")
+	}
+	ls, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 0 {
+		t.Errorf("restore wrote %d files before detecting corruption", len(ls))
+	}
+}
+
+func TestBackupRejectsUnsafeManifests(t *testing.T) {
+	sum := strings.Repeat("ab", sha256.Size)
+	for _, f := range []BackupFile{
+		{Name: "000001.sst", SHA256: "../../escaped"},
+		{Name: "000001.sst", SHA256: strings.ToUpper(sum)},
+		{Name: "000001.sst", SHA256: sum[2:]},
+		{Name: "../escaped", SHA256: sum},
+		{Name: "/etc/escaped", SHA256: sum},
+		{Name: "dir/../../escaped", SHA256: sum},
+		{Name: `..\escaped`, SHA256: sum},
+		{Name: "", SHA256: sum},
+	} {
+		m := BackupManifest{Version: BackupFormatVersion, Files: []BackupFile{f}}
+
+		var stream bytes.Buffer
+		gzw := gzip.NewWriter(&stream)
+		enc := gob.NewEncoder(gzw)
+		if err := enc.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(BackupChunk{SHA256: f.SHA256, Data: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		backupDir := filepath.Join(tempDir(t, "test-backup-*"), "backup")
+		if _, err := ReadBackup(&stream, backupDir, nil); err == nil {
+			t.Errorf("ReadBackup accepted %+v", f)
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(backupDir), "escaped.partial")); err == nil {
+			t.Errorf("ReadBackup of %+v wrote outside the objects directory", f)
+		}
+
+		// A manifest already on disk is checked before restoring.
+		if err := writeManifest(backupDir, &m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RestoreBackup(backupDir, filepath.Join(backupDir, "db")); err == nil {
+			t.Errorf("RestoreBackup accepted %+v", f)
+		}
+	}
+}
+
+func TestCheckpointEndpoint(t *testing.T) {
+	s := &Server{Store: openStore(t, tempDir(t, "test-checkpoint-*")), BootstrapPassword: testBootstrapPW}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	have := make([]string, 20000)
+	for i := range have {
+		have[i] = strings.Repeat("ab", sha256.Size)
+	}
+	for _, tc := range []struct {
+		body interface{}
+		want int
+	}{
+		{map[string]interface{}{"have": []string{}}, 200},
+		{map[string]interface{}{"hav": []string{}}, 400},
+		{map[string]interface{}{"have": have}, http.StatusRequestEntityTooLarge},
+	} {
+		if code := postJSONAs(t, ts.URL+"/checkpoint", "", tc.body, nil); code != tc.want {
+			t.Errorf("POST /checkpoint returned %d, want %d", code, tc.want)
+		}
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/checkpoint", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", testBootstrapPW)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /checkpoint returned %d", resp.StatusCode)
+	}
+	if _, err := ReadBackup(resp.Body, tempDir(t, "test-backup-*"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
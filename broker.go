@@ -0,0 +1,179 @@
+package crossclues
+
+import (
+	"sync"
+)
+
+// GameEventType identifies what happened to a game.
+type GameEventType string
+
+const (
+	// GameUpdated is published whenever a game's state or its set of
+	// connected players changes.
+	GameUpdated GameEventType = "updated"
+	// GameReplaced is published when a game is swapped out for the
+	// next game under the same ID.
+	GameReplaced GameEventType = "replaced"
+	// GameNotice carries a message from the server's operators to
+	// the game's players, such as a maintenance warning. It doesn't
+	// change the game.
+	GameNotice GameEventType = "notice"
+)
+
+// GameEvent describes a change to a game. Game is a snapshot taken
+// when the event was published, and is nil for placeholder games
+// that players have connected to before the game was created.
+// Subscribers must not modify it.
+type GameEvent struct {
+	Type      GameEventType
+	GameID    string
+	Game      *Game
+	PlayerIDs []string // players connected over websockets
+	Notice    string   // the message of a GameNotice
+
+	// the span that published the event, so deliveries can be traced
+	// as its children
+	tracer *Tracer
+	trace  spanContext
+}
+
+// Broker fans game events out to subscribers. GameHandle publishes
+// to it, and websockets, long-polls and other observers subscribe to
+// it, so the delivery mechanism can be replaced without touching
+// game logic.
+type Broker interface {
+	// Publish delivers an event to every subscriber of its game and
+	// every subscriber to all games. It must not block on slow
+	// subscribers.
+	Publish(GameEvent)
+	// Subscribe calls fn with each event for gameID, or for every
+	// game if gameID is empty, until the returned function is
+	// called. Calls to a single subscriber's fn are never concurrent
+	// and arrive in the order the events were published. A game's
+	// subscribers may miss events if they fall behind, but
+	// subscribers to every game, which compare events to find what
+	// changed, get them all.
+	Subscribe(gameID string, fn func(GameEvent)) (unsubscribe func())
+}
+
+// subscriberQueueLen is how many events the memory broker buffers
+// for a game's subscriber before it starts dropping events for it.
+const subscriberQueueLen = 64
+
+// memoryBroker is the in-process Broker. Each subscriber has its own
+// queue and goroutine, so a slow websocket only delays itself.
+type memoryBroker struct {
+	log *Logger
+
+	mu   sync.Mutex
+	subs map[string]map[*brokerSub]bool // by game ID; "" is all games
+}
+
+type brokerSub struct {
+	ch chan GameEvent // nil for subscribers to every game
+
+	// Subscribers to every game queue events without bound instead.
+	mu     sync.Mutex
+	queue  []GameEvent
+	closed bool
+	wake   chan struct{}
+}
+
+// enqueue adds e to an all-games subscriber's queue.
+func (sub *brokerSub) enqueue(e GameEvent) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, e)
+	sub.mu.Unlock()
+	sub.signal()
+}
+
+func (sub *brokerSub) signal() {
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drain calls fn with queued events until the subscriber is closed.
+func (sub *brokerSub) drain(fn func(GameEvent)) {
+	for range sub.wake {
+		sub.mu.Lock()
+		events, closed := sub.queue, sub.closed
+		sub.queue = nil
+		sub.mu.Unlock()
+		if closed {
+			return
+		}
+		for _, e := range events {
+			fn(e)
+		}
+	}
+}
+
+// NewMemoryBroker returns a Broker that delivers events within the
+// process. Dropped events are logged to l.
+func NewMemoryBroker(l *Logger) Broker {
+	return &memoryBroker{log: l, subs: make(map[string]map[*brokerSub]bool)}
+}
+
+func (b *memoryBroker) Publish(e GameEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[e.GameID] {
+		select {
+		case sub.ch <- e:
+		default:
+			// Every event carries the whole game, so a subscriber
+			// that misses one catches up on the next.
+			b.log.Warn("dropped event: subscriber is behind", "event", e.Type, "game_id", e.GameID)
+		}
+	}
+	// Webhooks compare events to find what changed, and would miss
+	// a game finishing, so events for every game are never dropped.
+	for sub := range b.subs[""] {
+		sub.enqueue(e)
+	}
+}
+
+func (b *memoryBroker) Subscribe(gameID string, fn func(GameEvent)) func() {
+	sub := &brokerSub{wake: make(chan struct{}, 1)}
+	if gameID != "" {
+		sub.ch = make(chan GameEvent, subscriberQueueLen)
+	}
+	b.mu.Lock()
+	if b.subs[gameID] == nil {
+		b.subs[gameID] = make(map[*brokerSub]bool)
+	}
+	b.subs[gameID][sub] = true
+	b.mu.Unlock()
+
+	go func() {
+		if sub.ch == nil {
+			sub.drain(fn)
+			return
+		}
+		for e := range sub.ch {
+			fn(e)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs[gameID], sub)
+			if len(b.subs[gameID]) == 0 {
+				delete(b.subs, gameID)
+			}
+			if sub.ch == nil {
+				sub.mu.Lock()
+				sub.closed = true
+				sub.mu.Unlock()
+				sub.signal()
+				return
+			}
+			close(sub.ch)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package crossclues
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func receive(t *testing.T, ch <-chan GameEvent) GameEvent {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return GameEvent{}
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker(nil)
+
+	one, all := make(chan GameEvent, 10), make(chan GameEvent, 10)
+	unsubscribeOne := b.Subscribe("one", func(e GameEvent) { one <- e })
+	defer b.Subscribe("", func(e GameEvent) { all <- e })()
+
+	b.Publish(GameEvent{Type: GameUpdated, GameID: "one"})
+	b.Publish(GameEvent{Type: GameUpdated, GameID: "two"})
+	b.Publish(GameEvent{Type: GameReplaced, GameID: "one"})
+
+	if e := receive(t, one); e.Type != GameUpdated {
+		t.Errorf("first event = %+v, want %s", e, GameUpdated)
+	}
+	if e := receive(t, one); e.Type != GameReplaced {
+		t.Errorf("second event = %+v, want %s", e, GameReplaced)
+	}
+	for _, want := range []string{"one", "two", "one"} {
+		if e := receive(t, all); e.GameID != want {
+			t.Errorf("all-games subscriber got %q, want %q", e.GameID, want)
+		}
+	}
+
+	unsubscribeOne()
+	unsubscribeOne() // idempotent
+	b.Publish(GameEvent{Type: GameUpdated, GameID: "one"})
+	receive(t, all)
+	select {
+	case e := <-one:
+		t.Errorf("received %+v after unsubscribing", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerKeepsEventsForAllGames(t *testing.T) {
+	b := NewMemoryBroker(nil)
+
+	unblock := make(chan struct{})
+	all := make(chan GameEvent, 10*subscriberQueueLen)
+	defer b.Subscribe("", func(e GameEvent) {
+		<-unblock
+		all <- e
+	})()
+
+	n := 3 * subscriberQueueLen
+	for i := 0; i < n; i++ {
+		b.Publish(GameEvent{Type: GameUpdated, GameID: fmt.Sprint(i)})
+	}
+	close(unblock)
+	for i := 0; i < n; i++ {
+		if e := receive(t, all); e.GameID != fmt.Sprint(i) {
+			t.Fatalf("event %d is for game %q", i, e.GameID)
+		}
+	}
+}
+
+func TestWebsocketReceivesNextGame(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "pushed", "alice")
+	var g Game
+	code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "pushed", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, &g)
+	if code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/pushed/alice?session="+alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var pushed Game
+	if err := conn.ReadJSON(&pushed); err != nil {
+		t.Fatal(err)
+	}
+	if !pushed.CreatedAt.Equal(g.CreatedAt) {
+		t.Fatalf("websocket pushed %+v", pushed)
+	}
+
+	// The connection moves to the next game.
+	var next Game
+	code = postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "pushed", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, &next)
+	if code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	if err := conn.ReadJSON(&pushed); err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Seed != next.Seed || len(pushed.PlayerIDs) != 1 {
+		t.Errorf("websocket pushed %+v after next game, want seed %d with alice connected", pushed, next.Seed)
+	}
+}
@@ -0,0 +1,152 @@
+package crossclues
+
+import (
+	"container/list"
+)
+
+// DefaultMaxCachedGames is the number of games kept in memory when
+// Server.MaxCachedGames is unset.
+const DefaultMaxCachedGames = 1000
+
+// gameCache is a bounded, least-recently-used cache of game handles
+// keyed by game ID. It isn't safe for concurrent use; the Server
+// guards it with its own mutex.
+type gameCache struct {
+	capacity int
+	ll       *list.List // front is the most recently used entry
+	entries  map[string]*list.Element
+
+	// sizeOf, if set, returns the bytes a handle holds that count
+	// towards bytes. It's computed when the handle is added. Games
+	// are evicted while the total is over maxBytes, if that's set.
+	sizeOf   func(*GameHandle) int64
+	size     int64
+	maxBytes int64
+}
+
+type cacheEntry struct {
+	id   string
+	gh   *GameHandle
+	size int64
+}
+
+func newGameCache(capacity int) *gameCache {
+	return &gameCache{
+		capacity: capacity,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the handle for id and marks it as recently used.
+func (c *gameCache) get(id string) (*GameHandle, bool) {
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).gh, true
+}
+
+// put adds or replaces the handle for id, evicting the least
+// recently used games if the cache is over capacity.
+func (c *gameCache) put(id string, gh *GameHandle) {
+	var size int64
+	if c.sizeOf != nil {
+		size = c.sizeOf(gh)
+	}
+	if e, ok := c.entries[id]; ok {
+		entry := e.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.gh, entry.size = gh, size
+		c.ll.MoveToFront(e)
+	} else {
+		c.entries[id] = c.ll.PushFront(&cacheEntry{id: id, gh: gh, size: size})
+		c.size += size
+	}
+	c.evict()
+}
+
+func (c *gameCache) remove(id string) {
+	if e, ok := c.entries[id]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *gameCache) removeElement(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	c.ll.Remove(e)
+	delete(c.entries, entry.id)
+	c.size -= entry.size
+}
+
+func (c *gameCache) len() int {
+	return len(c.entries)
+}
+
+func (c *gameCache) over() bool {
+	return len(c.entries) > c.capacity || (c.maxBytes > 0 && c.size > c.maxBytes)
+}
+
+// bytes returns the total size of the cached handles, as measured by
+// sizeOf.
+func (c *gameCache) bytes() int64 {
+	return c.size
+}
+
+// inUseBytes returns the total size of the cached handles that
+// can't be evicted because they have websockets connected or
+// requests using them.
+func (c *gameCache) inUseBytes() int64 {
+	var n int64
+	for _, e := range c.entries {
+		entry := e.Value.(*cacheEntry)
+		if entry.size == 0 {
+			continue
+		}
+		entry.gh.mu.Lock()
+		if entry.gh.users > 0 || len(entry.gh.websockets) > 0 {
+			n += entry.size
+		}
+		entry.gh.mu.Unlock()
+	}
+	return n
+}
+
+// each calls fn for every cached game without affecting recency.
+// fn may remove the entry it's called with.
+func (c *gameCache) each(fn func(id string, gh *GameHandle)) {
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*cacheEntry)
+		fn(entry.id, entry.gh)
+		e = next
+	}
+}
+
+// evict drops least recently used games until the cache is within
+// capacity and maxBytes. Games with connected websockets are never
+// evicted, since their connections live on the handle, and nor are
+// games that requests are using, whose updates would be overwritten
+// by a copy loaded in the meantime, and nor are placeholders players
+// have joined, whose sessions aren't in the store. If every game is
+// in use the cache is allowed to grow past its capacity.
+//
+// Every update is saved to the store, so an evicted game is reloaded
+// from disk the next time it's requested. The most recently used
+// game is never evicted.
+func (c *gameCache) evict() {
+	for e := c.ll.Back(); e != c.ll.Front() && c.over(); {
+		prev := e.Prev()
+		entry := e.Value.(*cacheEntry)
+		entry.gh.mu.Lock()
+		inUse := entry.gh.users > 0 || len(entry.gh.websockets) > 0 ||
+			(entry.gh.g == nil && len(entry.gh.pendingSessions) > 0)
+		entry.gh.mu.Unlock()
+		if !inUse {
+			c.removeElement(e)
+			entry.gh.log.Debug("evicted game from memory")
+		}
+		e = prev
+	}
+}
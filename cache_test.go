@@ -0,0 +1,177 @@
+package crossclues
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestGameCacheLRU(t *testing.T) {
+	c := newGameCache(2)
+	a, b, d := loadedHandle("", nil, discardStore{}, nil, nil), loadedHandle("", nil, discardStore{}, nil, nil), loadedHandle("", nil, discardStore{}, nil, nil)
+
+	c.put("a", a)
+	c.put("b", b)
+	// Touch "a" so "b" becomes the least recently used.
+	if gh, ok := c.get("a"); !ok || gh != a {
+		t.Fatalf("get(a) = %v, %t", gh, ok)
+	}
+	c.put("d", d)
+
+	if _, ok := c.get("b"); ok {
+		t.Errorf("b should have been evicted")
+	}
+	for _, id := range []string{"a", "d"} {
+		if _, ok := c.get(id); !ok {
+			t.Errorf("%s should still be cached", id)
+		}
+	}
+}
+
+func TestGameCacheKeepsConnectedGames(t *testing.T) {
+	c := newGameCache(1)
+	connected := loadedHandle("", nil, discardStore{}, nil, nil)
+	connected.websockets["player"] = &websocket.Conn{}
+
+	c.put("connected", connected)
+	c.put("other", loadedHandle("", nil, discardStore{}, nil, nil))
+	c.put("newest", loadedHandle("", nil, discardStore{}, nil, nil))
+
+	if _, ok := c.get("connected"); !ok {
+		t.Errorf("game with a websocket was evicted")
+	}
+	if _, ok := c.get("other"); ok {
+		t.Errorf("idle game should have been evicted")
+	}
+	if c.len() != 2 {
+		t.Errorf("cache holds %d games, want 2", c.len())
+	}
+}
+
+func TestGameCacheKeepsJoinedPlaceholders(t *testing.T) {
+	c := newGameCache(1)
+	joined := loadedHandle("joined", nil, discardStore{}, nil, nil)
+	joined.setSessionLocked("player", "nonce")
+
+	c.put("joined", joined)
+	c.put("other", loadedHandle("other", nil, discardStore{}, nil, nil))
+	c.put("newest", loadedHandle("newest", nil, discardStore{}, nil, nil))
+
+	if _, ok := c.get("joined"); !ok {
+		t.Errorf("placeholder with joined players was evicted")
+	}
+	if _, ok := c.get("other"); ok {
+		t.Errorf("empty placeholder should have been evicted")
+	}
+}
+
+func TestGameCacheMaxBytes(t *testing.T) {
+	c := newGameCache(10)
+	c.sizeOf = func(gh *GameHandle) int64 { return int64(len(gh.id)) }
+	c.maxBytes = 5
+
+	c.put("aa", loadedHandle("aa", nil, discardStore{}, nil, nil))
+	c.put("bbb", loadedHandle("bbb", nil, discardStore{}, nil, nil))
+	if c.bytes() != 5 {
+		t.Fatalf("bytes() = %d, want 5", c.bytes())
+	}
+	c.put("c", loadedHandle("c", nil, discardStore{}, nil, nil))
+	if _, ok := c.get("aa"); ok {
+		t.Errorf("aa should have been evicted to stay under maxBytes")
+	}
+	if c.bytes() != 4 {
+		t.Errorf("bytes() = %d after eviction, want 4", c.bytes())
+	}
+	c.remove("bbb")
+	if c.bytes() != 1 {
+		t.Errorf("bytes() = %d after remove, want 1", c.bytes())
+	}
+}
+
+func TestGamesInUseStayCached(t *testing.T) {
+	s := &Server{Store: newMemStore(), MaxCachedGames: 1}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"in-use", "other"} {
+		if err := s.Store.Save(newGame(id, randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A request holds the game while another loads a different one;
+	// the first request's updates must go to the only copy.
+	gh := s.getGame("in-use")
+	other := s.getGame("other")
+	s.releaseGame(other)
+	if current := s.getGame("in-use"); current != gh {
+		t.Fatal("a game in use was evicted and loaded again")
+	} else {
+		s.releaseGame(current)
+	}
+
+	s.releaseGame(gh)
+	s.releaseGame(s.getGame("other"))
+	s.mu.Lock()
+	_, cached := s.games.get("in-use")
+	s.mu.Unlock()
+	if cached {
+		t.Error("a released game wasn't evicted")
+	}
+}
+
+// slowStore blocks loads of one game until release is closed.
+type slowStore struct {
+	*memStore
+	slow    string
+	release chan struct{}
+	loads   int32
+}
+
+func (ss *slowStore) Load(id string) (*Game, error) {
+	if id == ss.slow {
+		atomic.AddInt32(&ss.loads, 1)
+		<-ss.release
+	}
+	return ss.memStore.Load(id)
+}
+
+func TestLoadsDontHoldTheServerLock(t *testing.T) {
+	store := &slowStore{memStore: newMemStore(), slow: "slow", release: make(chan struct{})}
+	for _, id := range []string{"slow", "fast"} {
+		if err := store.Save(newGame(id, randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(store)
+
+	handles := make(chan *GameHandle, 2)
+	for i := 0; i < 2; i++ {
+		go func() { handles <- s.getGame("slow") }()
+	}
+	for atomic.LoadInt32(&store.loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan *GameHandle)
+	go func() { done <- s.getGame("fast") }()
+	select {
+	case gh := <-done:
+		if gh == nil {
+			t.Fatal("getGame(fast) = nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("loading one game blocked looking up another")
+	}
+
+	close(store.release)
+	a, b := <-handles, <-handles
+	if a == nil || a != b {
+		t.Errorf("concurrent lookups got handles %p and %p, want the same one", a, b)
+	}
+	if n := atomic.LoadInt32(&store.loads); n != 1 {
+		t.Errorf("game was loaded %d times, want once", n)
+	}
+}
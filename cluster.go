@@ -0,0 +1,334 @@
+package crossclues
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node is a crossclues server in a cluster.
+type Node struct {
+	ID  string
+	URL *url.URL
+}
+
+// Cluster assigns each game to the node that owns it. Each node
+// keeps its own games in memory and in its own store, and forwards
+// requests for other nodes' games to their owners, so every request
+// for a game is served by the same process.
+type Cluster interface {
+	// Self returns the ID of this node.
+	Self() string
+	// Owner returns the node that owns gameID, and whether that's
+	// this node.
+	Owner(gameID string) (owner Node, local bool)
+}
+
+// StaticCluster is a Cluster with a fixed membership. Games are
+// assigned by rendezvous hashing, so adding or removing a node only
+// moves the games that node gains or loses. Games that move are
+// left behind in the previous owner's store; export and import them
+// to carry them over.
+type StaticCluster struct {
+	SelfID string
+	Nodes  []Node
+}
+
+// ParseStaticCluster parses a comma-separated list of id=url pairs.
+func ParseStaticCluster(self, spec string) (*StaticCluster, error) {
+	c := &StaticCluster{SelfID: self}
+	var found bool
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("cluster node %q isn't of the form id=url", pair)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("cluster node %q: %w", parts[0], err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("cluster node %q: URL %q isn't absolute", parts[0], parts[1])
+		}
+		c.Nodes = append(c.Nodes, Node{ID: parts[0], URL: u})
+		found = found || parts[0] == self
+	}
+	if !found {
+		return nil, fmt.Errorf("this node, %q, isn't in the cluster", self)
+	}
+	return c, nil
+}
+
+// Self implements Cluster.
+func (c *StaticCluster) Self() string {
+	return c.SelfID
+}
+
+// Owner implements Cluster.
+func (c *StaticCluster) Owner(gameID string) (Node, bool) {
+	var owner Node
+	var best uint64
+	for _, n := range c.Nodes {
+		h := sha256.Sum256([]byte(n.ID + "\x00" + gameID))
+		if w := binary.BigEndian.Uint64(h[:8]); w >= best {
+			owner, best = n, w
+		}
+	}
+	return owner, owner.ID == c.SelfID
+}
+
+// forwardedHeader marks requests forwarded by another node. They're
+// always served locally, so nodes that disagree about membership
+// can't forward a request back and forth. forwardedClientHeader
+// carries the address of the client the forwarding node served, and
+// forwardSignatureHeader proves the request came from a node: anyone
+// else who sets these headers has them removed.
+const (
+	forwardedHeader        = "X-Crossclues-Forwarded-By"
+	forwardedClientHeader  = "X-Crossclues-Forwarded-For"
+	forwardSignatureHeader = "X-Crossclues-Forward-Signature"
+)
+
+// maxForwardAge is how old a forward's signature can be, allowing
+// for clock differences between nodes.
+const maxForwardAge = 5 * time.Minute
+
+// router forwards requests for games owned by other nodes.
+type router struct {
+	cluster Cluster
+	secret  []byte
+	log     *Logger
+
+	// maxBodyBytes bounds how much of a request body is buffered to
+	// find the game it's for. No endpoint accepts more.
+	maxBodyBytes int64
+
+	// client asks other nodes about their games.
+	client *http.Client
+
+	mu      sync.Mutex
+	proxies map[string]*httputil.ReverseProxy
+}
+
+func newRouter(c Cluster, secret string, maxBodyBytes int64, l *Logger) *router {
+	return &router{
+		cluster:      c,
+		secret:       []byte(secret),
+		log:          l,
+		maxBodyBytes: maxBodyBytes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		proxies:      make(map[string]*httputil.ReverseProxy),
+	}
+}
+
+// forwardSignature signs the parts of a forwarded request the
+// receiving node relies on: who forwarded it, when, what it asks for
+// and for which client. The body isn't signed; connections between
+// nodes should use TLS where they can be tampered with.
+func (r *router) forwardSignature(node, at string, req *http.Request, client string) string {
+	mac := hmac.New(sha256.New, r.secret)
+	for _, part := range []string{node, at, req.Method, req.URL.RequestURI(), client} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signForward marks req as forwarded by this node for client.
+func (r *router) signForward(req *http.Request, client string) {
+	at := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(forwardedHeader, r.cluster.Self())
+	req.Header.Set(forwardedClientHeader, client)
+	req.Header.Set(forwardSignatureHeader, at+"."+r.forwardSignature(r.cluster.Self(), at, req, client))
+}
+
+// authenticateForward removes the forwarding headers from req unless
+// another node signed them, so clients can't pass their requests off
+// as forwarded.
+func (r *router) authenticateForward(req *http.Request) {
+	node := req.Header.Get(forwardedHeader)
+	if node != "" && r.validForward(req, node) {
+		return
+	}
+	for _, h := range []string{forwardedHeader, forwardedClientHeader, forwardSignatureHeader} {
+		req.Header.Del(h)
+	}
+	if node != "" {
+		loggerFrom(req.Context()).Warn("unauthenticated forwarded request", "path", req.URL.Path, "node", node)
+	}
+}
+
+func (r *router) validForward(req *http.Request, node string) bool {
+	parts := strings.SplitN(req.Header.Get(forwardSignatureHeader), ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxForwardAge || age < -maxForwardAge {
+		return false
+	}
+	want := r.forwardSignature(node, parts[0], req, req.Header.Get(forwardedClientHeader))
+	return hmac.Equal([]byte(parts[1]), []byte(want))
+}
+
+// route forwards req, from client, to the owner of the game it's for
+// and reports whether it did. Requests that aren't for a game, or are
+// for a game this node owns, are left to the caller.
+func (r *router) route(rw http.ResponseWriter, req *http.Request, client string) bool {
+	if req.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	gameID, err := requestGameID(req, r.maxBodyBytes)
+	if err != nil {
+		writeError(rw, 400, err.Error())
+		return true
+	}
+	if gameID == "" {
+		return false
+	}
+	owner, local := r.cluster.Owner(gameID)
+	if local {
+		return false
+	}
+	r.signForward(req, client)
+	ctx, span := startSpan(req.Context(), "cluster.forward", "node", owner.ID, "game_id", gameID)
+	defer span.End()
+	injectTraceparent(ctx, req)
+	r.proxy(owner).ServeHTTP(rw, req.WithContext(ctx))
+	return true
+}
+
+// gameExistsPath is where nodes ask each other whether they have a
+// game. Only requests signed by another node are answered.
+const gameExistsPath = "/cluster/game-exists"
+
+// gameExists asks owner whether it has a game with the given ID.
+func (r *router) gameExists(owner Node, id GameID) (bool, error) {
+	u := *owner.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + gameExistsPath
+	u.RawQuery = url.Values{"id": {string(id)}}.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	r.signForward(req, "")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("asking %s about game %q: %w", owner.ID, id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("asking %s about game %q: %s", owner.ID, id, resp.Status)
+	}
+	var body struct {
+		Exists bool `json:"exists"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, fmt.Errorf("asking %s about game %q: %w", owner.ID, id, err)
+	}
+	return body.Exists, nil
+}
+
+// GET /cluster/game-exists?id=...
+//
+// handleGameExists tells another node whether this one has a game.
+func (s *Server) handleGameExists(rw http.ResponseWriter, req *http.Request) {
+	// Forwarding headers that no node signed have been removed.
+	if req.Header.Get(forwardedHeader) == "" {
+		http.NotFound(rw, req)
+		return
+	}
+	id, err := ParseGameID(req.URL.Query().Get("id"))
+	if err != nil {
+		writeError(rw, 400, err.Error())
+		return
+	}
+	exists, err := s.localGameExists(id)
+	if err != nil {
+		loggerFrom(req.Context()).Error("checking for game", "game_id", id, "err", err)
+		writeError(rw, 500, "Error checking for the game")
+		return
+	}
+	writeJSON(rw, struct {
+		Exists bool `json:"exists"`
+	}{exists})
+}
+
+func (r *router) proxy(n Node) *httputil.ReverseProxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.proxies[n.ID]
+	if !ok {
+		p = httputil.NewSingleHostReverseProxy(n.URL)
+		p.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+			r.log.Error("forwarding request", "path", req.URL.Path, "node", n.ID, "request_id", req.Header.Get(requestIDHeader), "err", err)
+			http.Error(rw, "Game server unavailable", http.StatusBadGateway)
+		}
+		r.proxies[n.ID] = p
+	}
+	return p
+}
+
+// requestGameID returns the ID of the game a request is for, or ""
+// if it isn't for a particular game. JSON bodies of up to
+// maxBodyBytes are read to find it and then restored so the request
+// can still be handled.
+func requestGameID(req *http.Request, maxBodyBytes int64) (string, error) {
+	if strings.HasPrefix(req.URL.Path, "/websocket/") {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/websocket/"), "/")
+		// Let the handler reject an invalid ID.
+		id, _ := ParseGameID(parts[0])
+		return string(id), nil
+	}
+	// A game's page shows whether it needs a passcode, which only the
+	// node that owns it knows.
+	if name := strings.TrimPrefix(req.URL.Path, "/"); (req.Method == "GET" || req.Method == "HEAD") && !strings.Contains(name, "/") {
+		id, _ := ParseGameID(name)
+		return string(id), nil
+	}
+	if req.URL.Path == "/admin/game" {
+		// Let the handler reject an invalid ID.
+		id, _ := ParseGameID(req.URL.Query().Get("id"))
+		return string(id), nil
+	}
+	switch req.URL.Path {
+	case "/join", "/passcode", "/kick", "/transfer-host", "/lock", "/next-game", "/guess", "/discard", "/game-state",
+		"/admin/end-game", "/admin/delete-game":
+	default:
+		return "", nil
+	}
+	if req.Body == nil {
+		return "", nil
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, maxBodyBytes))
+	req.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("reading request body: %w", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	var body struct {
+		GameID GameID `json:"game_id"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		// Let the handler report the malformed body.
+		return "", nil
+	}
+	return string(body.GameID), nil
+}
@@ -0,0 +1,308 @@
+package crossclues
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeCluster runs several nodes in process, each with its own
+// server and store, and assigns games to nodes from a table so tests
+// control which node owns what.
+type fakeCluster struct {
+	nodes   []Node
+	servers map[string]*Server
+	http    map[string]*httptest.Server
+	owners  map[string]string // game ID -> node ID; others go to nodes[0]
+}
+
+type fakeMembership struct {
+	c    *fakeCluster
+	self string
+}
+
+func (m fakeMembership) Self() string { return m.self }
+
+func (m fakeMembership) Owner(gameID string) (Node, bool) {
+	owner := m.c.nodes[0]
+	for _, n := range m.c.nodes {
+		if n.ID == m.c.owners[gameID] {
+			owner = n
+		}
+	}
+	return owner, owner.ID == m.self
+}
+
+func newFakeCluster(t *testing.T, ids ...string) *fakeCluster {
+	c := &fakeCluster{
+		servers: make(map[string]*Server),
+		http:    make(map[string]*httptest.Server),
+		owners:  make(map[string]string),
+	}
+	for _, id := range ids {
+		s := &Server{Store: newMemStore(), Cluster: fakeMembership{c: c, self: id}, ClusterSecret: "cluster secret",
+			AdminCredentials: []Credential{{Username: "ops", Password: "hunter2", Role: RoleAdmin}}}
+		if err := s.setup(); err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(s)
+		t.Cleanup(ts.Close)
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.nodes = append(c.nodes, Node{ID: id, URL: u})
+		c.servers[id] = s
+		c.http[id] = ts
+	}
+	return c
+}
+
+func TestClusterForwardsToOwner(t *testing.T) {
+	c := newFakeCluster(t, "a", "b")
+	c.owners["on-b"] = "b"
+
+	// Ask node a to create a game owned by node b.
+	alice := join(t, c.http["a"].URL, "on-b", "alice")
+	var g Game
+	code := postJSONAs(t, c.http["a"].URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "on-b", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, &g)
+	if code != 200 || g.ID != "on-b" {
+		t.Fatalf("/next-game via a returned %d, %+v", code, g)
+	}
+	if c.servers["b"].getGame("on-b") == nil {
+		t.Errorf("owner doesn't have the game")
+	}
+	if c.servers["a"].getGame("on-b") != nil {
+		t.Errorf("non-owner has the game")
+	}
+
+	code = postJSONAs(t, c.http["a"].URL+"/game-state", alice, map[string]interface{}{
+		"game_id": "on-b", "player_id": "alice",
+	}, &g)
+	if code != 200 || len(g.PlayerCards) == 0 {
+		t.Errorf("/game-state via a returned %d with cards %v", code, g.PlayerCards)
+	}
+
+	// Websockets are proxied too.
+	wsURL := "ws" + strings.TrimPrefix(c.http["a"].URL, "http") + "/websocket/on-b/alice?session=" + alice
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var pushed Game
+	if err := conn.ReadJSON(&pushed); err != nil {
+		t.Fatal(err)
+	}
+	if pushed.ID != "on-b" || len(pushed.PlayerIDs) != 1 || pushed.PlayerIDs[0] != "alice" {
+		t.Errorf("websocket pushed %+v", pushed)
+	}
+}
+
+func TestClusterForwardsGamePages(t *testing.T) {
+	c := newFakeCluster(t, "a", "b")
+	c.owners["private-on-b"] = "b"
+	alice := join(t, c.http["a"].URL, "private-on-b", "alice")
+	if code := postJSONAs(t, c.http["a"].URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "private-on-b", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize, "passcode": "secret",
+	}, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	code, body := getBody(t, c.http["a"].URL+"/private-on-b")
+	if code != 200 || !strings.Contains(body, "data-passcode-required") {
+		t.Fatalf("GET /private-on-b via a returned %d:\n%s", code, body)
+	}
+}
+
+func TestClusterForwardsAdminRequests(t *testing.T) {
+	c := newFakeCluster(t, "a", "b")
+	c.owners["on-b"] = "b"
+	c.owners["free-on-b"] = "b"
+	alice := join(t, c.http["a"].URL, "on-b", "alice")
+	if code := postJSONAs(t, c.http["a"].URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "on-b", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	// Node a asks b whether its games exist.
+	for id, want := range map[GameID]bool{"on-b": true, "free-on-b": false} {
+		if exists, err := c.servers["a"].gameExists(id); err != nil || exists != want {
+			t.Errorf("gameExists(%q) on a = %t, %v; want %t", id, exists, err, want)
+		}
+	}
+	if code, _ := getBody(t, c.http["b"].URL+gameExistsPath+"?id=on-b"); code != 404 {
+		t.Errorf("unsigned %s returned %d, want 404", gameExistsPath, code)
+	}
+
+	admin := func(method, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, c.http["a"].URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("ops", "hunter2")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := admin("GET", "/admin/game?id=on-b", ""); code != 200 {
+		t.Errorf("/admin/game via a returned %d", code)
+	}
+	if code := admin("POST", "/admin/end-game", `{"game_id":"on-b"}`); code != http.StatusNoContent {
+		t.Errorf("/admin/end-game via a returned %d", code)
+	}
+	if code := admin("POST", "/admin/delete-game", `{"game_id":"on-b"}`); code != http.StatusNoContent {
+		t.Errorf("/admin/delete-game via a returned %d", code)
+	}
+	if c.servers["b"].getGame("on-b") != nil {
+		t.Errorf("owner still has the game after /admin/delete-game")
+	}
+}
+
+func TestClusterServesForwardedRequestsLocally(t *testing.T) {
+	c := newFakeCluster(t, "a", "b")
+	c.owners["on-b"] = "b"
+	alice := join(t, c.http["a"].URL, "on-b", "alice")
+	if code := postJSONAs(t, c.http["a"].URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "on-b", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	gameState := func(sign func(*http.Request)) int {
+		t.Helper()
+		req, err := http.NewRequest("POST", c.http["a"].URL+"/game-state",
+			strings.NewReader(`{"game_id":"on-b","player_id":"alice"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(sessionHeader, alice)
+		sign(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Node a thinks b owns the game, but the request was already
+	// forwarded once, so a handles it rather than bouncing it.
+	if code := gameState(func(req *http.Request) {
+		c.servers["b"].router.signForward(req, "127.0.0.1")
+	}); code != 404 {
+		t.Errorf("forwarded request returned %d, want 404 from node a", code)
+	}
+
+	// Forwarding headers that no node signed are ignored, so the
+	// request still reaches the owner.
+	other := newRouter(fakeMembership{c: c, self: "b"}, "another secret", maxRequestBodyBytes, nil)
+	for name, sign := range map[string]func(*http.Request){
+		"unsigned":     func(req *http.Request) { req.Header.Set(forwardedHeader, "b") },
+		"wrong secret": func(req *http.Request) { other.signForward(req, "127.0.0.1") },
+		"changed": func(req *http.Request) {
+			c.servers["b"].router.signForward(req, "127.0.0.1")
+			req.Header.Set(forwardedClientHeader, "1.2.3.4")
+		},
+	} {
+		if code := gameState(sign); code != 200 {
+			t.Errorf("%s forward returned %d, want 200 from node b", name, code)
+		}
+	}
+}
+
+func TestClusterChargesRateLimitsOnce(t *testing.T) {
+	c := newFakeCluster(t, "a", "b")
+	c.owners["on-b"] = "b"
+	alice := join(t, c.http["a"].URL, "on-b", "alice")
+	if code := postJSONAs(t, c.http["a"].URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "on-b", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	// The node a client reaches charges its address; the owner
+	// charges the game.
+	c.servers["a"].limiter = newRateLimiter(RateLimits{
+		PerIP:   Rate{PerSecond: 0.001, Burst: 2},
+		PerGame: Rate{PerSecond: 0.001, Burst: 1},
+	}, true, maxRequestBodyBytes)
+	c.servers["b"].limiter = newRateLimiter(RateLimits{
+		PerIP:   Rate{PerSecond: 0.001, Burst: 2},
+		PerGame: Rate{PerSecond: 0.001, Burst: 4},
+	}, true, maxRequestBodyBytes)
+	state := map[string]interface{}{"game_id": "on-b", "player_id": "alice"}
+	for _, node := range []string{"a", "a", "b", "b"} {
+		if code := postJSONAs(t, c.http[node].URL+"/game-state", alice, state, nil); code != 200 {
+			t.Errorf("/game-state via %s returned %d", node, code)
+		}
+	}
+	if code := postJSONAs(t, c.http["a"].URL+"/game-state", alice, state, nil); code != http.StatusTooManyRequests {
+		t.Errorf("/game-state over the limit returned %d, want 429", code)
+	}
+}
+
+func TestStaticClusterOwner(t *testing.T) {
+	spec := "a=http://a.internal:8080,b=http://b.internal:8080,c=http://c.internal:8080"
+	views := map[string]*StaticCluster{}
+	for _, id := range []string{"a", "b", "c"} {
+		sc, err := ParseStaticCluster(id, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		views[id] = sc
+	}
+	smaller, err := ParseStaticCluster("a", "a=http://a.internal:8080,b=http://b.internal:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for _, id := range gameIDs[:300] {
+		owner, _ := views["a"].Owner(id)
+		counts[owner.ID]++
+		// Every node agrees on the owner, and exactly one thinks
+		// it's local.
+		var locals int
+		for _, v := range views {
+			o, local := v.Owner(id)
+			if o.ID != owner.ID {
+				t.Fatalf("nodes disagree about the owner of %q", id)
+			}
+			if local {
+				locals++
+			}
+		}
+		if locals != 1 {
+			t.Fatalf("%d nodes think they own %q", locals, id)
+		}
+		// Removing c only moves c's games.
+		if o, _ := smaller.Owner(id); owner.ID != "c" && o.ID != owner.ID {
+			t.Errorf("removing c moved %q from %s to %s", id, owner.ID, o.ID)
+		}
+	}
+	for id, n := range counts {
+		if n < 50 {
+			t.Errorf("node %s owns only %d of 300 games", id, n)
+		}
+	}
+
+	for _, bad := range []string{"a", "a=", "a=not-a-url", "b=http://b.internal"} {
+		if _, err := ParseStaticCluster("a", bad); err == nil {
+			t.Errorf("ParseStaticCluster(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	crossclues "github.com/dfturn/crossclues"
+)
+
+// runExport implements `crossclues export`, writing stored games to
+// stdout as newline-delimited JSON.
+func runExport(ps *crossclues.PebbleStore, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	createdAfter := fs.String("created-after", "", "only export games created at or after this RFC 3339 time")
+	createdBefore := fs.String("created-before", "", "only export games created before this RFC 3339 time")
+	ids := fs.String("ids", "", "only export games with these comma-separated IDs")
+	fs.Parse(args)
+
+	var filter crossclues.GameFilter
+	var err error
+	if *createdAfter != "" {
+		filter.CreatedAfter, err = time.Parse(time.RFC3339, *createdAfter)
+		if err != nil {
+			return fmt.Errorf("-created-after: %w", err)
+		}
+	}
+	if *createdBefore != "" {
+		filter.CreatedBefore, err = time.Parse(time.RFC3339, *createdBefore)
+		if err != nil {
+			return fmt.Errorf("-created-before: %w", err)
+		}
+	}
+	if *ids != "" {
+		filter.IDs = make(map[string]bool)
+		for _, id := range strings.Split(*ids, ",") {
+			parsed, err := crossclues.ParseGameID(strings.TrimSpace(id))
+			if err != nil {
+				return fmt.Errorf("-ids: %q: %w", id, err)
+			}
+			filter.IDs[string(parsed)] = true
+		}
+	}
+
+	n, err := ps.Export(os.Stdout, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d games.\n", n)
+	return nil
+}
+
+// runImport implements `crossclues import`, merging games exported
+// by runExport from the named files, or stdin if there are none.
+func runImport(ps *crossclues.PebbleStore, args []string) error {
+	var r io.Reader = os.Stdin
+	if len(args) > 0 {
+		var readers []io.Reader
+		for _, name := range args {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+		r = io.MultiReader(readers...)
+	}
+
+	res, err := ps.Import(r)
+	fmt.Fprintf(os.Stderr, "Imported %d games, skipped %d that were already up to date.\n",
+		res.Imported, res.Skipped)
+	return err
+}
@@ -2,18 +2,15 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"encoding/gob"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"runtime/trace"
 	"time"
 
@@ -23,52 +20,96 @@ import (
 	"github.com/pkg/errors"
 )
 
-const defaultPort = "8080"
-const expiryDur = -24 * time.Hour
-
-func LookupEnvOrString(key string, defaultVal string) string {
-	if val, ok := os.LookupEnv(key); ok {
-		return val
-	}
-	return defaultVal
-}
+// logger is replaced once the log settings are loaded.
+var logger = crossclues.NewLogger(os.Stderr, crossclues.LevelInfo, false)
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	var bootstrapURL string
-	var listenPort string
-
-	flag.StringVar(&listenPort, "port", LookupEnvOrString("PORT", defaultPort),
-		"port for server to listen on")
+	cfg, args, err := crossclues.LoadConfig(os.Args[1:], os.LookupEnv, os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err)
+		os.Exit(2)
+	}
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
 
-	flag.StringVar(&bootstrapURL, "bootstrap-url", "",
-		"URL of an existing crossclues server to bootstrap the DB from")
+	if arg(0) == "config" {
+		if arg(1) != "print" {
+			fmt.Fprintf(os.Stderr, "usage: crossclues config print\n")
+			os.Exit(2)
+		}
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "config print: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	flag.Parse()
+	level, _ := crossclues.ParseLevel(cfg.LogLevel)
+	logger = crossclues.NewLogger(os.Stderr, level, cfg.LogFormat == "json")
 
 	// Open a Pebble DB to persist games to disk.
-	dir := os.Getenv("PEBBLE_DIR")
-	if dir == "" {
-		dir = filepath.Join(".", "db")
-	}
-	err := os.MkdirAll(dir, os.ModePerm)
+	dir := cfg.DataDir
+	err = os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "MkdirAll(%q): %s\n", dir, err)
 		os.Exit(1)
 	}
-	log.Printf("[STARTUP] Opening pebble db from directory: %s\n", dir)
+	logger.Info("opening pebble db", "dir", dir)
 
-	if len(bootstrapURL) > 0 {
-		err := bootstrap(bootstrapURL, dir)
+	if len(cfg.BootstrapURL) > 0 {
+		err := bootstrap(cfg.BootstrapURL, dir, cfg.BootstrapPassword)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Bootstrapping from %q: %s\n", bootstrapURL, err)
+			fmt.Fprintf(os.Stderr, "Bootstrapping from %q: %s\n", cfg.BootstrapURL, err)
 			os.Exit(1)
 		}
-		fmt.Printf("Bootstrapped from %q.\n", bootstrapURL)
+		fmt.Printf("Bootstrapped from %q.\n", cfg.BootstrapURL)
 		os.Exit(0)
 	}
 
+	switch arg(0) {
+	case "backup":
+		// Download a backup from a running server into a backup
+		// directory. Files of the latest backup in the directory aren't
+		// downloaded again, so repeated backups are incremental, and
+		// an interrupted one can be resumed.
+		serverURL, backupDir := arg(1), arg(2)
+		if serverURL == "" || backupDir == "" {
+			fmt.Fprintf(os.Stderr, "usage: crossclues backup <server url> <backup dir>\n")
+			os.Exit(2)
+		}
+		m, err := backup(serverURL, backupDir, cfg.BootstrapPassword)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Backing up %q: %s\n", serverURL, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Backed up %d files from %q.\n", len(m.Files), serverURL)
+		return
+	case "restore":
+		// Verify the latest backup in a backup directory and restore
+		// it into the (empty) Pebble directory.
+		backupDir := arg(1)
+		if backupDir == "" {
+			fmt.Fprintf(os.Stderr, "usage: crossclues restore <backup dir>\n")
+			os.Exit(2)
+		}
+		m, err := crossclues.RestoreBackup(backupDir, dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Restoring %q: %s\n", backupDir, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored backup from %s into %q.\n", m.CreatedAt, dir)
+		return
+	}
+
 	var opts pebble.Options
 	opts.EventListener = pebble.MakeLoggingEventListener(nil)
 	opts.Experimental.DeleteRangeFlushDelay = 5 * time.Second
@@ -79,43 +120,158 @@ func main() {
 	}
 	defer db.Close()
 
-	ps := &crossclues.PebbleStore{DB: db}
+	ps := &crossclues.PebbleStore{DB: db, Log: logger}
 
-	// Delete any games created too long ago.
-	err = ps.DeleteExpired(time.Now().Add(expiryDur))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "PebbleStore.DeletedExpired: %s\n", err)
-		os.Exit(1)
+	switch cmd := arg(0); cmd {
+	case "":
+		// Run the server.
+	case "migrate":
+		// Upgrade every stored game to the current schema version
+		// and exit. The server must not be running against dir.
+		n, err := ps.Migrate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "PebbleStore.Migrate: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Migrated %d games to schema version %d.\n", n, crossclues.SchemaVersion)
+		return
+	case "export":
+		if err := runExport(ps, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "export: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	case "import":
+		if err := runImport(ps, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "import: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	case "show":
+		// Print a stored game as JSON.
+		id := arg(1)
+		b, err := ps.LoadJSON(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "PebbleStore.LoadJSON: %s\n", err)
+			os.Exit(1)
+		}
+		if b == nil {
+			fmt.Fprintf(os.Stderr, "game %q not found\n", id)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", b)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		os.Exit(2)
 	}
-	go deleteExpiredPeriodically(ps)
 
-	// Restore games from disk.
-	games, err := ps.Restore()
+	// Delete any games that have been idle for too long. The server
+	// applies the same policy periodically once it's running.
+	err = ps.DeleteExpired(time.Now().Add(-cfg.Retention))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "PebbleStore.Resore: %s\n", err)
+		fmt.Fprintf(os.Stderr, "PebbleStore.DeletedExpired: %s\n", err)
 		os.Exit(1)
 	}
-	log.Printf("[STARTUP] Restored %d games from disk.\n", len(games))
 
-	if traceDir := os.Getenv("TRACE"); len(traceDir) > 0 {
-		log.Printf("[STARTUP] Traces enabled; storing most recent trace in %q", traceDir)
+	if traceDir := cfg.RuntimeTraceFile; len(traceDir) > 0 {
+		logger.Info("traces enabled; storing most recent trace", "path", traceDir)
 		go tracePeriodically(traceDir)
 	}
 
-	log.Printf("[STARTUP] Listening on port %s\n", listenPort)
+	sessionSecret := cfg.SessionSecret
+	if sessionSecret == "" {
+		// Followers and clusters need SESSION_SECRET, so the
+		// generated one only has to work on this node.
+		sessionSecret, err = ps.SessionSecret()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "PebbleStore.SessionSecret: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var cluster crossclues.Cluster
+	if cfg.Cluster != "" {
+		// already checked by LoadConfig
+		sc, _ := crossclues.ParseStaticCluster(cfg.NodeID, cfg.Cluster)
+		logger.Info("joining cluster", "node_id", cfg.NodeID, "nodes", len(sc.Nodes))
+		cluster = sc
+	}
+
+	if len(cfg.Webhooks) > 0 {
+		logger.Info("sending webhooks", "urls", len(cfg.Webhooks))
+	}
+
+	adminCredentials, _ := crossclues.ParseCredentials(cfg.AdminCredentials)
+
+	var tracer *crossclues.Tracer
+	switch cfg.TraceExporter {
+	case "stdout":
+		tracer = crossclues.NewTracer(crossclues.NewStdoutExporter(os.Stdout))
+	case "otlp-file":
+		f, err := os.OpenFile(cfg.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "trace_file: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		tracer = crossclues.NewTracer(crossclues.NewOTLPFileExporter(f))
+		logger.Info("exporting spans", "path", cfg.TraceFile)
+	}
+
+	logger.Info("listening", "port", cfg.Port, "tls", cfg.TLSCert != "")
 	server := &crossclues.Server{
 		Server: http.Server{
-			Addr: ":" + listenPort,
+			Addr: ":" + cfg.Port,
 		},
-		Upgrader: websocket.Upgrader{},
-		Store:    ps,
+		Upgrader:        websocket.Upgrader{},
+		Store:           ps,
+		Retention:       cfg.Retention,
+		MaxCachedGames:  cfg.MaxCachedGames,
+		LongPollTimeout: cfg.LongPollTimeout,
+		MaxWordSetWords: cfg.MaxWordSetWords,
+		AssetsDir:       cfg.AssetsDir,
+		StaticDir:       cfg.StaticDir,
+		GameIDWords:     cfg.GameIDWords,
+		GameIDEntropy:   cfg.GameIDEntropy,
+		TLSCertFile:     cfg.TLSCert,
+		TLSKeyFile:      cfg.TLSKey,
+		HSTSMaxAge:      cfg.HSTSMaxAge,
+		Follow:          cfg.Follow,
+		Cluster:         cluster,
+		ClusterSecret:   cfg.ClusterSecret,
+		Log:             logger,
+		Tracer:          tracer,
+
+		Webhooks:          cfg.Webhooks,
+		WebhookSecret:     cfg.WebhookSecret,
+		AllowGameWebhooks: cfg.AllowGameWebhooks,
+
+		SessionSecret:     sessionSecret,
+		BootstrapPassword: cfg.BootstrapPassword,
+		PprofPassword:     cfg.PprofPassword,
+		AdminCredentials:  adminCredentials,
+
+		RateLimits: crossclues.RateLimits{
+			PerIP:            burstRate(cfg.IPRate),
+			PerGame:          burstRate(cfg.GameRate),
+			Global:           burstRate(cfg.GlobalRate),
+			GamesPerIP:       crossclues.Rate{PerSecond: cfg.GamesPerIP / 3600, Burst: int(math.Ceil(cfg.GamesPerIP))},
+			MaxWordSetBytes:  cfg.MaxWordSetMB << 20,
+			TrustedProxyHops: cfg.TrustedProxyHops,
+		},
+	}
+	if cfg.RedirectPort != "" {
+		server.RedirectAddr = ":" + cfg.RedirectPort
 	}
-	if err := server.Start(games); err != nil {
+	if err := server.Start(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 	}
 }
 
-func bootstrap(bootstrapURL, dir string) error {
+// bootstrap copies the database of the server at bootstrapURL into
+// the empty directory dir.
+func bootstrap(bootstrapURL, dir, password string) error {
 	ls, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return err
@@ -123,59 +279,65 @@ func bootstrap(bootstrapURL, dir string) error {
 	if len(ls) > 0 {
 		return fmt.Errorf("directory %q is not empty: aborting\n", dir)
 	}
-	u, err := url.Parse(bootstrapURL)
+
+	backupDir, err := ioutil.TempDir("", "bootstrap")
 	if err != nil {
 		return err
 	}
-	u.Path = "/checkpoint"
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
+	defer os.RemoveAll(backupDir)
+
+	if _, err := backup(bootstrapURL, backupDir, password); err != nil {
 		return err
 	}
-	req.SetBasicAuth("admin", os.Getenv("BOOTSTRAPPW"))
-	resp, err := http.DefaultClient.Do(req)
+	_, err = crossclues.RestoreBackup(backupDir, dir)
+	return err
+}
+
+// backup downloads a backup from the server at serverURL into
+// backupDir, skipping files the directory already holds. password is
+// the server's bootstrap password.
+func backup(serverURL, backupDir, password string) (*crossclues.BackupManifest, error) {
+	u, err := url.Parse(serverURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	u.Path = "/checkpoint"
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("checkpoint returned %s status code\n", resp.Status)
+	have, err := crossclues.BackupChecksums(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	var request struct {
+		Have []string `json:"have"`
 	}
-	b, err := ioutil.ReadAll(resp.Body)
+	for sum := range have {
+		request.Have = append(request.Have, sum)
+	}
+	body, err := json.Marshal(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	r := bytes.NewReader(b)
-	gzr, err := gzip.NewReader(r)
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	dec := gob.NewDecoder(gzr)
-	for {
-		var cf crossclues.CheckpointFile
-		err := dec.Decode(&cf)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-		err = ioutil.WriteFile(filepath.Join(dir, cf.Name), cf.Data, os.ModePerm)
-		if err != nil {
-			return errors.Wrapf(err, "writing %s", filepath.Base(cf.Name))
-		}
-		log.Printf("Downloaded %s (%d bytes)\n", cf.Name, len(cf.Data))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("admin", password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
+	defer resp.Body.Close()
 
-func deleteExpiredPeriodically(ps *crossclues.PebbleStore) {
-	for range time.Tick(time.Hour) {
-		err := ps.DeleteExpired(time.Now().Add(expiryDur))
-		if err != nil {
-			log.Printf("PebbleStore.DeletedExpired: %s\n", err)
-		}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("checkpoint returned %s status code\n", resp.Status)
+	}
+	m, err := crossclues.ReadBackup(resp.Body, backupDir, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading backup")
 	}
+	return m, nil
 }
 
 func tracePeriodically(dst string) {
@@ -187,20 +349,26 @@ func tracePeriodically(dst string) {
 func takeTrace(dst string) {
 	f, err := ioutil.TempFile("", "trace")
 	if err != nil {
-		log.Printf("[TRACE] error creating temp file: %s", err)
+		logger.Error("creating trace file", "err", err)
 		return
 	}
 	defer f.Close()
 
 	err = trace.Start(f)
 	if err != nil {
-		log.Printf("[TRACE] error starting trace: %s", err)
+		logger.Error("starting trace", "err", err)
 		return
 	}
 	<-time.After(10 * time.Second)
 	trace.Stop()
 	err = os.Rename(f.Name(), dst)
 	if err != nil {
-		log.Printf("[TRACE] error renaming trace: %s", err)
+		logger.Error("renaming trace", "err", err)
 	}
 }
+
+// burstRate allows perSecond requests a second, in bursts of up to
+// two seconds' worth.
+func burstRate(perSecond float64) crossclues.Rate {
+	return crossclues.Rate{PerSecond: perSecond, Burst: int(math.Ceil(2 * perSecond))}
+}
@@ -0,0 +1,442 @@
+package crossclues
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the crossclues command. LoadConfig
+// reads it from, in increasing order of precedence, DefaultConfig, a
+// JSON file, environment variables and command-line flags.
+type Config struct {
+	Port             string
+	DataDir          string
+	BootstrapURL     string
+	RuntimeTraceFile string
+
+	Retention       time.Duration
+	MaxCachedGames  int
+	LongPollTimeout time.Duration
+	MaxWordSetWords int
+	AssetsDir       string
+	StaticDir       string
+	GameIDWords     string
+	GameIDEntropy   float64
+
+	TLSCert      string
+	TLSKey       string
+	RedirectPort string
+	HSTSMaxAge   time.Duration
+
+	Follow  string
+	NodeID  string
+	Cluster string
+
+	Webhooks          []string
+	AllowGameWebhooks bool
+
+	LogLevel      string
+	LogFormat     string
+	TraceExporter string
+	TraceFile     string
+
+	IPRate           float64
+	GameRate         float64
+	GlobalRate       float64
+	GamesPerIP       float64
+	MaxWordSetMB     int64
+	TrustedProxyHops int
+
+	BootstrapPassword string
+	PprofPassword     string
+	WebhookSecret     string
+	SessionSecret     string
+	ClusterSecret     string
+	AdminCredentials  string
+}
+
+// DefaultConfig returns the configuration used for settings that
+// aren't set any other way.
+func DefaultConfig() *Config {
+	return &Config{
+		Port:            "8080",
+		DataDir:         "db",
+		Retention:       DefaultRetention,
+		MaxCachedGames:  DefaultMaxCachedGames,
+		LongPollTimeout: DefaultLongPollTimeout,
+		MaxWordSetWords: DefaultMaxWordSetWords,
+		HSTSMaxAge:      DefaultHSTSMaxAge,
+		GameIDEntropy:   DefaultGameIDEntropy,
+		LogLevel:        "info",
+		LogFormat:       "text",
+		TraceFile:       "traces.jsonl",
+	}
+}
+
+// configFileEnv names the environment variable that can point to the
+// config file instead of the -config flag.
+const configFileEnv = "CROSSCLUES_CONFIG"
+
+// setting describes one field of Config: its key in the config file,
+// which is also its flag name with dashes for underscores, and the
+// environment variable that sets it.
+type setting struct {
+	key   string
+	env   string
+	usage string
+	// secret settings can't be set by flags, which other users can
+	// see, and aren't printed.
+	secret bool
+	value  interface{} // points to the field
+}
+
+func (s setting) flagName() string {
+	return strings.Replace(s.key, "_", "-", -1)
+}
+
+// settings lists c's fields. Environment variables the server read
+// before it had a config file keep their names; the others are
+// CROSSCLUES_ and the key in upper case.
+func (c *Config) settings() []setting {
+	env := func(key string) string { return "CROSSCLUES_" + strings.ToUpper(key) }
+	return []setting{
+		{key: "port", env: "PORT", usage: "port for server to listen on", value: &c.Port},
+		{key: "data_dir", env: "PEBBLE_DIR", usage: "directory of the Pebble database games are stored in", value: &c.DataDir},
+		{key: "bootstrap_url", env: env("bootstrap_url"), usage: "URL of an existing crossclues server to bootstrap the DB from", value: &c.BootstrapURL},
+		{key: "runtime_trace_file", env: "TRACE", usage: "file to keep a 10s Go runtime trace in, taken every minute", value: &c.RuntimeTraceFile},
+
+		{key: "retention", env: env("retention"), usage: "how long games are kept after their last update", value: &c.Retention},
+		{key: "max_cached_games", env: env("max_cached_games"), usage: "maximum number of games held in memory; others are loaded from disk on demand", value: &c.MaxCachedGames},
+		{key: "long_poll_timeout", env: env("long_poll_timeout"), usage: "how long /game-state waits for a change", value: &c.LongPollTimeout},
+		{key: "max_word_set_words", env: env("max_word_set_words"), usage: "maximum number of words in a custom word set", value: &c.MaxWordSetWords},
+		{key: "assets_dir", env: env("assets_dir"), usage: "directory overriding the embedded word lists and page template", value: &c.AssetsDir},
+		{key: "static_dir", env: env("static_dir"), usage: "directory overriding the embedded frontend", value: &c.StaticDir},
+		{key: "game_id_words", env: env("game_id_words"), usage: "file of newline separated words to suggest game IDs from, instead of the embedded list", value: &c.GameIDWords},
+		{key: "game_id_entropy", env: env("game_id_entropy"), usage: "bits of randomness in suggested game IDs", value: &c.GameIDEntropy},
+
+		{key: "tls_cert", env: env("tls_cert"), usage: "certificate file to serve HTTPS and HTTP/2 with; reloaded when it changes", value: &c.TLSCert},
+		{key: "tls_key", env: env("tls_key"), usage: "private key file of -tls-cert", value: &c.TLSKey},
+		{key: "redirect_port", env: env("redirect_port"), usage: "port for a plain HTTP listener that redirects to HTTPS", value: &c.RedirectPort},
+		{key: "hsts_max_age", env: env("hsts_max_age"), usage: "how long browsers should only use HTTPS, sent over TLS; 0 to send no HSTS header", value: &c.HSTSMaxAge},
+
+		{key: "follow", env: env("follow"), usage: "URL of a primary crossclues server to replicate from; serves read-only until promoted", value: &c.Follow},
+		{key: "node_id", env: env("node_id"), usage: "ID of this node in -cluster", value: &c.NodeID},
+		{key: "cluster", env: env("cluster"), usage: "comma-separated id=url list of every node sharing the games; requests for games owned by other nodes are forwarded", value: &c.Cluster},
+
+		{key: "webhooks", env: env("webhooks"), usage: "comma-separated URLs that receive game lifecycle events, signed with the webhook secret", value: &c.Webhooks},
+		{key: "allow_game_webhooks", env: env("allow_game_webhooks"), usage: "let games created through /next-game set their own webhook URL", value: &c.AllowGameWebhooks},
+
+		{key: "log_level", env: env("log_level"), usage: "minimum level of log entries: debug, info, warn or error", value: &c.LogLevel},
+		{key: "log_format", env: env("log_format"), usage: "log entry format: text or json", value: &c.LogFormat},
+		{key: "trace_exporter", env: env("trace_exporter"), usage: "export tracing spans for requests, game updates and websocket pushes: stdout or otlp-file", value: &c.TraceExporter},
+		{key: "trace_file", env: env("trace_file"), usage: "file that -trace-exporter otlp-file appends spans to", value: &c.TraceFile},
+
+		{key: "ip_rate", env: env("ip_rate"), usage: "requests per second allowed from one client address, in bursts of twice that; 0 for no limit", value: &c.IPRate},
+		{key: "game_rate", env: env("game_rate"), usage: "requests per second allowed for one game, in bursts of twice that; 0 for no limit", value: &c.GameRate},
+		{key: "global_rate", env: env("global_rate"), usage: "requests per second allowed in total, in bursts of twice that; 0 for no limit", value: &c.GlobalRate},
+		{key: "games_per_ip", env: env("games_per_ip"), usage: "games one client address can create per hour; 0 for no limit", value: &c.GamesPerIP},
+		{key: "max_word_set_mb", env: env("max_word_set_mb"), usage: "megabytes of custom word sets held in memory before new ones are refused; 0 for no limit", value: &c.MaxWordSetMB},
+		{key: "trusted_proxy_hops", env: env("trusted_proxy_hops"), usage: "number of proxies in front of the server whose X-Forwarded-For entries identify clients", value: &c.TrustedProxyHops},
+
+		{key: "bootstrap_password", env: "BOOTSTRAPPW", secret: true, value: &c.BootstrapPassword},
+		{key: "pprof_password", env: "PPROFPW", secret: true, value: &c.PprofPassword},
+		{key: "webhook_secret", env: "WEBHOOK_SECRET", secret: true, value: &c.WebhookSecret},
+		{key: "session_secret", env: "SESSION_SECRET", secret: true, value: &c.SessionSecret},
+		{key: "cluster_secret", env: "CLUSTER_SECRET", secret: true, value: &c.ClusterSecret},
+		{key: "admin_credentials", env: "ADMIN_CREDENTIALS", secret: true, value: &c.AdminCredentials},
+	}
+}
+
+// setString parses s into the field v points to. Lists are
+// comma-separated.
+func setString(v interface{}, s string) error {
+	var err error
+	switch v := v.(type) {
+	case *string:
+		*v = s
+	case *int:
+		*v, err = strconv.Atoi(s)
+	case *int64:
+		*v, err = strconv.ParseInt(s, 10, 64)
+	case *float64:
+		*v, err = strconv.ParseFloat(s, 64)
+	case *bool:
+		*v, err = strconv.ParseBool(s)
+	case *time.Duration:
+		*v, err = time.ParseDuration(s)
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", v))
+	}
+	return err
+}
+
+// setJSON decodes raw, a value from the config file, into the field v
+// points to. Durations are strings like "90s", and lists may also be
+// comma-separated strings.
+func setJSON(v interface{}, raw json.RawMessage) error {
+	switch v.(type) {
+	case *time.Duration, *[]string:
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return setString(v, s)
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// flagValue records a flag's value so it can be applied after the
+// config file and environment variables.
+type flagValue struct {
+	s   setting
+	set map[string]string
+}
+
+// String returns the default, or "" if it's the zero value so flag
+// doesn't show it.
+func (f *flagValue) String() string {
+	if f == nil || f.s.value == nil || reflect.ValueOf(f.s.value).Elem().IsZero() {
+		return ""
+	}
+	return formatSetting(f.s.value)
+}
+
+func (f *flagValue) Set(v string) error {
+	// parse into a scratch value so errors are reported by flag
+	scratch := DefaultConfig()
+	for _, s := range scratch.settings() {
+		if s.key == f.s.key {
+			if err := setString(s.value, v); err != nil {
+				return err
+			}
+		}
+	}
+	f.set[f.s.key] = v
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	_, ok := f.s.value.(*bool)
+	return ok
+}
+
+func formatSetting(v interface{}) string {
+	switch v := v.(type) {
+	case *time.Duration:
+		return v.String()
+	case *[]string:
+		return strings.Join(*v, ",")
+	}
+	return fmt.Sprint(deref(v))
+}
+
+// deref returns the value of the field v points to.
+func deref(v interface{}) interface{} {
+	if l, ok := v.(*[]string); ok && *l == nil {
+		return []string{}
+	}
+	return reflect.ValueOf(v).Elem().Interface()
+}
+
+// LoadConfig returns the configuration given by the flags in args
+// and the environment, and the arguments left after the flags.
+// Flags take precedence over environment variables, which take
+// precedence over the config file named by the -config flag or the
+// CROSSCLUES_CONFIG environment variable. The configuration is
+// validated.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool), output io.Writer) (*Config, []string, error) {
+	c := DefaultConfig()
+	defaults := DefaultConfig().settings()
+
+	fs := flag.NewFlagSet("crossclues", flag.ContinueOnError)
+	fs.SetOutput(output)
+	path := fs.String("config", "", "JSON file to read settings from, by their flag names with underscores (env "+configFileEnv+")")
+	flagged := make(map[string]string)
+	for _, s := range defaults {
+		if s.secret {
+			continue
+		}
+		fs.Var(&flagValue{s: s, set: flagged}, s.flagName(), s.usage+" (env "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *path == "" {
+		*path, _ = lookupEnv(configFileEnv)
+	}
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, s := range c.settings() {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := setString(s.value, v); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+		if v, ok := flagged[s.key]; ok {
+			// already checked by flagValue.Set
+			setString(s.value, v)
+		}
+	}
+	return c, fs.Args(), c.Validate()
+}
+
+// readFile sets the settings in the JSON config file at path.
+func (c *Config) readFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, s := range c.settings() {
+		if raw, ok := file[s.key]; ok {
+			if err := setJSON(s.value, raw); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, s.key, err)
+			}
+			delete(file, s.key)
+		}
+	}
+	for key := range file {
+		return fmt.Errorf("%s: unknown setting %q", path, key)
+	}
+	return nil
+}
+
+// Validate checks that the settings are usable before the server
+// starts.
+func (c *Config) Validate() error {
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("port %q isn't a port number", c.Port)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if c.RedirectPort != "" {
+		if c.TLSCert == "" {
+			return errors.New("redirect_port requires tls_cert and tls_key")
+		}
+		if port, err := strconv.Atoi(c.RedirectPort); err != nil || port < 1 || port > 65535 || c.RedirectPort == c.Port {
+			return fmt.Errorf("redirect_port %q isn't a port number other than port", c.RedirectPort)
+		}
+	}
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log_level: %w", err)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format: unknown format %q", c.LogFormat)
+	}
+	switch c.TraceExporter {
+	case "", "stdout", "otlp-file":
+	default:
+		return fmt.Errorf("trace_exporter: unknown exporter %q", c.TraceExporter)
+	}
+	switch {
+	case c.Retention <= 0:
+		return errors.New("retention must be positive")
+	case c.LongPollTimeout <= 0:
+		return errors.New("long_poll_timeout must be positive")
+	case c.GameIDEntropy < 8 || c.GameIDEntropy > 64:
+		return errors.New("game_id_entropy must be between 8 and 64 bits")
+	case c.HSTSMaxAge < 0:
+		return errors.New("hsts_max_age can't be negative")
+	case c.MaxCachedGames <= 0:
+		return errors.New("max_cached_games must be positive")
+	case c.MaxWordSetWords < 25:
+		return errors.New("max_word_set_words must be at least 25, the smallest word set")
+	case c.IPRate < 0 || c.GameRate < 0 || c.GlobalRate < 0 || c.GamesPerIP < 0:
+		return errors.New("rate limits can't be negative")
+	case c.MaxWordSetMB < 0 || c.TrustedProxyHops < 0:
+		return errors.New("max_word_set_mb and trusted_proxy_hops can't be negative")
+	case c.DataDir == "":
+		return errors.New("data_dir is required")
+	}
+	if c.Follow != "" {
+		if u, err := url.Parse(c.Follow); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("follow: %q isn't an absolute URL", c.Follow)
+		}
+	}
+	if (c.Cluster == "") != (c.NodeID == "") {
+		return errors.New("cluster and node_id must be set together")
+	}
+	if c.Cluster != "" {
+		if _, err := ParseStaticCluster(c.NodeID, c.Cluster); err != nil {
+			return fmt.Errorf("cluster: %w", err)
+		}
+		if c.ClusterSecret == "" {
+			return errors.New("cluster requires a cluster secret (env CLUSTER_SECRET)")
+		}
+	}
+	if (c.Follow != "" || c.Cluster != "") && c.SessionSecret == "" {
+		// A generated secret is only kept in this node's store.
+		return errors.New("follow and cluster require a session secret shared by every node (env SESSION_SECRET)")
+	}
+	if (len(c.Webhooks) > 0 || c.AllowGameWebhooks) && c.WebhookSecret == "" {
+		return errors.New("webhooks require a webhook secret (env WEBHOOK_SECRET)")
+	}
+	for _, u := range c.Webhooks {
+		if err := validateWebhookURL(u); err != nil {
+			return fmt.Errorf("webhooks: %w", err)
+		}
+	}
+	if _, err := ParseCredentials(c.AdminCredentials); err != nil {
+		return fmt.Errorf("admin_credentials: %w", err)
+	}
+	return nil
+}
+
+// Print writes the configuration as a JSON config file. Secrets that
+// are set are replaced with "<redacted>".
+func (c *Config) Print(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	settings := c.settings()
+	for i, s := range settings {
+		v := deref(s.value)
+		switch {
+		case s.secret && v != "":
+			v = "<redacted>"
+		case s.secret:
+		default:
+			if _, ok := s.value.(*time.Duration); ok {
+				v = formatSetting(s.value)
+			}
+		}
+		fmt.Fprintf(&buf, "  %q: ", s.key)
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		// Encode ends the value with a newline
+		buf.Truncate(buf.Len() - 1)
+		if i < len(settings)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
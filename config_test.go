@@ -0,0 +1,137 @@
+package crossclues
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(tempDir(t, "test-config-*"), "crossclues.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func envFrom(m map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := m[key]
+		return v, ok
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"port": "9000",
+		"retention": "2h",
+		"max_cached_games": 50,
+		"log_level": "debug",
+		"webhooks": ["https://a.example.com/hook", "https://b.example.com/hook"],
+		"allow_game_webhooks": true
+	}`)
+	env := envFrom(map[string]string{
+		"CROSSCLUES_CONFIG":           path,
+		"PORT":                        "9001",
+		"CROSSCLUES_MAX_CACHED_GAMES": "60",
+		"WEBHOOK_SECRET":              "shh",
+	})
+	c, args, err := LoadConfig([]string{"-port", "9002", "-ip-rate", "2.5", "migrate"}, env, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []string{"migrate"}) {
+		t.Errorf("remaining args are %q", args)
+	}
+	want := DefaultConfig()
+	want.Port = "9002"             // flag over env and file
+	want.MaxCachedGames = 60       // env over file
+	want.Retention = 2 * time.Hour // file over default
+	want.LogLevel = "debug"        // file
+	want.IPRate = 2.5              // flag
+	want.WebhookSecret = "shh"     // env only
+	want.AllowGameWebhooks = true  // file
+	want.Webhooks = []string{"https://a.example.com/hook", "https://b.example.com/hook"}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v\nwant %+v", c, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	unknown := writeConfigFile(t, `{"prot": "9000"}`)
+	for _, tc := range []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"unknown key", []string{"-config", unknown}, nil, `unknown setting "prot"`},
+		{"missing file", []string{"-config", "/does/not/exist.json"}, nil, "no such file"},
+		{"bad env", nil, map[string]string{"CROSSCLUES_RETENTION": "forever"}, "CROSSCLUES_RETENTION"},
+		{"bad flag", []string{"-max-cached-games", "lots"}, nil, "invalid value"},
+		{"secret flag", []string{"-session-secret", "shh"}, nil, "not defined"},
+		{"bad port", []string{"-port", "http"}, nil, "isn't a port number"},
+		{"bad level", []string{"-log-level", "loud"}, nil, "log_level"},
+		{"cluster without node", []string{"-cluster", "a=http://a:8080"}, nil, "node_id"},
+		{"cluster without secret", []string{"-cluster", "a=http://a:8080", "-node-id", "a"}, nil, "cluster secret"},
+		{"follower without session secret", []string{"-follow", "http://primary:8080"}, nil, "SESSION_SECRET"},
+		{"cluster without session secret", []string{"-cluster", "a=http://a:8080", "-node-id", "a"}, map[string]string{"CLUSTER_SECRET": "shh"}, "SESSION_SECRET"},
+		{"webhooks without secret", []string{"-webhooks", "https://example.com/hook"}, nil, "webhook secret"},
+		{"bad credentials", nil, map[string]string{"ADMIN_CREDENTIALS": "ops:pw:root"}, "admin_credentials"},
+		{"tiny word sets", []string{"-max-word-set-words", "10"}, nil, "max_word_set_words"},
+		{"guessable game IDs", []string{"-game-id-entropy", "4"}, nil, "game_id_entropy"},
+		{"cert without key", []string{"-tls-cert", "cert.pem"}, nil, "tls_key"},
+		{"redirect without TLS", []string{"-redirect-port", "80"}, nil, "redirect_port requires"},
+		{"redirect to itself", []string{"-tls-cert", "cert.pem", "-tls-key", "key.pem", "-redirect-port", "8080"}, nil, "other than port"},
+	} {
+		_, _, err := LoadConfig(tc.args, envFrom(tc.env), ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestConfigPrint(t *testing.T) {
+	c := DefaultConfig()
+	c.SessionSecret = "shh"
+	c.Webhooks = []string{"https://example.com/hook"}
+	var buf bytes.Buffer
+	if err := c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`"session_secret": "<redacted>"`,
+		`"webhook_secret": ""`,
+		`"retention": "24h0m0s"`,
+		`"webhooks": ["https://example.com/hook"]`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("printed config is missing %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "shh") {
+		t.Errorf("printed config contains a secret:\n%s", out)
+	}
+
+	// Apart from secrets, the printed config reads back the same.
+	c.SessionSecret = ""
+	buf.Reset()
+	c.Print(&buf)
+	path := writeConfigFile(t, buf.String())
+	read, _, err := LoadConfig([]string{"-config", path}, envFrom(map[string]string{"WEBHOOK_SECRET": "x"}), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read.WebhookSecret = ""
+	if !reflect.DeepEqual(read, c) {
+		t.Errorf("read back %+v\nwant %+v", read, c)
+	}
+	os.Remove(path)
+}
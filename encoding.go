@@ -0,0 +1,404 @@
+package crossclues
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Games are persisted in a compact, protobuf-style binary encoding:
+//
+//	record = binaryRecordMagic uvarint(schema version) field*
+//	field  = uvarint(number<<3 | wire type) payload
+//
+// Varint payloads are zigzag encoded. Bytes payloads are a uvarint
+// length followed by that many bytes. Repeated fields are written
+// once per element, except for packed scalars. Unknown fields are
+// skipped, so fields can be added without breaking older readers.
+// Records written before the binary encoding existed are JSON, which
+// never starts with binaryRecordMagic.
+const binaryRecordMagic = 0x00
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Field numbers. Never reuse a number once it has been written to
+// disk.
+const (
+	fieldSeed            = 1
+	fieldPermIndex       = 2
+	fieldRevealed        = 3 // packed, one byte per cell
+	fieldWordSet         = 4 // repeated
+	fieldDeckIndex       = 5
+	fieldPlayerCards     = 6 // repeated {varint index, string player}
+	fieldDiscards        = 7 // repeated {varint index, string player}
+	fieldID              = 8
+	fieldCreatedAt       = 9  // {varint unix secs, varint nanos}
+	fieldUpdatedAt       = 10 // {varint unix secs, varint nanos}
+	fieldWords           = 11 // repeated
+	fieldDeck            = 12 // packed varints
+	fieldScore           = 13
+	fieldDiscardCount    = 14
+	fieldWon             = 15
+	fieldTimerDurationMS = 16
+	fieldEnforceTimer    = 17
+	fieldHandSize        = 18
+	fieldBoardSize       = 19
+	fieldPlayerIDs       = 20 // repeated
+	fieldWebhookURL      = 21
+	fieldSessions        = 22 // repeated {string player, string nonce}
+	fieldHost            = 23
+	fieldPasscodeHash    = 24
+	fieldHostNonce       = 25
+	fieldLocked          = 26
+	fieldWordSetID       = 27 // a built-in word set, in place of fieldWordSet
+)
+
+type binaryWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binaryWriter) key(num, wire int) {
+	w.uvarint(uint64(num<<3 | wire))
+}
+
+func (w *binaryWriter) int(num int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.key(num, wireVarint)
+	w.uvarint(zigzag(v))
+}
+
+func (w *binaryWriter) bool(num int, v bool) {
+	if v {
+		w.int(num, 1)
+	}
+}
+
+func (w *binaryWriter) bytes(num int, b []byte) {
+	w.key(num, wireBytes)
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *binaryWriter) string(num int, s string) {
+	w.key(num, wireBytes)
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binaryWriter) strings(num int, ss []string) {
+	for _, s := range ss {
+		w.string(num, s)
+	}
+}
+
+func (w *binaryWriter) time(num int, t time.Time) {
+	var sub binaryWriter
+	sub.uvarint(zigzag(t.Unix()))
+	sub.uvarint(uint64(t.Nanosecond()))
+	w.bytes(num, sub.buf)
+}
+
+func (w *binaryWriter) cards(num int, m map[int]string) {
+	// Sort so identical games encode identically.
+	idxs := make([]int, 0, len(m))
+	for idx := range m {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	for _, idx := range idxs {
+		var sub binaryWriter
+		sub.uvarint(zigzag(int64(idx)))
+		sub.buf = append(sub.buf, m[idx]...)
+		w.bytes(num, sub.buf)
+	}
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// marshalGameBinary encodes g in the binary record format, stamped
+// with the current SchemaVersion.
+func marshalGameBinary(g *Game) []byte {
+	w := binaryWriter{buf: make([]byte, 0, 64+12*len(g.WordSet))}
+	w.buf = append(w.buf, binaryRecordMagic)
+	w.uvarint(SchemaVersion)
+
+	w.int(fieldSeed, g.Seed)
+	w.int(fieldPermIndex, int64(g.PermIndex))
+	if g.Revealed != nil {
+		packed := make([]byte, len(g.Revealed))
+		for i, r := range g.Revealed {
+			if r {
+				packed[i] = 1
+			}
+		}
+		w.bytes(fieldRevealed, packed)
+	}
+	id := hashWordSet(g.WordSet)
+	if _, builtin := builtinWordSet(id); builtin {
+		w.bytes(fieldWordSetID, id[:])
+	} else {
+		w.strings(fieldWordSet, g.WordSet)
+	}
+	w.int(fieldDeckIndex, int64(g.DeckIndex))
+	w.cards(fieldPlayerCards, g.PlayerCards)
+	w.cards(fieldDiscards, g.Discards)
+
+	w.string(fieldID, g.ID)
+	w.time(fieldCreatedAt, g.CreatedAt)
+	w.time(fieldUpdatedAt, g.UpdatedAt)
+	w.strings(fieldWords, g.Words)
+	if g.Deck != nil {
+		var packed binaryWriter
+		for _, c := range g.Deck {
+			packed.uvarint(zigzag(int64(c)))
+		}
+		w.bytes(fieldDeck, packed.buf)
+	}
+	w.int(fieldScore, int64(g.Score))
+	w.int(fieldDiscardCount, int64(g.DiscardCount))
+	w.bool(fieldWon, g.Won)
+
+	w.int(fieldTimerDurationMS, g.TimerDurationMS)
+	w.bool(fieldEnforceTimer, g.EnforceTimer)
+	w.int(fieldHandSize, int64(g.HandSize))
+	w.int(fieldBoardSize, int64(g.BoardSize))
+	w.strings(fieldPlayerIDs, g.PlayerIDs)
+	if g.WebhookURL != "" {
+		w.string(fieldWebhookURL, g.WebhookURL)
+	}
+	w.sessions(fieldSessions, g.Sessions)
+	if g.Host != "" {
+		w.string(fieldHost, g.Host)
+	}
+	if g.PasscodeHash != "" {
+		w.string(fieldPasscodeHash, g.PasscodeHash)
+	}
+	if g.HostNonce != "" {
+		w.string(fieldHostNonce, g.HostNonce)
+	}
+	w.bool(fieldLocked, g.Locked)
+	return w.buf
+}
+
+func (w *binaryWriter) sessions(num int, m map[string]string) {
+	players := make([]string, 0, len(m))
+	for p := range m {
+		players = append(players, p)
+	}
+	sort.Strings(players)
+	for _, p := range players {
+		var sub binaryWriter
+		sub.uvarint(uint64(len(p)))
+		sub.buf = append(sub.buf, p...)
+		sub.buf = append(sub.buf, m[p]...)
+		w.bytes(num, sub.buf)
+	}
+}
+
+var errTruncated = errors.New("truncated binary game record")
+
+type binaryReader struct {
+	buf []byte
+}
+
+func (r *binaryReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *binaryReader) bytes() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)) < n {
+		return nil, errTruncated
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+func readTime(b []byte) (time.Time, error) {
+	r := binaryReader{buf: b}
+	secs, err := r.uvarint()
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos, err := r.uvarint()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unzigzag(secs), int64(nanos)).UTC(), nil
+}
+
+func readCard(b []byte, m map[int]string) error {
+	r := binaryReader{buf: b}
+	idx, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	m[int(unzigzag(idx))] = string(r.buf)
+	return nil
+}
+
+func readSession(b []byte, m map[string]string) error {
+	r := binaryReader{buf: b}
+	player, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	m[string(player)] = string(r.buf)
+	return nil
+}
+
+// unmarshalGameBinary decodes a record written by marshalGameBinary
+// and returns the game along with the record's schema version.
+func unmarshalGameBinary(b []byte) (*Game, int, error) {
+	if len(b) == 0 || b[0] != binaryRecordMagic {
+		return nil, 0, errors.New("not a binary game record")
+	}
+	r := binaryReader{buf: b[1:]}
+	version, err := r.uvarint()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Games always have these allocated, even when they're empty.
+	g := &Game{Words: []string{}}
+	g.PlayerCards = make(map[int]string)
+	g.Discards = make(map[int]string)
+	for len(r.buf) > 0 {
+		key, err := r.uvarint()
+		if err != nil {
+			return nil, 0, err
+		}
+		num, wire := int(key>>3), int(key&7)
+
+		var v int64
+		var payload []byte
+		switch wire {
+		case wireVarint:
+			u, err := r.uvarint()
+			if err != nil {
+				return nil, 0, err
+			}
+			v = unzigzag(u)
+		case wireBytes:
+			payload, err = r.bytes()
+			if err != nil {
+				return nil, 0, err
+			}
+		default:
+			return nil, 0, fmt.Errorf("field %d has unknown wire type %d", num, wire)
+		}
+
+		switch num {
+		case fieldSeed:
+			g.Seed = v
+		case fieldPermIndex:
+			g.PermIndex = int(v)
+		case fieldRevealed:
+			g.Revealed = make([]bool, len(payload))
+			for i, p := range payload {
+				g.Revealed[i] = p != 0
+			}
+		case fieldWordSet:
+			g.WordSet = append(g.WordSet, string(payload))
+		case fieldWordSetID:
+			var id wordSetID
+			copy(id[:], payload)
+			words, ok := builtinWordSet(id)
+			if len(payload) != len(id) || !ok {
+				return nil, 0, fmt.Errorf("unknown word set %x", payload)
+			}
+			// Games share the set, as they do in memory; none
+			// modify it.
+			g.WordSet = words
+		case fieldDeckIndex:
+			g.DeckIndex = int(v)
+		case fieldPlayerCards:
+			err = readCard(payload, g.PlayerCards)
+		case fieldDiscards:
+			err = readCard(payload, g.Discards)
+		case fieldID:
+			g.ID = string(payload)
+		case fieldCreatedAt:
+			g.CreatedAt, err = readTime(payload)
+		case fieldUpdatedAt:
+			g.UpdatedAt, err = readTime(payload)
+		case fieldWords:
+			g.Words = append(g.Words, string(payload))
+		case fieldDeck:
+			g.Deck = make([]int, 0, len(payload))
+			packed := binaryReader{buf: payload}
+			for len(packed.buf) > 0 {
+				u, perr := packed.uvarint()
+				if perr != nil {
+					return nil, 0, perr
+				}
+				g.Deck = append(g.Deck, int(unzigzag(u)))
+			}
+		case fieldScore:
+			g.Score = int(v)
+		case fieldDiscardCount:
+			g.DiscardCount = int(v)
+		case fieldWon:
+			g.Won = v != 0
+		case fieldTimerDurationMS:
+			g.TimerDurationMS = v
+		case fieldEnforceTimer:
+			g.EnforceTimer = v != 0
+		case fieldHandSize:
+			g.HandSize = int(v)
+		case fieldBoardSize:
+			g.BoardSize = int(v)
+		case fieldPlayerIDs:
+			g.PlayerIDs = append(g.PlayerIDs, string(payload))
+		case fieldWebhookURL:
+			g.WebhookURL = string(payload)
+		case fieldSessions:
+			if g.Sessions == nil {
+				g.Sessions = make(map[string]string)
+			}
+			err = readSession(payload, g.Sessions)
+		case fieldHost:
+			g.Host = string(payload)
+		case fieldPasscodeHash:
+			g.PasscodeHash = string(payload)
+		case fieldHostNonce:
+			g.HostNonce = string(payload)
+		case fieldLocked:
+			g.Locked = v != 0
+		default:
+			// Written by a newer version; skip it.
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("field %d: %w", num, err)
+		}
+	}
+	return g, int(version), nil
+}
@@ -0,0 +1,138 @@
+package crossclues
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kr/pretty"
+)
+
+func playedGame() *Game {
+	opts := GameOptions{TimerDurationMS: 90000, EnforceTimer: true, HandSize: 2, BoardSize: DefaultBoardSize, WebhookURL: "https://example.com/hook"}
+	g := newGame("binary", randomState(words, DefaultBoardSize), opts)
+	g.Draw("alice")
+	g.Draw("bob")
+	for idx, player := range g.PlayerCards {
+		if player == "alice" {
+			g.Guess(idx, "alice")
+			break
+		}
+	}
+	for idx, player := range g.PlayerCards {
+		if player == "bob" {
+			g.Discard("bob", idx)
+			break
+		}
+	}
+	g.PlayerIDs = []string{"alice", "bob"}
+	g.Sessions = map[string]string{"alice": "0123456789abcdef", "bob": "fedcba9876543210"}
+	g.Host = "alice"
+	g.PasscodeHash = hashPasscode("open sesame")
+	g.HostNonce = "0123456789abcdef"
+	g.Locked = true
+	g.Won = true
+	return g
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	g := playedGame()
+	got, version, err := unmarshalGameBinary(marshalGameBinary(g))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion {
+		t.Errorf("version = %d, want %d", version, SchemaVersion)
+	}
+
+	// Times come back in UTC without a monotonic reading.
+	for _, pair := range [][2]*time.Time{{&got.CreatedAt, &g.CreatedAt}, {&got.UpdatedAt, &g.UpdatedAt}} {
+		if !pair[0].Equal(*pair[1]) {
+			t.Errorf("time = %s, want %s", *pair[0], *pair[1])
+		}
+		*pair[0], *pair[1] = time.Time{}, time.Time{}
+	}
+	if !reflect.DeepEqual(got, g) {
+		t.Errorf("round trip mismatch:\n%s", pretty.Diff(got, g))
+	}
+}
+
+func TestBinarySkipsUnknownFields(t *testing.T) {
+	g := playedGame()
+	b := marshalGameBinary(g)
+
+	// Append fields from a hypothetical newer version.
+	w := binaryWriter{buf: b}
+	w.int(99, 12345)
+	w.string(100, "from the future")
+
+	got, _, err := unmarshalGameBinary(w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != g.ID || !reflect.DeepEqual(got.Deck, g.Deck) {
+		t.Errorf("decoding with unknown fields lost data: %s", pretty.Sprint(got))
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	b := marshalGameBinary(playedGame())
+	// The record ends with the locked flag, so dropping its last byte
+	// leaves the flag's key without a value.
+	for _, n := range []int{1, len(b) - 1} {
+		if _, _, err := unmarshalGameBinary(b[:n]); err == nil {
+			t.Errorf("decoding %d of %d bytes succeeded", n, len(b))
+		}
+	}
+}
+
+func TestBinaryBuiltinWordSets(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	custom := append([]string{"AARDVARK"}, s.defaultWords...)
+	// The frontend sends its word sets as custom ones.
+	var sets map[string][]string
+	if err := json.Unmarshal(embeddedWordSets, &sets); err != nil {
+		t.Fatal(err)
+	}
+	var ws WordSets
+	_, picked, err := ws.Canonicalize(sets["English (Original)"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		words   []string
+		builtin bool
+	}{
+		{"default", s.defaultWords, true},
+		{"frontend", picked, true},
+		{"custom", custom, false},
+	} {
+		g := newGame("words", randomState(tc.words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})
+		b := marshalGameBinary(g)
+		// Every word takes at least two bytes inline.
+		if inline := len(b) > 2*len(tc.words); inline == tc.builtin {
+			t.Errorf("%s word set: record of %d bytes for %d words", tc.name, len(b), len(tc.words))
+		}
+		got, _, err := unmarshalGameBinary(b)
+		if err != nil {
+			t.Fatalf("%s word set: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(got.WordSet, tc.words) {
+			t.Errorf("%s word set didn't round trip", tc.name)
+		}
+	}
+
+	// A record naming a word set this build doesn't know is refused.
+	w := binaryWriter{buf: []byte{binaryRecordMagic}}
+	w.uvarint(SchemaVersion)
+	w.bytes(fieldWordSetID, make([]byte, 20))
+	if _, _, err := unmarshalGameBinary(w.buf); err == nil {
+		t.Error("decoding an unknown word set succeeded")
+	}
+}
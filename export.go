@@ -0,0 +1,141 @@
+package crossclues
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// GameFilter selects stored games by creation time and ID. The zero
+// value matches every game.
+type GameFilter struct {
+	CreatedAfter  time.Time       // inclusive; ignored if zero
+	CreatedBefore time.Time       // exclusive; ignored if zero
+	IDs           map[string]bool // ignored if empty
+}
+
+func (f GameFilter) match(g *Game) bool {
+	if !f.CreatedAfter.IsZero() && g.CreatedAt.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !g.CreatedAt.Before(f.CreatedBefore) {
+		return false
+	}
+	return len(f.IDs) == 0 || f.IDs[g.ID]
+}
+
+// iterOptions narrows the scan to the creation times the filter can
+// match, since keys are ordered by creation time.
+func (f GameFilter) iterOptions() *pebble.IterOptions {
+	opts := gamesIterOptions()
+	if !f.CreatedAfter.IsZero() {
+		opts.LowerBound = mkkey(f.CreatedAfter.Unix(), "")
+	}
+	if !f.CreatedBefore.IsZero() && f.CreatedBefore.Unix() < math.MaxInt64 {
+		// Keys hold whole seconds; match refines the boundary.
+		opts.UpperBound = mkkey(f.CreatedBefore.Unix()+1, "")
+	}
+	return opts
+}
+
+// Each calls fn with every stored game matching f, in order of
+// creation time, stopping at the first error fn returns. Records
+// that can't be decoded are logged and skipped, so one bad record
+// doesn't stop an export.
+func (ps *PebbleStore) Each(f GameFilter, fn func(*Game) error) error {
+	iter := ps.DB.NewIter(f.iterOptions())
+	defer iter.Close()
+
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		g, err := decodeGame(iter.Value())
+		if err != nil {
+			ps.Log.Error("skipping undecodable game record", "key", string(iter.Key()), "err", err)
+			continue
+		}
+		if !f.match(g) {
+			continue
+		}
+		if err := fn(g); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("games iter: %w", err)
+	}
+	return nil
+}
+
+// Export writes every stored game matching f to w as
+// newline-delimited JSON, one record per line in the same form
+// Import reads, and returns how many games were written.
+func (ps *PebbleStore) Export(w io.Writer, f GameFilter) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var n int
+	err := ps.Each(f, func(g *Game) error {
+		if err := enc.Encode(gameRecord{SchemaVersion: SchemaVersion, Game: g}); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// ImportResult counts what Import did with each record.
+type ImportResult struct {
+	Imported int // new games, or newer versions of stored games
+	Skipped  int // stored games that were as new or newer
+}
+
+// Import reads newline-delimited JSON games written by Export and
+// saves them. Older records are migrated like any other record. A
+// game is only saved if the store has no game with its ID or the
+// stored one was updated earlier, so importing never overwrites
+// newer data. Import stops at the first invalid record; records
+// before it have already been saved.
+func (ps *PebbleStore) Import(r io.Reader) (ImportResult, error) {
+	var res ImportResult
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		b := sc.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		g, err := decodeGame(b)
+		if err != nil {
+			return res, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := g.validate(); err != nil {
+			return res, fmt.Errorf("line %d: game %q: %w", line, g.ID, err)
+		}
+		if id, err := ParseGameID(g.ID); err != nil {
+			return res, fmt.Errorf("line %d: game %q: %w", line, g.ID, err)
+		} else if string(id) != g.ID {
+			return res, fmt.Errorf("line %d: game %q: game IDs are lowercase", line, g.ID)
+		}
+
+		existing, err := ps.Load(g.ID)
+		if err != nil {
+			return res, fmt.Errorf("line %d: %w", line, err)
+		}
+		if existing != nil && !existing.UpdatedAt.Before(g.UpdatedAt) {
+			res.Skipped++
+			continue
+		}
+		if err := ps.Save(g); err != nil {
+			return res, fmt.Errorf("line %d: %w", line, err)
+		}
+		res.Imported++
+	}
+	return res, sc.Err()
+}
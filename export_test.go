@@ -0,0 +1,121 @@
+package crossclues
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := openStore(t, tempDir(t, "test-export-*"))
+	games := randomGames(6)
+	base := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range gameIDs[:6] {
+		games[id].CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		games[id].UpdatedAt = games[id].CreatedAt.Add(time.Minute)
+	}
+	saveGames(t, src, games)
+
+	filterTests := []struct {
+		name   string
+		filter GameFilter
+		want   []string
+	}{
+		{"all", GameFilter{}, gameIDs[:6]},
+		{"created after", GameFilter{CreatedAfter: base.Add(4 * time.Hour)}, gameIDs[4:6]},
+		{"created before", GameFilter{CreatedBefore: base.Add(2*time.Hour + time.Second)}, gameIDs[:3]},
+		{"by ID", GameFilter{IDs: map[string]bool{gameIDs[1]: true, gameIDs[5]: true}}, []string{gameIDs[1], gameIDs[5]}},
+	}
+	for _, tc := range filterTests {
+		var buf bytes.Buffer
+		n, err := src.Export(&buf, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(tc.want) {
+			t.Errorf("%s: exported %d games, want %d", tc.name, n, len(tc.want))
+		}
+		for _, id := range tc.want {
+			if !strings.Contains(buf.String(), `"id":"`+id+`"`) {
+				t.Errorf("%s: export is missing %q", tc.name, id)
+			}
+		}
+	}
+
+	// A record that can't be decoded is skipped rather than ending
+	// the export.
+	if err := src.DB.Set(mkkey(base.Add(30*time.Minute).Unix(), "garbled"), []byte("not a game"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var all bytes.Buffer
+	if n, err := src.Export(&all, GameFilter{}); err != nil || n != 6 {
+		t.Fatalf("Export with an undecodable record = %d, %v; want the 6 games", n, err)
+	}
+
+	// The destination already has a newer version of one game and an
+	// older version of another.
+	dst := openStore(t, tempDir(t, "test-import-*"))
+	newer := *games[gameIDs[0]]
+	newer.UpdatedAt = newer.UpdatedAt.Add(time.Hour)
+	newer.Score = 7
+	older := *games[gameIDs[1]]
+	older.UpdatedAt = older.UpdatedAt.Add(-time.Hour)
+	older.Score = 3
+	for _, g := range []*Game{&newer, &older} {
+		if err := dst.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := dst.Import(&all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 5 || res.Skipped != 1 {
+		t.Errorf("Import = %+v, want 5 imported and 1 skipped", res)
+	}
+	if g, _ := dst.Load(gameIDs[0]); g == nil || g.Score != 7 {
+		t.Errorf("import overwrote a newer game: %+v", g)
+	}
+	if g, _ := dst.Load(gameIDs[1]); g == nil || g.Score != games[gameIDs[1]].Score {
+		t.Errorf("import didn't replace an older game: %+v", g)
+	}
+	for _, id := range gameIDs[2:6] {
+		if g, _ := dst.Load(id); g == nil {
+			t.Errorf("game %q wasn't imported", id)
+		}
+	}
+}
+
+func TestImportRejectsInvalid(t *testing.T) {
+	dst := openStore(t, tempDir(t, "test-import-*"))
+	tests := []string{
+		`not json`,
+		`{"schema_version":1,"id":""}`,
+		`{"schema_version":1,"id":"x","board_size":4,"revealed":[true],"created_at":"2021-01-01T00:00:00Z","updated_at":"2021-01-01T00:00:00Z"}`,
+		`{"schema_version":99,"id":"from-the-future"}`,
+	}
+	for _, in := range tests {
+		if _, err := dst.Import(strings.NewReader(in + "\n")); err == nil {
+			t.Errorf("Import(%s) succeeded", in)
+		}
+	}
+
+	// The golden record from before schema versioning is valid, and
+	// older IDs are made canonical, unless they can't be.
+	golden := readGoldenV0(t)
+	if _, err := dst.Import(bytes.NewReader(bytes.Replace(golden, []byte(`"golden-fixture"`), []byte(`"stats"`), 1))); err == nil {
+		t.Errorf("Import of a game with a reserved ID succeeded")
+	}
+	res, err := dst.Import(bytes.NewReader(bytes.Replace(golden, []byte(`"golden-fixture"`), []byte(`"Golden Fixture"`), 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 1 {
+		t.Errorf("Import of golden record = %+v", res)
+	}
+	if g, _ := dst.Load("golden-fixture"); g == nil {
+		t.Errorf("golden record wasn't imported as golden-fixture")
+	}
+}
@@ -2,6 +2,7 @@ import * as React from 'react';
 import * as ReactDOM from 'react-dom';
 import { Game } from '~/ui/game';
 import { Lobby } from '~/ui/lobby';
+import { autogeneratedGameID, selectedGameID } from '~/ui/page';
 import websocket from '~/ui/websocket';
 
 export class App extends React.Component {
@@ -15,8 +16,8 @@ export class App extends React.Component {
     if (document.location.hash) {
       this.state.gameID = document.location.hash.slice(1);
     }
-    if (window.selectedGameID) {
-      this.state.gameID = window.selectedGameID;
+    if (selectedGameID()) {
+      this.state.gameID = selectedGameID();
     }
 
     if (this.state.gameID) {
@@ -29,7 +30,7 @@ export class App extends React.Component {
     if (this.state.gameID) {
       pane = <Game gameID={this.state.gameID} playerID={this.state.playerID} />;
     } else {
-      pane = <Lobby autogeneratedGameID={window.autogeneratedGameID} />;
+      pane = <Lobby autogeneratedGameID={autogeneratedGameID()} />;
     }
 
     return (
@@ -3,6 +3,7 @@ import axios from 'axios';
 import { Settings, SettingsButton, SettingsPanel } from '~/ui/settings';
 import Timer from '~/ui/timer';
 import websocket from '~/ui/websocket';
+import { asPlayer, join } from '~/ui/session';
 
 export class Game extends React.Component {
   constructor(props) {
@@ -20,14 +21,78 @@ export class Game extends React.Component {
     };
 
     if (websocket.websocket == null) {
-      websocket.connect(this.props.gameID, this.state.playerID);
+      // Joining again resumes the session after a page reload.
+      join(this.props.gameID, this.state.playerID).then(() => {
+        websocket.connect(this.props.gameID, this.state.playerID);
+        this.listen();
+      });
+    } else {
+      this.listen();
     }
+  }
 
+  private listen() {
     websocket.websocket.onmessage = function (event) {
       let gameState = JSON.parse(event.data);
+      if (gameState.notice) {
+        // a message from the server's operators
+        alert(gameState.notice);
+        return;
+      }
       this.setState({ game: gameState });
       this.refresh();
     }.bind(this);
+    websocket.websocket.onclose = function (event) {
+      if (event.code == 1008) {
+        // kicked by the host, or the game was deleted
+        alert(event.reason);
+        window.location = '/';
+      }
+    };
+  }
+
+  public isHost() {
+    return this.state.game?.host == this.state.playerID;
+  }
+
+  // Sends one of the host's moderation requests.
+  public hostAction(path, body) {
+    axios
+      .post(
+        path,
+        {
+          game_id: this.state.game.id,
+          player_id: this.state.playerID,
+          ...body,
+        },
+        asPlayer(this.state.game.id, this.state.playerID)
+      )
+      .then(({ data }) => {
+        this.setState({ game: data });
+      });
+  }
+
+  public changePasscode(e) {
+    e.preventDefault();
+    const passcode = prompt(
+      'New passcode for this game (leave empty to make it public):'
+    );
+    if (passcode == null) {
+      return;
+    }
+    axios
+      .post(
+        '/passcode',
+        {
+          game_id: this.state.game.id,
+          player_id: this.state.playerID,
+          passcode: passcode,
+        },
+        asPlayer(this.state.game.id, this.state.playerID)
+      )
+      .then(({ data }) => {
+        this.setState({ game: data });
+      });
   }
 
   public extraClasses() {
@@ -67,11 +132,15 @@ export class Game extends React.Component {
 
     // TODO: Handle game state error
     axios
-      .post('/game-state', {
-        game_id: this.props.gameID,
-        state_id: state_id,
-        player_id: this.props.playerID,
-      })
+      .post(
+        '/game-state',
+        {
+          game_id: this.props.gameID,
+          state_id: state_id,
+          player_id: this.props.playerID,
+        },
+        asPlayer(this.props.gameID, this.props.playerID)
+      )
       .then(({ data }) => {
         this.setState((oldState) => {
           const stateToUpdate = { game: data };
@@ -161,11 +230,15 @@ export class Game extends React.Component {
     }
 
     axios
-      .post('/guess', {
-        game_id: this.state.game.id,
-        index: idx,
-        player_id: this.state.playerID,
-      })
+      .post(
+        '/guess',
+        {
+          game_id: this.state.game.id,
+          index: idx,
+          player_id: this.state.playerID,
+        },
+        asPlayer(this.state.game.id, this.state.playerID)
+      )
       .then(({ data }) => {
         this.setState({ game: data });
       })
@@ -190,11 +263,15 @@ export class Game extends React.Component {
     }
 
     axios
-      .post('/discard', {
-        game_id: this.state.game.id,
-        index: idx,
-        player_id: this.state.playerID,
-      })
+      .post(
+        '/discard',
+        {
+          game_id: this.state.game.id,
+          index: idx,
+          player_id: this.state.playerID,
+        },
+        asPlayer(this.state.game.id, this.state.playerID)
+      )
       .then(({ data }) => {
         this.setState({ game: data });
       })
@@ -300,16 +377,20 @@ export class Game extends React.Component {
     }
 
     axios
-      .post('/next-game', {
-        game_id: this.state.game.id,
-        player_id: this.state.playerID,
-        word_set: this.state.game.word_set,
-        create_new: false,
-        timer_duration_ms: this.state.game.timer_duration_ms,
-        enforce_timer: this.state.game.enforce_timer,
-        hand_size: this.state.game.hand_size,
-        board_size: this.state.boardSize ?? this.state.game.board_size,
-      })
+      .post(
+        '/next-game',
+        {
+          game_id: this.state.game.id,
+          player_id: this.state.playerID,
+          word_set: this.state.game.word_set,
+          create_new: false,
+          timer_duration_ms: this.state.game.timer_duration_ms,
+          enforce_timer: this.state.game.enforce_timer,
+          hand_size: this.state.game.hand_size,
+          board_size: this.state.boardSize ?? this.state.game.board_size,
+        },
+        asPlayer(this.state.game.id, this.state.playerID)
+      )
       .then(({ data }) => {
         this.setState({ game: data, gameOver: false, timerExpired: false });
       })
@@ -371,6 +452,16 @@ export class Game extends React.Component {
           }
           values={this.state.settings}
           game={this.state.game}
+          isHost={this.isHost()}
+          onKick={(playerID) =>
+            this.hostAction('/kick', { target_player_id: playerID })
+          }
+          onMakeHost={(playerID) =>
+            this.hostAction('/transfer-host', { target_player_id: playerID })
+          }
+          onToggleLock={() =>
+            this.hostAction('/lock', { locked: !this.state.game.locked })
+          }
         />
       );
     }
@@ -442,9 +533,20 @@ export class Game extends React.Component {
             </span>
           </div>
 
-          <button onClick={(e) => this.nextGame(e)} id="next-game-btn">
-            Next game
-          </button>
+          {this.isHost() ? (
+            <button onClick={(e) => this.nextGame(e)} id="next-game-btn">
+              Next game
+            </button>
+          ) : null}
+
+          {this.isHost() ? (
+            <button
+              onClick={(e) => this.changePasscode(e)}
+              id="passcode-btn"
+            >
+              {this.state.game.private ? 'Change passcode' : 'Set passcode'}
+            </button>
+          ) : null}
 
           <SettingsButton
             onClick={(e) => {
@@ -6,6 +6,7 @@ import TimerSettings from '~/ui/timer_settings';
 import OriginalWords from '~/words.json';
 import websocket from '~/ui/websocket';
 import { Settings } from '~/ui/settings';
+import { asPlayer, join } from '~/ui/session';
 
 export const Lobby = ({ autogeneratedGameID }) => {
   const [newGameName, setNewGameName] = React.useState(
@@ -27,6 +28,7 @@ export const Lobby = ({ autogeneratedGameID }) => {
     Settings.load().boardSize ?? 4
   );
   const [enforceTimerEnabled, setEnforceTimerEnabled] = React.useState(false);
+  const [passcode, setPasscode] = React.useState('');
 
   let selectedWordCount = selectedWordSets
     .map((l) => words[l].length)
@@ -41,15 +43,30 @@ export const Lobby = ({ autogeneratedGameID }) => {
   let wsConn = null;
 
   function connectToWs() {
-    wsConn = websocket.connect(newGameName, playerId);
-
-    wsConn.onmessage = function (event) {
-      let gameState = JSON.parse(event.data);
-      setPlayerIds(gameState.player_ids);
-      if (gameState.words != null && gameState.words.length > 0) {
-        startGame(null);
-      }
-    };
+    join(newGameName, playerId, passcode || undefined)
+      .then(() => {
+        wsConn = websocket.connect(newGameName, playerId);
+
+        wsConn.onmessage = function (event) {
+          let gameState = JSON.parse(event.data);
+          if (gameState.notice) {
+            setWarning(gameState.notice);
+            return;
+          }
+          setPlayerIds(gameState.player_ids);
+          if (gameState.words != null && gameState.words.length > 0) {
+            // the host started the game
+            window.location = '/' + newGameName;
+          }
+        };
+      })
+      .catch((err) => {
+        if (err.response?.status == 400) {
+          setWarning(err.response.data.error);
+          return;
+        }
+        setWarning('Someone else in this game is using that name.');
+      });
   }
 
   function startGame(e) {
@@ -66,21 +83,35 @@ export const Lobby = ({ autogeneratedGameID }) => {
       return;
     }
 
-    axios
-      .post('/next-game', {
-        game_id: newGameName,
-        player_id: playerId,
-        word_set: combinedWordSet,
-        create_new: true,
-        timer_duration_ms:
-          timer && timer.length ? timer[0] * 60 * 1000 + timer[1] * 1000 : 0,
-        enforce_timer: timer && timer.length && enforceTimerEnabled,
-        hand_size: playerIds.length > 3 ? 1 : 2,
-        board_size: boardSize,
-      })
+    join(newGameName, playerId, passcode || undefined)
+      .then(() =>
+        axios.post(
+          '/next-game',
+          {
+            game_id: newGameName,
+            player_id: playerId,
+            word_set: combinedWordSet,
+            create_new: true,
+            timer_duration_ms:
+              timer && timer.length
+                ? timer[0] * 60 * 1000 + timer[1] * 1000
+                : 0,
+            enforce_timer: timer && timer.length && enforceTimerEnabled,
+            hand_size: playerIds.length > 3 ? 1 : 2,
+            board_size: boardSize,
+            passcode: passcode,
+          },
+          asPlayer(newGameName, playerId)
+        )
+      )
       .then(({ data }) => {
         const newURL = (document.location.pathname = '/' + newGameName);
         window.location = newURL;
+      })
+      .catch((err) => {
+        if (err.response?.status == 403) {
+          setWarning('Only the host can start the game.');
+        }
       });
   }
 
@@ -131,8 +162,10 @@ export const Lobby = ({ autogeneratedGameID }) => {
             aria-label="game identifier"
             autoFocus
             onChange={(e) => {
-              setNewGameName(e.target.value);
-              localStorage.setItem('gameName', e.target.value);
+              // The server lowercases game IDs anyway.
+              const name = e.target.value.toLowerCase();
+              setNewGameName(name);
+              localStorage.setItem('gameName', name);
             }}
             placeholder="Game ID"
             value={newGameName}
@@ -150,6 +183,15 @@ export const Lobby = ({ autogeneratedGameID }) => {
             value={playerId}
           />
 
+          <input
+            type="password"
+            id="game-passcode"
+            aria-label="passcode"
+            onChange={(e) => setPasscode(e.target.value)}
+            placeholder="Passcode (optional)"
+            value={passcode}
+          />
+
           <br></br>
 
           <button disabled={!newGameName.length} onClick={handleConnectToGame}>
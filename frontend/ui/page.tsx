@@ -0,0 +1,26 @@
+// The server renders the page's settings into data attributes of
+// #app, since the Content-Security-Policy allows no inline scripts.
+function data(): DOMStringMap {
+  const app = document.getElementById('app');
+  return app ? app.dataset : {};
+}
+
+// The game ID in the page's URL, if any.
+export function selectedGameID(): string {
+  return data().selectedGameId ?? '';
+}
+
+// An unused game ID to suggest in the lobby.
+export function autogeneratedGameID(): string {
+  return data().autogeneratedGameId ?? '';
+}
+
+// Whether the selected game is private and the URL has no passcode.
+export function passcodeRequired(): boolean {
+  return data().passcodeRequired != null;
+}
+
+// The passcode from an invite link, if it's right.
+export function invitePasscode(): string | undefined {
+  return data().passcode;
+}
@@ -0,0 +1,75 @@
+import axios from 'axios';
+import { invitePasscode, passcodeRequired } from '~/ui/page';
+
+// Session tokens are kept per game and player, so reloading the page
+// resumes the session instead of joining as someone new.
+function storageKey(gameID, playerID) {
+  return 'session:' + gameID + ':' + playerID;
+}
+
+function hostStorageKey(gameID) {
+  return 'host:' + gameID;
+}
+
+export function sessionToken(gameID, playerID) {
+  return localStorage.getItem(storageKey(gameID, playerID));
+}
+
+// Options for axios requests made as the player.
+export function asPlayer(gameID, playerID) {
+  const token = sessionToken(gameID, playerID);
+  return token ? { headers: { 'X-Crossclues-Session': token } } : {};
+}
+
+// Joins the game, or resumes the player's session in it, and returns
+// a promise of the session token. Private games need a passcode: the
+// one given, the one from an invite link, or one the player is
+// prompted for. A saved host token makes the player the host again.
+// Saved tokens the server no longer accepts are forgotten, and the
+// player joins afresh.
+export function join(gameID, playerID, passcode?) {
+  passcode = passcode ?? invitePasscode();
+  if (
+    passcode == null &&
+    passcodeRequired() &&
+    sessionToken(gameID, playerID) == null
+  ) {
+    passcode = prompt('This game is private. Enter its passcode:') ?? '';
+  }
+  const hostToken = localStorage.getItem(hostStorageKey(gameID));
+  const stale = sessionToken(gameID, playerID) != null || hostToken != null;
+  return axios
+    .post(
+      '/join',
+      {
+        game_id: gameID,
+        player_id: playerID,
+        passcode: passcode ?? '',
+        host_token: hostToken ?? '',
+      },
+      asPlayer(gameID, playerID)
+    )
+    .then(({ data }) => {
+      localStorage.setItem(storageKey(gameID, playerID), data.session_token);
+      if (data.host_token) {
+        localStorage.setItem(hostStorageKey(gameID), data.host_token);
+      }
+      return data.session_token;
+    })
+    .catch((err) => {
+      const status = err.response?.status;
+      if (stale && [401, 403, 409].includes(status)) {
+        localStorage.removeItem(storageKey(gameID, playerID));
+        localStorage.removeItem(hostStorageKey(gameID));
+        return join(gameID, playerID, passcode);
+      }
+      if (status != 403) {
+        throw err;
+      }
+      const entered = prompt('This game is private. Enter its passcode:');
+      if (entered == null) {
+        throw err;
+      }
+      return join(gameID, playerID, entered);
+    });
+}
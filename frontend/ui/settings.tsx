@@ -135,10 +135,29 @@ export class SettingsPanel extends React.Component {
             ))}
           </div>
 
+          {this.props.isHost ? (
+            <div className="toggles">
+              <button onClick={() => this.props.onToggleLock()}>
+                {this.props.game.locked ? 'Unlock settings' : 'Lock settings'}
+              </button>
+            </div>
+          ) : null}
+
           <div className={'playerIds'}>
             <h2>Connected Players</h2>
             {this.props.game.player_ids.map((w, idx) => (
-              <span key={idx}>{w}</span>
+              <span key={idx}>
+                {w}
+                {w == this.props.game.host ? ' (host)' : ''}
+                {this.props.isHost && w != this.props.game.host ? (
+                  <>
+                    <button onClick={() => this.props.onMakeHost(w)}>
+                      Make host
+                    </button>
+                    <button onClick={() => this.props.onKick(w)}>Kick</button>
+                  </>
+                ) : null}
+              </span>
             ))}
           </div>
         </div>
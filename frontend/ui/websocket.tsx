@@ -1,3 +1,5 @@
+import { sessionToken } from '~/ui/session';
+
 export class Websocket {
   constructor() {
     this.websocket = null;
@@ -9,7 +11,14 @@ export class Websocket {
     var getUrl = window.location;
     let wsProtocol = getUrl.protocol.endsWith('s:') ? 'wss://' : 'ws://';
     let wsPath =
-      wsProtocol + getUrl.host + '/websocket/' + gameID + '/' + playerID;
+      wsProtocol +
+      getUrl.host +
+      '/websocket/' +
+      gameID +
+      '/' +
+      playerID +
+      '?session=' +
+      encodeURIComponent(sessionToken(gameID, playerID) ?? '');
 
     this.websocket = new WebSocket(wsPath);
     return this.websocket;
@@ -0,0 +1,91 @@
+package crossclues
+
+import (
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestIndexSecurity(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	scriptTag := regexp.MustCompile(`<script[^>]*>`)
+	nonceAttr := regexp.MustCompile(`^<script nonce="([0-9a-f]+)" `)
+	selectedAttr := regexp.MustCompile(`data-selected-game-id="([^"]*)"`)
+	nonces := make(map[string]bool)
+	for _, id := range []string{"friendly-game", "another_game"} {
+		resp, err := http.Get(ts.URL + "/" + url.PathEscape(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := string(b)
+		if resp.StatusCode != 200 {
+			t.Fatalf("GET %q returned %d", id, resp.StatusCode)
+		}
+
+		// The only script is the app, with the nonce its policy allows.
+		scripts := scriptTag.FindAllString(body, -1)
+		if len(scripts) != 1 || !nonceAttr.MatchString(scripts[0]) {
+			t.Fatalf("%q: page has scripts %q, want only the app's with a nonce", id, scripts)
+		}
+		nonce := nonceAttr.FindStringSubmatch(scripts[0])[1]
+		csp := resp.Header.Get("Content-Security-Policy")
+		if !strings.Contains(csp, "script-src 'nonce-"+nonce+"'") || !strings.Contains(csp, "frame-ancestors 'none'") || strings.Contains(csp, "unsafe-inline") {
+			t.Fatalf("%q: Content-Security-Policy for nonce %s is %q", id, nonce, csp)
+		}
+		if nonces[nonce] {
+			t.Fatalf("%q: nonce %s was used before", id, nonce)
+		}
+		nonces[nonce] = true
+
+		m := selectedAttr.FindAllStringSubmatch(body, -1)
+		if len(m) != 1 || m[0][1] != id {
+			t.Fatalf("%q: page has selected game ID attributes %q", id, m)
+		}
+	}
+
+	// Hostile IDs aren't valid game IDs, so they never reach the page.
+	for _, id := range []string{
+		`"><img src=x onerror=alert(1)>`,
+		`x" data-passcode="owned`,
+		`';alert(1);x='`,
+		`{{.Nonce}}`,
+		"game <!--",
+		"game\u2028id",
+	} {
+		code, body := getBody(t, ts.URL+"/"+url.PathEscape(id))
+		if code != 404 || strings.Contains(body, id) || strings.Contains(body, html.EscapeString(id)) {
+			t.Fatalf("GET %q returned %d:\n%s", id, code, body)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for header, want := range map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "same-origin",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("/stats %s is %q, want %q", header, got, want)
+		}
+	}
+}
@@ -75,12 +75,31 @@ type Game struct {
 	Score        int       `json:"score"`
 	DiscardCount int       `json:"discard_count"`
 	Won          bool      `json:"won"` // TODO: Update name to "gameOver"
+
+	// Sessions maps the ID of each player who has joined the game to
+	// the nonce in their session token. It isn't sent to players.
+	Sessions map[string]string `json:"sessions,omitempty"`
+	// Host is the player who moderates the game: the first to join,
+	// unless they've handed it over. Only they can start the next
+	// game, change its passcode, lock its settings or kick players.
+	Host string `json:"host,omitempty"`
+	// HostNonce is in the host token, which makes whoever presents it
+	// the host. It isn't sent to players.
+	HostNonce string `json:"host_nonce,omitempty"`
+	// Locked keeps the next games' settings and word set the same as
+	// this one's.
+	Locked bool `json:"locked,omitempty"`
+	// PasscodeHash, if set, makes the game private: players need the
+	// passcode to join. See hashPasscode.
+	PasscodeHash string `json:"passcode_hash,omitempty"`
+
 	GameOptions
 	GameClientInfo
 }
 
 type GameClientInfo struct {
 	PlayerIDs []string `json:"player_ids"`
+	Private   bool     `json:"private,omitempty"`
 }
 
 type GameOptions struct {
@@ -88,6 +107,10 @@ type GameOptions struct {
 	EnforceTimer    bool  `json:"enforce_timer,omitempty"`
 	HandSize        int   `json:"hand_size,omitempty"`
 	BoardSize       int   `json:"board_size,omitempty"`
+
+	// WebhookURL receives this game's webhook payloads in addition
+	// to the server's. It isn't sent to players.
+	WebhookURL string `json:"webhook_url,omitempty"`
 }
 
 func (g *Game) ClientCopy(playerID string, playerIds []string) Game {
@@ -127,9 +150,33 @@ func (g *Game) ClientCopy(playerID string, playerIds []string) Game {
 	newGame.EnforceTimer = g.EnforceTimer
 	newGame.HandSize = g.HandSize
 	newGame.BoardSize = g.BoardSize
+
+	newGame.Host = g.Host
+	newGame.Locked = g.Locked
+	newGame.Private = g.PasscodeHash != ""
 	return newGame
 }
 
+// clone returns a deep copy of the game's mutable state. The word
+// set is shared, since it's never modified in place.
+func (g *Game) clone() *Game {
+	c := *g
+	c.Revealed = append([]bool(nil), g.Revealed...)
+	c.PlayerCards = make(map[int]string, len(g.PlayerCards))
+	for k, v := range g.PlayerCards {
+		c.PlayerCards[k] = v
+	}
+	c.Discards = make(map[int]string, len(g.Discards))
+	for k, v := range g.Discards {
+		c.Discards[k] = v
+	}
+	c.Words = append([]string(nil), g.Words...)
+	c.Deck = append([]int(nil), g.Deck...)
+	c.PlayerIDs = append([]string(nil), g.PlayerIDs...)
+	c.Sessions = copySessions(g.Sessions)
+	return &c
+}
+
 func (g *Game) StateID() string {
 	return fmt.Sprintf("%019d", g.UpdatedAt.UnixNano())
 }
@@ -204,6 +251,26 @@ func (g *Game) Draw(playerID string) error {
 	return nil
 }
 
+// ReturnCards puts the cards in playerID's hand back on top of the
+// deck, to be drawn by the other players.
+func (g *Game) ReturnCards(playerID string) {
+	for card, owner := range g.PlayerCards {
+		if owner != playerID {
+			continue
+		}
+		for i := 0; i < g.DeckIndex; i++ {
+			if g.Deck[i] == card {
+				g.DeckIndex--
+				g.Deck[i], g.Deck[g.DeckIndex] = g.Deck[g.DeckIndex], g.Deck[i]
+				break
+			}
+		}
+		delete(g.PlayerCards, card)
+		g.UpdatedAt = time.Now()
+	}
+	g.checkWinningCondition()
+}
+
 func (g *Game) Guess(idx int, playerID string) error {
 	if idx >= len(g.Revealed) || idx < 0 {
 		return fmt.Errorf("index %d is invalid", idx)
@@ -228,6 +295,49 @@ func (g *Game) Guess(idx int, playerID string) error {
 	return nil
 }
 
+// validate checks that a game read from outside the server is
+// internally consistent, so it can't cause a panic once it's played.
+func (g *Game) validate() error {
+	if g.ID == "" {
+		return errors.New("missing game ID")
+	}
+	if g.BoardSize < 0 || g.HandSize < 0 {
+		return fmt.Errorf("invalid board size %d or hand size %d", g.BoardSize, g.HandSize)
+	}
+	totalSpaces := getTotalSpaces(g.BoardSize)
+	if len(g.Revealed) != totalSpaces {
+		return fmt.Errorf("%d revealed flags for %d spaces", len(g.Revealed), totalSpaces)
+	}
+	if len(g.Deck) != totalSpaces {
+		return fmt.Errorf("%d cards in the deck for %d spaces", len(g.Deck), totalSpaces)
+	}
+	for _, c := range g.Deck {
+		if c < 0 || c >= totalSpaces {
+			return fmt.Errorf("card %d is off the board", c)
+		}
+	}
+	if g.DeckIndex < 0 || g.DeckIndex > len(g.Deck) {
+		return fmt.Errorf("deck index %d is out of range", g.DeckIndex)
+	}
+	for _, cards := range []map[int]string{g.PlayerCards, g.Discards} {
+		for idx := range cards {
+			if idx < 0 || idx >= totalSpaces {
+				return fmt.Errorf("card %d is off the board", idx)
+			}
+		}
+	}
+	if g.PlayerCards == nil || g.Discards == nil {
+		return errors.New("missing player cards or discards")
+	}
+	if g.PermIndex < 0 || g.PermIndex+getWordsPerGame(g.BoardSize) > len(g.WordSet) {
+		return fmt.Errorf("word set of %d words is too small", len(g.WordSet))
+	}
+	if g.CreatedAt.IsZero() || g.UpdatedAt.IsZero() {
+		return errors.New("missing timestamps")
+	}
+	return nil
+}
+
 func newGame(id string, state GameState, opts GameOptions) *Game {
 	// consistent randomness across games with the same seed
 	seedRnd := rand.New(rand.NewSource(state.Seed))
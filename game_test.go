@@ -29,12 +29,68 @@ func BenchmarkGameMarshal(b *testing.B) {
 		WordSet:  d.Words(),
 	}, GameOptions{})
 	b.StartTimer()
+	var out []byte
 	for i := 0; i < b.N; i++ {
-		_, err = json.Marshal(g)
+		out, err = json.Marshal(g)
 		if err != nil {
 			b.Fatal(err)
 		}
 	}
+	b.ReportMetric(float64(len(out)), "record-bytes")
+}
+
+func BenchmarkGameMarshalBinary(b *testing.B) {
+	b.StopTimer()
+	d, err := dictionary.Load("assets/original.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	g := newGame("foo", GameState{
+		Seed:     1,
+		Revealed: make([]bool, 25),
+		WordSet:  d.Words(),
+	}, GameOptions{})
+	b.StartTimer()
+	var out []byte
+	for i := 0; i < b.N; i++ {
+		out = marshalGameBinary(g)
+	}
+	b.ReportMetric(float64(len(out)), "record-bytes")
+}
+
+func BenchmarkGameUnmarshal(b *testing.B) {
+	d, err := dictionary.Load("assets/original.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	g := newGame("foo", GameState{
+		Seed:     1,
+		Revealed: make([]bool, 25),
+		WordSet:  d.Words(),
+	}, GameOptions{})
+	jsonRecord, err := json.Marshal(g)
+	if err != nil {
+		b.Fatal(err)
+	}
+	binaryRecord := marshalGameBinary(g)
+
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var decoded Game
+			if err := json.Unmarshal(jsonRecord, &decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(len(jsonRecord)), "record-bytes")
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := unmarshalGameBinary(binaryRecord); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(len(binaryRecord)), "record-bytes")
+	})
 }
 
 func TestGameShuffle(t *testing.T) {
@@ -55,3 +111,40 @@ func TestGameShuffle(t *testing.T) {
 		currState = nextGameState(currState, DefaultBoardSize)
 	}
 }
+
+func TestReturnCards(t *testing.T) {
+	g := newGame("foo", randomState(testWords, DefaultBoardSize), GameOptions{HandSize: 2, BoardSize: DefaultBoardSize})
+	g.Draw("alice")
+	g.Draw("bob")
+	for card, owner := range g.PlayerCards {
+		if owner == "bob" {
+			if err := g.Guess(card, "bob"); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	returned := map[int]bool{}
+	for card, owner := range g.PlayerCards {
+		if owner == "alice" {
+			returned[card] = true
+		}
+	}
+
+	g.ReturnCards("alice")
+	if g.DeckIndex != 3 {
+		t.Errorf("deck index is %d after returning 2 of 5 drawn cards, want 3", g.DeckIndex)
+	}
+	if err := g.validate(); err != nil {
+		t.Fatal(err)
+	}
+	g.Draw("carol")
+	for card := range returned {
+		if g.PlayerCards[card] != "carol" {
+			t.Errorf("returned card %d is held by %q, want carol", card, g.PlayerCards[card])
+		}
+	}
+	if g.Score != 1 || g.Won {
+		t.Errorf("score is %d, won %t; want 1, false", g.Score, g.Won)
+	}
+}
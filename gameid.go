@@ -0,0 +1,157 @@
+package crossclues
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// GameID is a validated game ID in canonical form: lowercase ASCII
+// letters and digits, with dashes or underscores between them. IDs
+// are part of game URLs, so they're case-insensitive; ParseGameID
+// lowercases them.
+type GameID string
+
+// DefaultGameIDEntropy is the randomness of suggested game IDs, in
+// bits, when Server.GameIDEntropy is unset: two words from the
+// embedded list.
+const DefaultGameIDEntropy = 24
+
+// Bounds on the length of a game ID.
+const (
+	MinGameIDLength = 3
+	MaxGameIDLength = 64
+)
+
+// reservedGameIDs are the paths the server serves, which a game's URL
+// would clash with, and a few more kept for later use.
+var reservedGameIDs = map[string]bool{
+	"admin":         true,
+	"api":           true,
+	"checkpoint":    true,
+	"debug":         true,
+	"discard":       true,
+	"game-state":    true,
+	"guess":         true,
+	"join":          true,
+	"kick":          true,
+	"lock":          true,
+	"metrics":       true,
+	"new":           true,
+	"next-game":     true,
+	"passcode":      true,
+	"replication":   true,
+	"static":        true,
+	"stats":         true,
+	"transfer-host": true,
+	"webhooks":      true,
+	"websocket":     true,
+}
+
+// ParseGameID validates id and returns it in canonical form.
+func ParseGameID(id string) (GameID, error) {
+	if id == "" {
+		return "", errors.New("a game ID is required")
+	}
+	if len(id) < MinGameIDLength || len(id) > MaxGameIDLength {
+		return "", fmt.Errorf("game IDs are %d to %d characters long", MinGameIDLength, MaxGameIDLength)
+	}
+	id = strings.ToLower(id)
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '-' || c == '_':
+			if i == 0 || i == len(id)-1 {
+				return "", errors.New("game IDs start and end with a letter or digit")
+			}
+		default:
+			return "", errors.New("game IDs only have letters, digits, dashes and underscores")
+		}
+	}
+	if reservedGameIDs[id] {
+		return "", fmt.Errorf("%q is reserved and can't be a game ID", id)
+	}
+	return GameID(id), nil
+}
+
+// legacyGameID converts an ID from before IDs were validated to a
+// valid one, replacing anything but ASCII letters and digits with
+// dashes. It reports false for IDs that can't be converted, like ones
+// too short or reserved.
+func legacyGameID(id string) (GameID, bool) {
+	if parsed, err := ParseGameID(id); err == nil {
+		return parsed, true
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(id) {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	parsed, err := ParseGameID(strings.TrimSuffix(b.String(), "-"))
+	return parsed, err == nil
+}
+
+func (id GameID) String() string {
+	return string(id)
+}
+
+// UnmarshalJSON parses the ID with ParseGameID, so decodeJSON rejects
+// requests with invalid IDs.
+func (id *GameID) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseGameID(s)
+	if err != nil {
+		return fmt.Errorf("game_id: %w", err)
+	}
+	*id = parsed
+	return nil
+}
+
+// gameIDWordsFor returns the words in list that suggested game IDs can
+// be made of, and how many of them give an ID entropy bits of
+// randomness.
+func gameIDWordsFor(list []string, entropy float64) ([]string, int, error) {
+	var words []string
+	var length int
+	for _, w := range list {
+		w = strings.ToLower(strings.TrimSpace(w))
+		if len(w) < 3 || strings.Trim(w, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+			continue
+		}
+		words = append(words, w)
+		length += len(w)
+	}
+	if len(words) < 2 {
+		return nil, 0, fmt.Errorf("the game ID word list has %d usable words; it needs at least 2", len(words))
+	}
+	count := int(math.Ceil(entropy / math.Log2(float64(len(words)))))
+	if count < 1 {
+		count = 1
+	}
+	// Most IDs should fit, or suggesting one could take a long time.
+	if avg := float64(length) / float64(len(words)); float64(count)*(avg+1)-1 > MaxGameIDLength {
+		return nil, 0, fmt.Errorf("%d words from the game ID word list are too long for a game ID; use shorter words or less entropy", count)
+	}
+	return words, count, nil
+}
+
+// randomIndex returns a uniformly random index into a slice of length
+// n, for IDs that mustn't be predictable.
+func randomIndex(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(i.Int64())
+}
@@ -0,0 +1,186 @@
+package crossclues
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseGameID(t *testing.T) {
+	for _, tc := range []struct {
+		id, want string
+	}{
+		{"blue-fish", "blue-fish"},
+		{"Blue-Fish", "blue-fish"},
+		{"GAME_42", "game_42"},
+		{"abc", "abc"},
+		{strings.Repeat("a", MaxGameIDLength), strings.Repeat("a", MaxGameIDLength)},
+	} {
+		got, err := ParseGameID(tc.id)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("ParseGameID(%q) = %q, %v; want %q", tc.id, got, err, tc.want)
+		}
+	}
+
+	for _, id := range []string{
+		"",
+		"ab",
+		strings.Repeat("a", MaxGameIDLength+1),
+		"-fish",
+		"fish_",
+		"blue fish",
+		"blue/fish",
+		"café",
+		`"><script>`,
+		"stats",
+		"Static",
+		"next-game",
+	} {
+		if got, err := ParseGameID(id); err == nil {
+			t.Errorf("ParseGameID(%q) = %q, want an error", id, got)
+		}
+	}
+}
+
+func TestGameIDWordsFor(t *testing.T) {
+	list := []string{"Apple", "big bang", "st.patrick", "ox", "banana", "cherry", "damson"}
+	words, count, err := gameIDWordsFor(list, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(words, ",") != "apple,banana,cherry,damson" || count != 2 {
+		t.Fatalf("got words %q and count %d, want the 4 single words and 2 of them", words, count)
+	}
+	if _, _, err := gameIDWordsFor(list, 64); err == nil {
+		t.Fatal("32 words fit in a game ID")
+	}
+	if _, _, err := gameIDWordsFor([]string{"apple", "ox"}, 4); err == nil {
+		t.Fatal("a list of one usable word was accepted")
+	}
+}
+
+func TestGameIDEntryPoints(t *testing.T) {
+	dir := tempDir(t, "words")
+	wordsFile := filepath.Join(dir, "words.txt")
+	if err := ioutil.WriteFile(wordsFile, []byte("red\ngreen\nblue\ngold\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Store: newMemStore(), GameIDWords: wordsFile, GameIDEntropy: 5}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// Suggested IDs use the configured words, enough of them for the
+	// entropy target.
+	if s.gameIDWordCount != 3 {
+		t.Fatalf("suggesting IDs of %d words, want 3", s.gameIDWordCount)
+	}
+	suggested, err := s.getAutogeneratedID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range strings.Split(string(suggested), "-") {
+		if w != "red" && w != "green" && w != "blue" && w != "gold" {
+			t.Fatalf("suggested ID has the word %q", w)
+		}
+	}
+
+	// Looking for an unused ID doesn't load games into memory.
+	if err := s.Store.Save(newGame("red-green-blue", randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := s.gameExists("red-green-blue"); !exists || err != nil {
+		t.Fatalf("gameExists = %v, %v; want true", exists, err)
+	}
+	if s.games.len() != 0 {
+		t.Fatalf("gameExists cached the game")
+	}
+
+	// IDs are case-insensitive: joining Mixed-Case joins mixed-case.
+	alice := join(t, ts.URL, "Mixed-Case", "alice")
+	if s.getGame("mixed-case") == nil {
+		t.Fatal("joining Mixed-Case didn't create mixed-case")
+	}
+	var g Game
+	code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "MIXED-case", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, &g)
+	if code != 200 || g.ID != "mixed-case" {
+		t.Fatalf("/next-game returned %d, game %q", code, g.ID)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"game_id": "static", "player_id": "alice"},
+		{"game_id": "no spaces", "player_id": "alice"},
+		{"game_id": "", "player_id": "alice"},
+		{"player_id": "alice"},
+	} {
+		if code := postJSON(t, ts.URL+"/join", body, nil); code != 400 {
+			t.Errorf("/join with %v returned %d, want 400", body, code)
+		}
+	}
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{"player_id": "alice"}, nil); code != 400 {
+		t.Errorf("/next-game without a game ID returned %d, want 400", code)
+	}
+
+	// The page redirects to the canonical URL, keeping invite links.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(ts.URL + "/Mixed-Case?passcode=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/mixed-case?passcode=x" {
+		t.Fatalf("GET /Mixed-Case returned %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/websocket/"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"no%20spaces/alice?session="+alice, nil); err == nil || resp.StatusCode != 400 {
+		t.Fatalf("websocket for an invalid ID: %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"Mixed-Case/alice?session="+alice, nil)
+	if err != nil {
+		t.Fatalf("websocket for Mixed-Case: %v", err)
+	}
+	conn.Close()
+}
+
+func TestAutogeneratedIDsRunOut(t *testing.T) {
+	dir := tempDir(t, "words")
+	wordsFile := filepath.Join(dir, "words.txt")
+	if err := ioutil.WriteFile(wordsFile, []byte("red\nblue\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Store: newMemStore(), GameIDWords: wordsFile, GameIDEntropy: 1}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	// Use up every ID of one word, and of the two and three words
+	// suggestions fall back to.
+	ids := []string{"red", "blue"}
+	for i := 0; len(ids) < 2+4+8; i++ {
+		ids = append(ids, ids[i]+"-red", ids[i]+"-blue")
+	}
+	for _, id := range ids {
+		if err := s.Store.Save(newGame(id, randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id, err := s.getAutogeneratedID(); err == nil {
+		t.Fatalf("suggested %q with every ID in use", id)
+	}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	code, body := getBody(t, ts.URL+"/")
+	if code != 200 || !strings.Contains(body, `data-autogenerated-game-id=""`) {
+		t.Fatalf("GET / returned %d:\n%s", code, body)
+	}
+}
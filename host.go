@@ -0,0 +1,144 @@
+package crossclues
+
+import (
+	"net/http"
+)
+
+// hostLocked returns the game's host and the nonce in their host
+// token. Players can join a placeholder before the game is created,
+// so its host is kept on the handle until it is. gh.mu must be held.
+func (gh *GameHandle) hostLocked() (string, string) {
+	if gh.g == nil {
+		return gh.pendingHost, gh.pendingHostNonce
+	}
+	return gh.g.Host, gh.g.HostNonce
+}
+
+// setHostLocked makes playerID the host. An empty nonce issues a new
+// host token, so the previous one stops working. gh.mu must be held.
+func (gh *GameHandle) setHostLocked(playerID, nonce string) {
+	if nonce == "" {
+		nonce = randomHex(8)
+	}
+	if gh.g == nil {
+		gh.pendingHost, gh.pendingHostNonce = playerID, nonce
+		return
+	}
+	gh.g.Host, gh.g.HostNonce = playerID, nonce
+}
+
+// hostRequest is the body of the host's moderation requests.
+type hostRequest struct {
+	GameID   GameID `json:"game_id"`
+	PlayerID string `json:"player_id"`
+	// TargetPlayerID is the player to kick or make host.
+	TargetPlayerID string `json:"target_player_id"`
+	// Locked is the new setting for /lock.
+	Locked bool `json:"locked"`
+	// Passcode is the new passcode for /passcode.
+	Passcode string `json:"passcode"`
+}
+
+// handleHostRequest decodes a hostRequest from its host and applies
+// fn to the game. fn returns an error status and message, or 0 if it
+// changed the game.
+func (s *Server) handleHostRequest(rw http.ResponseWriter, req *http.Request, action string, fn func(gh *GameHandle, g *Game, r hostRequest) (int, string)) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+
+	var request hostRequest
+	if !decodeJSON(rw, req, &request) {
+		return
+	}
+
+	gh := s.getGame(request.GameID)
+	if gh == nil {
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	defer s.releaseGame(gh)
+	if !s.authorize(rw, req, gh, request.PlayerID) {
+		return
+	}
+
+	var errCode int
+	var errMsg string
+	gh.update(req.Context(), func(g *Game) bool {
+		if host, _ := gh.hostLocked(); host != request.PlayerID {
+			errCode, errMsg = http.StatusForbidden, "Only the host can do that"
+			return false
+		}
+		errCode, errMsg = fn(gh, g, request)
+		return errCode == 0
+	})
+	if errCode != 0 {
+		writeError(rw, errCode, errMsg)
+		return
+	}
+	loggerFrom(req.Context()).Info(action, "game_id", request.GameID, "player_id", request.PlayerID, "target_player_id", request.TargetPlayerID)
+	gh.mu.Lock()
+	started := gh.g != nil
+	gh.mu.Unlock()
+	if !started {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeGameForPlayer(rw, gh, request.PlayerID)
+}
+
+// POST /kick
+//
+// handleKick ends a player's session and disconnects them. Their
+// cards go back on the deck for the other players to draw. Unless the
+// game is private, they can join again.
+func (s *Server) handleKick(rw http.ResponseWriter, req *http.Request) {
+	s.handleHostRequest(rw, req, "kicked player", func(gh *GameHandle, g *Game, r hostRequest) (int, string) {
+		if r.TargetPlayerID == r.PlayerID {
+			return 400, "The host can't kick themselves; make someone else host first"
+		}
+		if _, ok := gh.sessionNonceLocked(r.TargetPlayerID); !ok {
+			return 404, "Player not found"
+		}
+		gh.deleteSessionLocked(r.TargetPlayerID)
+		if c, ok := gh.websockets[r.TargetPlayerID]; ok {
+			closeWebsocket(c, "Removed from the game by the host")
+			delete(gh.websockets, r.TargetPlayerID)
+		}
+		if g != nil {
+			won := g.Won
+			g.ReturnCards(r.TargetPlayerID)
+			s.metrics.checkFinished(g, won)
+		}
+		return 0, ""
+	})
+}
+
+// POST /transfer-host
+//
+// handleTransferHost makes another player who has joined the host.
+// The old host token stops working.
+func (s *Server) handleTransferHost(rw http.ResponseWriter, req *http.Request) {
+	s.handleHostRequest(rw, req, "transferred host", func(gh *GameHandle, g *Game, r hostRequest) (int, string) {
+		if _, ok := gh.sessionNonceLocked(r.TargetPlayerID); !ok {
+			return 404, "Player not found"
+		}
+		gh.setHostLocked(r.TargetPlayerID, "")
+		return 0, ""
+	})
+}
+
+// POST /lock
+//
+// handleLock locks or unlocks the game's settings. While they're
+// locked, next games keep this game's settings and word set.
+func (s *Server) handleLock(rw http.ResponseWriter, req *http.Request) {
+	s.handleHostRequest(rw, req, "locked settings", func(gh *GameHandle, g *Game, r hostRequest) (int, string) {
+		if g == nil {
+			return moveErrorCode(errGameNotStarted), errGameNotStarted.Error()
+		}
+		g.Locked = r.Locked
+		return 0, ""
+	})
+}
@@ -0,0 +1,182 @@
+package crossclues
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHostModeration(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	var alice, bob joinResponse
+	for _, j := range []struct {
+		player string
+		resp   *joinResponse
+	}{{"alice", &alice}, {"bob", &bob}} {
+		if code := postJSON(t, ts.URL+"/join", map[string]interface{}{"game_id": "hosted", "player_id": j.player}, j.resp); code != 200 {
+			t.Fatalf("/join as %s returned %d", j.player, code)
+		}
+	}
+	if alice.HostToken == "" || bob.HostToken != "" {
+		t.Fatalf("host tokens: alice %q, bob %q; want only alice's", alice.HostToken, bob.HostToken)
+	}
+	carol := join(t, ts.URL, "hosted", "carol")
+	early := map[string]interface{}{"game_id": "hosted", "player_id": "alice", "locked": true}
+	if code := postJSONAs(t, ts.URL+"/lock", alice.SessionToken, early, nil); code != http.StatusConflict {
+		t.Errorf("/lock before the game started returned %d, want 409", code)
+	}
+
+	start := map[string]interface{}{"game_id": "hosted", "player_id": "bob", "hand_size": 2, "board_size": DefaultBoardSize}
+	if code := postJSONAs(t, ts.URL+"/next-game", bob.SessionToken, start, nil); code != http.StatusForbidden {
+		t.Errorf("/next-game by a player returned %d, want 403", code)
+	}
+	start["player_id"] = "alice"
+	var g Game
+	if code := postJSONAs(t, ts.URL+"/next-game", alice.SessionToken, start, &g); code != 200 {
+		t.Fatalf("/next-game by the host returned %d", code)
+	}
+	if g.Host != "alice" {
+		t.Errorf("host is %q, want alice", g.Host)
+	}
+
+	// Locked settings carry over to the next game.
+	lock := map[string]interface{}{"game_id": "hosted", "player_id": "bob", "locked": true}
+	if code := postJSONAs(t, ts.URL+"/lock", bob.SessionToken, lock, nil); code != http.StatusForbidden {
+		t.Errorf("/lock by a player returned %d, want 403", code)
+	}
+	lock["player_id"] = "alice"
+	if code := postJSONAs(t, ts.URL+"/lock", alice.SessionToken, lock, &g); code != 200 || !g.Locked {
+		t.Fatalf("/lock by the host returned %d, locked %t", code, g.Locked)
+	}
+	next := map[string]interface{}{"game_id": "hosted", "player_id": "alice", "hand_size": 3, "board_size": 5}
+	if code := postJSONAs(t, ts.URL+"/next-game", alice.SessionToken, next, &g); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	if g.HandSize != 2 || g.BoardSize != DefaultBoardSize || !g.Locked {
+		t.Errorf("locked game's next game has hand size %d, board size %d, locked %t", g.HandSize, g.BoardSize, g.Locked)
+	}
+
+	// Kicking bob returns his cards and disconnects him.
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/websocket/hosted/bob?session=" + bob.SessionToken
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	asBob := map[string]interface{}{"game_id": "hosted", "player_id": "bob"}
+	if code := postJSONAs(t, ts.URL+"/game-state", bob.SessionToken, asBob, &g); code != 200 || len(g.PlayerCards) != 2 {
+		t.Fatalf("/game-state as bob returned %d with %d cards", code, len(g.PlayerCards))
+	}
+	kick := map[string]interface{}{"game_id": "hosted", "player_id": "carol", "target_player_id": "bob"}
+	if code := postJSONAs(t, ts.URL+"/kick", carol, kick, nil); code != http.StatusForbidden {
+		t.Errorf("/kick by a player returned %d, want 403", code)
+	}
+	kick["player_id"] = "alice"
+	if code := postJSONAs(t, ts.URL+"/kick", alice.SessionToken, kick, nil); code != 200 {
+		t.Fatalf("/kick by the host returned %d", code)
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("kicked websocket closed with %v", err)
+			}
+			break
+		}
+	}
+	if code := postJSONAs(t, ts.URL+"/game-state", bob.SessionToken, asBob, nil); code != http.StatusUnauthorized {
+		t.Errorf("/game-state as a kicked player returned %d, want 401", code)
+	}
+	gh := s.getGame("hosted")
+	gh.mu.Lock()
+	if gh.g.DeckIndex != 0 {
+		t.Errorf("deck index is %d after bob's cards were returned, want 0", gh.g.DeckIndex)
+	}
+	gh.mu.Unlock()
+
+	// Handing over the host invalidates the old host token.
+	transfer := map[string]interface{}{"game_id": "hosted", "player_id": "alice", "target_player_id": "carol"}
+	if code := postJSONAs(t, ts.URL+"/transfer-host", alice.SessionToken, transfer, &g); code != 200 || g.Host != "carol" {
+		t.Fatalf("/transfer-host returned %d, host %q", code, g.Host)
+	}
+	if code := postJSONAs(t, ts.URL+"/lock", alice.SessionToken, lock, nil); code != http.StatusForbidden {
+		t.Errorf("/lock by the old host returned %d, want 403", code)
+	}
+	var dave joinResponse
+	body := map[string]interface{}{"game_id": "hosted", "player_id": "dave", "host_token": alice.HostToken}
+	if code := postJSON(t, ts.URL+"/join", body, &dave); code != 200 || dave.HostToken != "" {
+		t.Errorf("/join with a stale host token returned %d, host token %q", code, dave.HostToken)
+	}
+
+	// The current host token makes its holder the host.
+	var carolJoin joinResponse
+	if code := postJSONAs(t, ts.URL+"/join", carol, map[string]interface{}{"game_id": "hosted", "player_id": "carol"}, &carolJoin); code != 200 || carolJoin.HostToken == "" {
+		t.Fatalf("/join as the new host returned %d without a host token", code)
+	}
+	body = map[string]interface{}{"game_id": "hosted", "player_id": "erin", "host_token": carolJoin.HostToken}
+	var erin joinResponse
+	if code := postJSON(t, ts.URL+"/join", body, &erin); code != 200 || erin.HostToken != carolJoin.HostToken {
+		t.Errorf("/join with the host token returned %d, host token %q", code, erin.HostToken)
+	}
+	gh.mu.Lock()
+	if host, _ := gh.hostLocked(); host != "erin" {
+		t.Errorf("host is %q after joining with the host token, want erin", host)
+	}
+	gh.mu.Unlock()
+}
+
+// Run with -race: starting the next game reads the old game's
+// settings while requests holding it, like /lock, may change them.
+func TestNextGameWhileLocking(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "racing", "alice")
+	start := map[string]interface{}{"game_id": "racing", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize}
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, start, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	for i := 0; i < 10; i++ {
+		gh := s.getGame("racing")
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				hash := hashPasscode(randomHex(4))
+				gh.update(context.Background(), func(g *Game) bool {
+					g.Locked = !g.Locked
+					g.PasscodeHash = hash
+					return true
+				})
+			}
+		}()
+		if code := postJSONAs(t, ts.URL+"/next-game", alice, start, nil); code != 200 {
+			t.Errorf("/next-game returned %d", code)
+		}
+		close(stop)
+		wg.Wait()
+		s.releaseGame(gh)
+	}
+}
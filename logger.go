@@ -0,0 +1,209 @@
+package crossclues
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "info", ignoring case.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger writes leveled entries with key/value fields, as text or as
+// one JSON object per line. Loggers derived with With share their
+// parent's output. A nil *Logger discards everything, so components
+// can be used without one.
+type Logger struct {
+	out    *logOutput
+	fields []interface{} // alternating keys and values
+}
+
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+// NewLogger returns a logger that writes entries at level or above
+// to w.
+func NewLogger(w io.Writer, level Level, json bool) *Logger {
+	return &Logger{out: &logOutput{w: w, level: level, json: json}}
+}
+
+// With returns a logger that adds the given key/value pairs to every
+// entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if l == nil || level < l.out.level {
+		return
+	}
+	fields := append(append([]interface{}(nil), l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	var buf bytes.Buffer
+	now := time.Now().UTC()
+	if l.out.json {
+		writeJSONEntry(&buf, now, level, msg, fields)
+	} else {
+		writeTextEntry(&buf, now, level, msg, fields)
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeTextEntry(buf *bytes.Buffer, t time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(t.Format("2006-01-02T15:04:05.000Z07:00"))
+	buf.WriteByte(' ')
+	buf.WriteString(level.String())
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+		v := fmt.Sprint(logValue(fields[i+1]))
+		if v == "" || strings.ContainsAny(v, " \"=\n\t") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+	buf.WriteByte('\n')
+}
+
+func writeJSONEntry(buf *bytes.Buffer, t time.Time, level Level, msg string, fields []interface{}) {
+	// Written by hand so fields keep their order.
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, t.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		writeJSONValue(buf, logValue(fields[i+1]))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// logValue converts values that don't marshal usefully.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying l.
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger carried by ctx, which is scoped to
+// the request, or nil.
+func loggerFrom(ctx context.Context) *Logger {
+	l, _ := ctx.Value(loggerKey{}).(*Logger)
+	return l
+}
+
+// requestIDHeader carries the request ID that's logged with every
+// entry about a request. It's kept when a request is forwarded to
+// another node.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds the request IDs accepted from clients.
+const maxRequestIDLen = 64
+
+// validRequestID reports whether id, from a client, can be used as a
+// request ID: it's logged and echoed back, so it's kept short and
+// plain.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.' || c == '_' || c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,129 @@
+package crossclues
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelInfo, false).With("game_id", "abc")
+	l.Debug("hidden")
+	l.Info("guess rejected", "player_id", "alice bob", "err", errors.New("not your card"))
+
+	line := buf.String()
+	if strings.Contains(line, "hidden") {
+		t.Errorf("debug entry written at info level: %q", line)
+	}
+	want := ` INFO guess rejected game_id=abc player_id="alice bob" err="not your card"` + "\n"
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got %q, want suffix %q", line, want)
+	}
+
+	var nilLogger *Logger
+	nilLogger.With("k", "v").Error("discarded")
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelDebug, true)
+	l.With("request_id", "r1").Warn("slow", "n", 3, "odd")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%q: %s", buf.String(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"level": "WARN", "msg": "slow", "request_id": "r1", "n": float64(3), "odd": "(MISSING)",
+	} {
+		if entry[k] != want {
+			t.Errorf("%s = %v, want %v", k, entry[k], want)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that's safe to log to from handlers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestLogging(t *testing.T) {
+	var out syncBuffer
+	s := &Server{Store: newMemStore(), Log: NewLogger(&out, LevelDebug, true)}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "logged", "alice")
+	req, err := http.NewRequest("POST", ts.URL+"/next-game", strings.NewReader(`{"game_id":"logged","player_id":"alice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sessionHeader, alice)
+	req.Header.Set(requestIDHeader, "req-123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(requestIDHeader); got != "req-123" {
+		t.Errorf("response request ID = %q, want req-123", got)
+	}
+
+	for _, id := range []string{strings.Repeat("x", maxRequestIDLen+1), "req 123", "req\u2028123"} {
+		req, err := http.NewRequest("GET", ts.URL+"/stats", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(requestIDHeader, id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get(requestIDHeader); got == id || !validRequestID(got) {
+			t.Errorf("request ID %q was replaced with %q, want a generated one", id, got)
+		}
+	}
+
+	var found bool
+	sc := bufio.NewScanner(strings.NewReader(out.String()))
+	for sc.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("%q: %s", sc.Text(), err)
+		}
+		if entry["msg"] == "created game" {
+			found = true
+			if entry["request_id"] != "req-123" || entry["game_id"] != "logged" || entry["player_id"] != "alice" {
+				t.Errorf("created game entry = %v", entry)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no entry for the created game in:\n%s", out.String())
+	}
+}
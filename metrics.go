@@ -0,0 +1,266 @@
+package crossclues
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The metrics below are updated as things happen, so serving
+// /metrics only reads counters and never touches games.
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20}
+	scoreBuckets   = []float64{4, 8, 12, 16, 20, 25, 36}
+)
+
+// histogram is a Prometheus histogram with fixed bucket bounds.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.mu.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), cumulative)
+}
+
+// histogramVec is a histogram per value of a single label.
+type histogramVec struct {
+	label  string
+	bounds []float64
+
+	mu sync.Mutex
+	m  map[string]*histogram
+}
+
+func newHistogramVec(label string, bounds []float64) *histogramVec {
+	return &histogramVec{label: label, bounds: bounds, m: make(map[string]*histogram)}
+}
+
+func (v *histogramVec) with(value string) *histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.m[value]
+	if !ok {
+		h = newHistogram(v.bounds)
+		v.m[value] = h
+	}
+	return h
+}
+
+func (v *histogramVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.m))
+	for value := range v.m {
+		values = append(values, value)
+	}
+	v.mu.Unlock()
+	sort.Strings(values)
+	for _, value := range values {
+		v.with(value).write(w, name, fmt.Sprintf("%s=%q", v.label, value))
+	}
+}
+
+// counterVec is a counter per value of a single label.
+type counterVec struct {
+	label string
+
+	mu sync.Mutex
+	m  map[string]uint64
+}
+
+func newCounterVec(label string) *counterVec {
+	return &counterVec{label: label, m: make(map[string]uint64)}
+}
+
+func (v *counterVec) inc(value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.m[value]++
+}
+
+func (v *counterVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make([]string, 0, len(v.m))
+	for value := range v.m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, v.label, value, v.m[value])
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metrics holds the server's Prometheus metrics.
+type metrics struct {
+	requestDuration   *histogramVec // by handler
+	websockets        int64         // atomic access
+	storeSaveDuration *histogram
+	storeErrors       *counterVec // by operation
+	gamesCreated      uint64      // atomic access
+	gamesFinished     uint64      // atomic access
+	finalScore        *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requestDuration:   newHistogramVec("handler", latencyBuckets),
+		storeSaveDuration: newHistogram(latencyBuckets),
+		storeErrors:       newCounterVec("op"),
+		finalScore:        newHistogram(scoreBuckets),
+	}
+}
+
+// instrument records the latency of requests to h under the handler
+// label name.
+func (m *metrics) instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	hist := m.requestDuration.with(name)
+	return func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		defer func() { hist.observe(time.Since(start).Seconds()) }()
+		h(rw, req)
+	}
+}
+
+// checkFinished records g as finished if it was just won; wasWon is
+// whether it had been won before the move.
+func (m *metrics) checkFinished(g *Game, wasWon bool) {
+	if wasWon || !g.Won {
+		return
+	}
+	atomic.AddUint64(&m.gamesFinished, 1)
+	m.finalScore.observe(float64(g.Score))
+}
+
+// metricsStore wraps a Store, timing saves and counting errors.
+type metricsStore struct {
+	Store
+	m *metrics
+}
+
+func (ms metricsStore) Load(id string) (*Game, error) {
+	g, err := ms.Store.Load(id)
+	if err != nil {
+		ms.m.storeErrors.inc("load")
+	}
+	return g, err
+}
+
+func (ms metricsStore) Save(g *Game) error {
+	start := time.Now()
+	err := ms.Store.Save(g)
+	ms.m.storeSaveDuration.observe(time.Since(start).Seconds())
+	if err != nil {
+		ms.m.storeErrors.inc("save")
+	}
+	return err
+}
+
+func (ms metricsStore) Delete(g *Game) error {
+	err := ms.Store.Delete(g)
+	if err != nil {
+		ms.m.storeErrors.inc("delete")
+	}
+	return err
+}
+
+func (ms metricsStore) DeleteExpired(expiry time.Time) error {
+	err := ms.Store.DeleteExpired(expiry)
+	if err != nil {
+		ms.m.storeErrors.inc("delete_expired")
+	}
+	return err
+}
+
+// GET /metrics serves metrics in the Prometheus text format.
+func (s *Server) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := s.metrics
+
+	fmt.Fprintf(rw, "# HELP crossclues_http_request_duration_seconds Latency of HTTP requests by handler.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_http_request_duration_seconds histogram\n")
+	m.requestDuration.write(rw, "crossclues_http_request_duration_seconds")
+
+	fmt.Fprintf(rw, "# HELP crossclues_http_requests_in_flight Requests currently being served.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_http_requests_in_flight gauge\n")
+	fmt.Fprintf(rw, "crossclues_http_requests_in_flight %d\n", atomic.LoadInt64(&s.statOpenRequests))
+
+	fmt.Fprintf(rw, "# HELP crossclues_websockets_active Open websocket connections.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_websockets_active gauge\n")
+	fmt.Fprintf(rw, "crossclues_websockets_active %d\n", atomic.LoadInt64(&m.websockets))
+
+	fmt.Fprintf(rw, "# HELP crossclues_store_save_duration_seconds Latency of saving a game to the store.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_store_save_duration_seconds histogram\n")
+	m.storeSaveDuration.write(rw, "crossclues_store_save_duration_seconds", "")
+
+	fmt.Fprintf(rw, "# HELP crossclues_store_errors_total Failed store operations by operation.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_store_errors_total counter\n")
+	m.storeErrors.write(rw, "crossclues_store_errors_total")
+
+	fmt.Fprintf(rw, "# HELP crossclues_games_created_total Games created, including next games.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_games_created_total counter\n")
+	fmt.Fprintf(rw, "crossclues_games_created_total %d\n", atomic.LoadUint64(&m.gamesCreated))
+
+	fmt.Fprintf(rw, "# HELP crossclues_games_finished_total Games played to the end.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_games_finished_total counter\n")
+	fmt.Fprintf(rw, "crossclues_games_finished_total %d\n", atomic.LoadUint64(&m.gamesFinished))
+
+	fmt.Fprintf(rw, "# HELP crossclues_game_final_score Score of finished games; _sum / _count is the average.\n")
+	fmt.Fprintf(rw, "# TYPE crossclues_game_final_score histogram\n")
+	m.finalScore.write(rw, "crossclues_game_final_score", "")
+}
@@ -0,0 +1,76 @@
+package crossclues
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.observe(v)
+	}
+	var buf bytes.Buffer
+	h.write(&buf, "score", `kind="test"`)
+	want := `score_bucket{kind="test",le="1"} 2
+score_bucket{kind="test",le="5"} 3
+score_bucket{kind="test",le="+Inf"} 4
+score_sum{kind="test"} 14.5
+score_count{kind="test"} 4
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "measured", "alice")
+	code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "measured", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, nil)
+	if code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	gh := s.getGame("measured")
+	gh.update(context.Background(), func(g *Game) bool {
+		g.Score = 12
+		g.Won = true
+		s.metrics.checkFinished(g, false)
+		return true
+	})
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`crossclues_http_request_duration_seconds_count{handler="next_game"} 1`,
+		// the placeholder created by joining, the new game and the update
+		`crossclues_store_save_duration_seconds_count 3`,
+		`crossclues_games_created_total 1`,
+		`crossclues_games_finished_total 1`,
+		`crossclues_game_final_score_sum 12`,
+		`crossclues_websockets_active 0`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("/metrics is missing %q:\n%s", want, body)
+		}
+	}
+}
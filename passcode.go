@@ -0,0 +1,73 @@
+package crossclues
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxPasscodeLen bounds passcodes, which are hashed on every join.
+const maxPasscodeLen = 128
+
+// hashPasscode returns a salted hash of code, of the form
+// salt$sha256(salt+code) in hex.
+func hashPasscode(code string) string {
+	salt := randomHex(16)
+	return salt + "$" + passcodeDigest(salt, code)
+}
+
+func passcodeDigest(salt, code string) string {
+	sum := sha256.Sum256([]byte(salt + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPasscode reports whether code matches hash, which was
+// returned by hashPasscode.
+func checkPasscode(hash, code string) bool {
+	parts := strings.SplitN(hash, "$", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(passcodeDigest(parts[0], code)), []byte(parts[1])) == 1
+}
+
+func validatePasscode(code string) error {
+	if len(code) > maxPasscodeLen {
+		return fmt.Errorf("Passcode is longer than %d bytes", maxPasscodeLen)
+	}
+	return nil
+}
+
+// passcodeHashLocked returns the hash of the passcode needed to join
+// the game, or "" if it's public. gh.mu must be held.
+func (gh *GameHandle) passcodeHashLocked() string {
+	if gh.g == nil {
+		return ""
+	}
+	return gh.g.PasscodeHash
+}
+
+// POST /passcode
+//
+// handlePasscode lets the game's host set a new passcode, so an old
+// invite stops letting new players join. Players who have already
+// joined keep their sessions. An empty passcode makes the game
+// public.
+func (s *Server) handlePasscode(rw http.ResponseWriter, req *http.Request) {
+	s.handleHostRequest(rw, req, "changed passcode", func(gh *GameHandle, g *Game, r hostRequest) (int, string) {
+		if err := validatePasscode(r.Passcode); err != nil {
+			return 400, err.Error()
+		}
+		if g == nil {
+			return moveErrorCode(errGameNotStarted), errGameNotStarted.Error()
+		}
+		g.PasscodeHash = ""
+		if r.Passcode != "" {
+			g.PasscodeHash = hashPasscode(r.Passcode)
+		}
+		return 0, ""
+	})
+}
@@ -0,0 +1,113 @@
+package crossclues
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckPasscode(t *testing.T) {
+	h := hashPasscode("sesame")
+	if h == hashPasscode("sesame") {
+		t.Errorf("hashes of the same passcode should be salted differently")
+	}
+	if !checkPasscode(h, "sesame") {
+		t.Errorf("passcode doesn't match its own hash")
+	}
+	for _, wrong := range []string{"", "Sesame", "sesame "} {
+		if checkPasscode(h, wrong) {
+			t.Errorf("%q matches the hash of %q", wrong, "sesame")
+		}
+	}
+}
+
+func TestPrivateGames(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "secret", "alice")
+	early := map[string]interface{}{"game_id": "secret", "player_id": "alice", "passcode": "early"}
+	if code := postJSONAs(t, ts.URL+"/passcode", alice, early, nil); code != http.StatusConflict {
+		t.Errorf("/passcode before the game started returned %d, want 409", code)
+	}
+	var g Game
+	start := map[string]interface{}{"game_id": "secret", "player_id": "alice", "passcode": "sesame"}
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, start, &g); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	if !g.Private || g.Host != "alice" {
+		t.Errorf("game is private: %t, hosted by %q; want true, alice", g.Private, g.Host)
+	}
+
+	joinWith := func(playerID, passcode string) int {
+		return postJSON(t, ts.URL+"/join", map[string]interface{}{"game_id": "secret", "player_id": playerID, "passcode": passcode}, nil)
+	}
+	if code := joinWith("bob", ""); code != http.StatusForbidden {
+		t.Errorf("joining without the passcode returned %d, want 403", code)
+	}
+	if code := joinWith("bob", "wrong"); code != http.StatusForbidden {
+		t.Errorf("joining with the wrong passcode returned %d, want 403", code)
+	}
+	if code := postJSONAs(t, ts.URL+"/join", alice, map[string]interface{}{"game_id": "secret", "player_id": "alice"}, nil); code != 200 {
+		t.Errorf("resuming a session without the passcode returned %d", code)
+	}
+	var bob joinResponse
+	if code := postJSON(t, ts.URL+"/join", map[string]interface{}{"game_id": "secret", "player_id": "bob", "passcode": "sesame"}, &bob); code != 200 {
+		t.Fatalf("joining with the passcode returned %d", code)
+	}
+
+	page := func(query string) string {
+		resp, err := http.Get(ts.URL + "/secret" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if p := page(""); !strings.Contains(p, " data-passcode-required") {
+		t.Errorf("page for a private game doesn't ask for a passcode")
+	}
+	if p := page("?passcode=sesame"); strings.Contains(p, "data-passcode-required") || !strings.Contains(p, `data-passcode="sesame"`) {
+		t.Errorf("invite link page doesn't carry the passcode")
+	}
+
+	// Only the host can change the passcode.
+	rotate := map[string]interface{}{"game_id": "secret", "player_id": "bob", "passcode": "new"}
+	if code := postJSONAs(t, ts.URL+"/passcode", bob.SessionToken, rotate, nil); code != http.StatusForbidden {
+		t.Errorf("/passcode by a player returned %d, want 403", code)
+	}
+	rotate["player_id"] = "alice"
+	if code := postJSONAs(t, ts.URL+"/passcode", alice, rotate, nil); code != 200 {
+		t.Fatalf("/passcode by the host returned %d", code)
+	}
+	if code := joinWith("carol", "sesame"); code != http.StatusForbidden {
+		t.Errorf("joining with the old passcode returned %d, want 403", code)
+	}
+	if code := joinWith("carol", "new"); code != 200 {
+		t.Errorf("joining with the new passcode returned %d", code)
+	}
+	if code := postJSONAs(t, ts.URL+"/game-state", bob.SessionToken, map[string]interface{}{"game_id": "secret", "player_id": "bob"}, nil); code != 200 {
+		t.Errorf("bob's session ended when the passcode changed: %d", code)
+	}
+
+	// The next game keeps the passcode.
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{"game_id": "secret", "player_id": "alice", "passcode": "ignored"}, &g); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	if !g.Private || g.Host != "alice" {
+		t.Errorf("next game is private: %t, hosted by %q; want true, alice", g.Private, g.Host)
+	}
+	if code := joinWith("dave", "ignored"); code != http.StatusForbidden {
+		t.Errorf("next game's passcode was changed by /next-game")
+	}
+}
@@ -0,0 +1,276 @@
+package crossclues
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a token bucket: PerSecond tokens are added each second, up
+// to Burst. A zero PerSecond means unlimited.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateLimits configures the server's abuse protection. Zero values
+// disable the corresponding limit.
+type RateLimits struct {
+	// PerIP, PerGame and Global limit requests from one client
+	// address, for one game, and in total.
+	PerIP   Rate
+	PerGame Rate
+	Global  Rate
+
+	// GamesPerIP limits how often one address can create games by
+	// joining game IDs that aren't in use.
+	GamesPerIP Rate
+
+	// MaxWordSetBytes caps the memory held by the custom word sets
+	// of games in memory. Idle games are evicted to stay under it,
+	// and games with custom word sets can't be created while games
+	// in use hold more.
+	MaxWordSetBytes int64
+
+	// TrustedProxyHops is the number of proxies in front of the
+	// server that append to X-Forwarded-For. The client address is
+	// read from that many entries from the right; with zero, the
+	// header is ignored and the connection's address is used.
+	TrustedProxyHops int
+}
+
+// bucketIdleTimeout is how long a bucket goes unused before it's
+// dropped. It's refilled by then for any reasonable rate.
+const bucketIdleTimeout = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from b if there is one. Otherwise it returns
+// how long until there will be.
+func (b *tokenBucket) take(r Rate, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.PerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / r.PerSecond * float64(time.Second))
+	return false, wait
+}
+
+// limiter keeps a token bucket per key.
+type limiter struct {
+	rate Rate
+
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	lastPruned time.Time
+}
+
+func newLimiter(r Rate) *limiter {
+	return &limiter{rate: r, buckets: make(map[string]*tokenBucket), lastPruned: time.Now()}
+}
+
+// allow takes a token for key, reporting how long to wait if there
+// isn't one. A nil limiter allows everything.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPruned) > bucketIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPruned = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(l.rate, now)
+}
+
+// rateLimiter applies a Server's RateLimits.
+type rateLimiter struct {
+	limits  RateLimits
+	cluster bool
+	perIP   *limiter
+	perGame *limiter
+	global  *limiter
+	games   *limiter
+
+	// maxBodyBytes bounds how much of a request body is read to find
+	// the game it's for.
+	maxBodyBytes int64
+}
+
+func newRateLimiter(limits RateLimits, cluster bool, maxBodyBytes int64) *rateLimiter {
+	rl := &rateLimiter{limits: limits, cluster: cluster, maxBodyBytes: maxBodyBytes}
+	for _, l := range []struct {
+		r   Rate
+		dst **limiter
+	}{
+		{limits.PerIP, &rl.perIP},
+		{limits.PerGame, &rl.perGame},
+		{limits.Global, &rl.global},
+		{limits.GamesPerIP, &rl.games},
+	} {
+		if l.r.PerSecond > 0 {
+			r := l.r
+			if r.Burst < 1 {
+				r.Burst = 1
+			}
+			*l.dst = newLimiter(r)
+		}
+	}
+	return rl
+}
+
+// clientIP returns the address of the client that sent req.
+func (rl *rateLimiter) clientIP(req *http.Request) string {
+	if rl.forwarded(req) {
+		// The node that forwarded the request signed its client's
+		// address.
+		if client := req.Header.Get(forwardedClientHeader); client != "" {
+			return client
+		}
+	}
+	hops := rl.limits.TrustedProxyHops
+	if hops > 0 {
+		var addrs []string
+		for _, h := range req.Header["X-Forwarded-For"] {
+			for _, a := range strings.Split(h, ",") {
+				addrs = append(addrs, strings.TrimSpace(a))
+			}
+		}
+		if len(addrs) >= hops {
+			return addrs[len(addrs)-hops]
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// allowRequest applies the global and per-IP request limits to req,
+// writing a 429 and returning false if one is exceeded. Requests
+// another node forwarded were charged there.
+func (rl *rateLimiter) allowRequest(rw http.ResponseWriter, req *http.Request) bool {
+	if rl == nil || rl.forwarded(req) {
+		return true
+	}
+	now := time.Now()
+	if ok, wait := rl.global.allow("", now); !ok {
+		writeTooManyRequests(rw, wait, "Server is busy")
+		return false
+	}
+	if ok, wait := rl.perIP.allow(rl.clientIP(req), now); !ok {
+		writeTooManyRequests(rw, wait, "Too many requests")
+		return false
+	}
+	return true
+}
+
+// allowGameRequest applies the per-game request limit to req,
+// writing a 429 and returning false if it's exceeded. In a cluster
+// it's only applied by the game's owner, after routing.
+func (rl *rateLimiter) allowGameRequest(rw http.ResponseWriter, req *http.Request) bool {
+	if rl == nil || rl.perGame == nil {
+		return true
+	}
+	gameID, err := requestGameID(req, rl.maxBodyBytes)
+	if err != nil {
+		writeError(rw, 400, err.Error())
+		return false
+	}
+	if gameID == "" {
+		return true
+	}
+	if ok, wait := rl.perGame.allow(gameID, time.Now()); !ok {
+		writeTooManyRequests(rw, wait, "Too many requests for this game")
+		return false
+	}
+	return true
+}
+
+// forwarded reports whether req was forwarded by another node.
+// Unsigned forwards have had the header removed.
+func (rl *rateLimiter) forwarded(req *http.Request) bool {
+	return rl.cluster && req.Header.Get(forwardedHeader) != ""
+}
+
+// allowNewGame applies the games-per-IP limit for a request that
+// creates a game, writing a 429 and returning false if it's
+// exceeded.
+func (rl *rateLimiter) allowNewGame(rw http.ResponseWriter, req *http.Request) bool {
+	if rl == nil {
+		return true
+	}
+	if ok, wait := rl.games.allow(rl.clientIP(req), time.Now()); !ok {
+		writeTooManyRequests(rw, wait, "Too many new games; try again later")
+		return false
+	}
+	return true
+}
+
+func writeTooManyRequests(rw http.ResponseWriter, wait time.Duration, msg string) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeError(rw, http.StatusTooManyRequests, msg)
+}
+
+// wordSetBytes approximates the memory held by a game's word set.
+// Games using the server's default words hold nothing extra, whether
+// they share its slice or were loaded with a copy of it.
+func (s *Server) wordSetBytes(gh *GameHandle) int64 {
+	if gh.g == nil {
+		return 0
+	}
+	return customWordSetBytes(gh.g.WordSet, s.defaultWords)
+}
+
+func customWordSetBytes(words, defaults []string) int64 {
+	if len(words) == 0 || sameWords(words, defaults) {
+		return 0
+	}
+	const stringHeader = 16
+	var n int64
+	for _, w := range words {
+		n += int64(len(w)) + stringHeader
+	}
+	return n
+}
+
+// sameWords reports whether a and b hold the same words in the same
+// order.
+func sameWords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if len(a) > 0 && &a[0] == &b[0] {
+		return true
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package crossclues
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	r := Rate{PerSecond: 2, Burst: 2}
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(r, now); !ok {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	ok, wait := b.take(r, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("take after the burst = %t, %s; want false, 500ms", ok, wait)
+	}
+	if ok, _ := b.take(r, now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("bucket didn't refill")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		hops      int
+		cluster   bool
+		forwarded string
+		client    string
+		xff       []string
+		want      string
+	}{
+		{want: "10.0.0.1"},
+		{xff: []string{"1.1.1.1"}, want: "10.0.0.1"},
+		{hops: 1, xff: []string{"6.6.6.6, 1.1.1.1"}, want: "1.1.1.1"},
+		{hops: 2, xff: []string{"6.6.6.6, 1.1.1.1", "2.2.2.2"}, want: "1.1.1.1"},
+		{hops: 2, xff: []string{"1.1.1.1"}, want: "10.0.0.1"},
+		{cluster: true, forwarded: "node-a", client: "1.1.1.1", xff: []string{"6.6.6.6, 10.0.0.2"}, want: "1.1.1.1"},
+		{cluster: true, xff: []string{"1.1.1.1"}, want: "10.0.0.1"},
+		{forwarded: "node-a", client: "1.1.1.1", want: "10.0.0.1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header["X-Forwarded-For"] = tc.xff
+		if tc.forwarded != "" {
+			req.Header.Set(forwardedHeader, tc.forwarded)
+			req.Header.Set(forwardedClientHeader, tc.client)
+		}
+		rl := newRateLimiter(RateLimits{TrustedProxyHops: tc.hops}, tc.cluster, maxRequestBodyBytes)
+		if got := rl.clientIP(req); got != tc.want {
+			t.Errorf("%+v: clientIP = %q, want %q", tc, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	s := &Server{Store: newMemStore(), RateLimits: RateLimits{
+		PerIP:      Rate{PerSecond: 0.001, Burst: 3},
+		GamesPerIP: Rate{PerSecond: 0.001, Burst: 1},
+	}}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	joinAs := func(gameID, playerID string) int {
+		return postJSON(t, ts.URL+"/join", map[string]interface{}{"game_id": gameID, "player_id": playerID}, nil)
+	}
+	if code := joinAs("limited", "alice"); code != 200 {
+		t.Fatalf("joining a new game returned %d", code)
+	}
+	if code := joinAs("another", "alice"); code != http.StatusTooManyRequests {
+		t.Errorf("joining a second new game returned %d, want 429", code)
+	}
+	// Joining an existing game doesn't create one.
+	if code := joinAs("limited", "bob"); code != 200 {
+		t.Errorf("joining an existing game returned %d", code)
+	}
+
+	resp, err := http.Get(ts.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("fourth request returned %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1000" {
+		t.Errorf("Retry-After = %q, want 1000", got)
+	}
+}
+
+func TestMaxWordSetBytes(t *testing.T) {
+	s := &Server{Store: newMemStore(), RateLimits: RateLimits{MaxWordSetBytes: 500}}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	custom := make([]string, 30)
+	for i := range custom {
+		custom[i] = strings.Repeat("W", 10) + string(rune('A'+i%26)) + string(rune('A'+i/26))
+	}
+	body := map[string]interface{}{
+		"game_id": "custom", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}
+	alice := join(t, ts.URL, "custom", "alice")
+	// The default word set is shared, so it doesn't count.
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, body, nil); code != 200 {
+		t.Fatalf("/next-game with default words returned %d", code)
+	}
+	// Nor does a copy of it loaded from the store.
+	s.mu.Lock()
+	s.games.remove("custom")
+	s.mu.Unlock()
+	if gh := s.getGame("custom"); gh == nil || s.wordSetBytes(gh) != 0 {
+		t.Fatalf("reloaded game with default words counts as custom")
+	}
+	body["word_set"] = custom
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, body, nil); code != http.StatusTooManyRequests {
+		t.Errorf("/next-game with %d bytes of words returned %d, want 429", customWordSetBytes(custom, nil), code)
+	}
+}
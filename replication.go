@@ -0,0 +1,382 @@
+package crossclues
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A follower is a server that tails a primary's changes over
+// GET /replication/stream and serves read-only views of the games.
+// The stream is newline-delimited JSON replicationEvents: a snapshot
+// of every stored game, followed by each save and delete as it
+// happens. Events are applied only if they're newer than what the
+// follower already has, so snapshots after a reconnect can overlap
+// with what was already streamed. Expiry isn't replicated; each
+// server applies its own retention policy.
+//
+// POST /replication/promote turns a follower into a primary: it
+// stops tailing and starts accepting moves.
+
+type replicationEvent struct {
+	Save   *gameRecord       `json:"save,omitempty"`
+	Delete *replicatedDelete `json:"delete,omitempty"`
+}
+
+type replicatedDelete struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// heartbeatInterval is how often an empty event is sent to idle
+// followers so that dead connections are noticed.
+const heartbeatInterval = 15 * time.Second
+
+// followerReadTimeout is how long a follower waits for the next event
+// before it gives up on the stream and reconnects. It's a variable so
+// tests can shorten it.
+var followerReadTimeout = 3 * heartbeatInterval
+
+// replicationClient connects followers to their primary. It has no
+// overall timeout, since the stream never ends; followOnce times out
+// reads instead.
+var replicationClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// subscriberBuffer is how many events a follower can fall behind by
+// before it's disconnected. It resynchronizes from a fresh snapshot
+// when it reconnects.
+const subscriberBuffer = 1024
+
+// changeFeed wraps a Store, publishing every save and delete to
+// replication subscribers.
+type changeFeed struct {
+	Store
+	log *Logger
+
+	mu   sync.Mutex
+	subs map[chan []byte]bool
+}
+
+func newChangeFeed(s Store, l *Logger) *changeFeed {
+	return &changeFeed{Store: s, log: l, subs: make(map[chan []byte]bool)}
+}
+
+func (f *changeFeed) Save(g *Game) error {
+	if err := f.Store.Save(g); err != nil || g == nil {
+		return err
+	}
+	// Encode now; the game is modified again once the caller
+	// releases its lock.
+	f.publish(func() replicationEvent {
+		return replicationEvent{Save: &gameRecord{SchemaVersion: SchemaVersion, Game: g}}
+	})
+	return nil
+}
+
+func (f *changeFeed) Delete(g *Game) error {
+	if err := f.Store.Delete(g); err != nil || g == nil {
+		return err
+	}
+	f.publish(func() replicationEvent {
+		return replicationEvent{Delete: &replicatedDelete{ID: g.ID, CreatedAt: g.CreatedAt}}
+	})
+	return nil
+}
+
+func (f *changeFeed) publish(event func() replicationEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subs) == 0 {
+		return
+	}
+	b, err := json.Marshal(event())
+	if err != nil {
+		f.log.Error("marshal replication event", "err", err)
+		return
+	}
+	for ch := range f.subs {
+		select {
+		case ch <- b:
+		default:
+			// Too far behind; drop the follower.
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (f *changeFeed) subscribe() chan []byte {
+	ch := make(chan []byte, subscriberBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[ch] = true
+	return ch
+}
+
+func (f *changeFeed) unsubscribe(ch chan []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs[ch] {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// gameIterator is implemented by stores that can enumerate their
+// games, which is required to snapshot them for followers.
+type gameIterator interface {
+	Each(f GameFilter, fn func(*Game) error) error
+}
+
+// GET /replication/stream
+func (s *Server) handleReplicationStream(rw http.ResponseWriter, req *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming unsupported", 500)
+		return
+	}
+	iter, ok := s.feed.Store.(gameIterator)
+	if !ok {
+		http.Error(rw, "Store doesn't support replication", 501)
+		return
+	}
+
+	// Subscribe before taking the snapshot so no change is missed.
+	// Changes made during the snapshot may be sent twice.
+	ch := s.feed.subscribe()
+	defer s.feed.unsubscribe(ch)
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	bw := bufio.NewWriter(rw)
+	enc := json.NewEncoder(bw)
+	err := iter.Each(GameFilter{}, func(g *Game) error {
+		return enc.Encode(replicationEvent{Save: &gameRecord{SchemaVersion: SchemaVersion, Game: g}})
+	})
+	if err != nil {
+		loggerFrom(req.Context()).Error("replication snapshot", "err", err)
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var line []byte
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			line = []byte("{}")
+		case b, ok := <-ch:
+			if !ok {
+				loggerFrom(req.Context()).Warn("replication follower fell behind; disconnecting", "remote_addr", req.RemoteAddr)
+				return
+			}
+			line = b
+		}
+		if _, err := rw.Write(append(line, '\n')); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// POST /replication/promote
+func (s *Server) handlePromote(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", 405)
+		return
+	}
+	if !s.promote() {
+		http.Error(rw, "Server is already a primary", 400)
+		return
+	}
+	loggerFrom(req.Context()).Info("promoted to primary")
+	writeJSON(rw, struct {
+		Primary bool `json:"primary"`
+	}{true})
+}
+
+func (s *Server) isReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
+
+// promote stops following the primary and starts accepting moves.
+// It reports whether the server was a follower.
+func (s *Server) promote() bool {
+	if !atomic.CompareAndSwapInt32(&s.readOnly, 1, 0) {
+		return false
+	}
+	s.stopFollowing()
+	return true
+}
+
+// follow tails the primary at primaryURL until ctx is cancelled,
+// reconnecting with backoff when the stream breaks.
+func (s *Server) follow(ctx context.Context, primaryURL, password string) {
+	const maxBackoff = 30 * time.Second
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.followOnce(ctx, primaryURL, password)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > maxBackoff {
+			backoff = time.Second
+		}
+		s.Log.Error("following primary failed; reconnecting", "primary", primaryURL, "err", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (s *Server) followOnce(ctx context.Context, primaryURL, password string) error {
+	u, err := url.Parse(primaryURL)
+	if err != nil {
+		return err
+	}
+	u.Path = "/replication/stream"
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	// The primary sends heartbeats, so a stream that's silent for
+	// longer than that is dead, even if the connection isn't closed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timedOut int32
+	idle := time.AfterFunc(followerReadTimeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	defer idle.Stop()
+
+	req = req.WithContext(ctx)
+	req.SetBasicAuth("admin", password)
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("replication stream returned %s", resp.Status)
+	}
+	s.Log.Info("following primary", "primary", primaryURL)
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		idle.Reset(followerReadTimeout)
+		var event replicationEvent
+		if err := json.Unmarshal(sc.Bytes(), &event); err != nil {
+			return fmt.Errorf("decoding replication event: %w", err)
+		}
+		if err := s.applyReplicated(event); err != nil {
+			return err
+		}
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("nothing received from the primary for %s", followerReadTimeout)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("replication stream closed")
+}
+
+func (s *Server) applyReplicated(event replicationEvent) error {
+	switch {
+	case event.Save != nil && event.Save.Game != nil:
+		g := event.Save.Game
+		if err := g.validate(); err != nil {
+			return fmt.Errorf("replicated game %q: %w", g.ID, err)
+		}
+		s.applyReplicatedSave(g)
+	case event.Delete != nil:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if gh, ok := s.games.get(event.Delete.ID); ok {
+			gh.mu.Lock()
+			deleted := gh.g != nil && gh.g.CreatedAt.Equal(event.Delete.CreatedAt)
+			gh.mu.Unlock()
+			if deleted {
+				s.games.remove(event.Delete.ID)
+			}
+		}
+		return s.Store.Delete(&Game{ID: event.Delete.ID, CreatedAt: event.Delete.CreatedAt})
+	}
+	return nil
+}
+
+// applyReplicatedSave brings the follower's copy of g up to date and
+// notifies anyone watching it.
+func (s *Server) applyReplicatedSave(g *Game) {
+	s.mu.Lock()
+	gh, cached := s.games.get(g.ID)
+	if cached {
+		gh.mu.Lock()
+		sameGame := gh.g != nil && gh.g.CreatedAt.Equal(g.CreatedAt)
+		gh.mu.Unlock()
+		if sameGame {
+			s.mu.Unlock()
+			gh.update(context.Background(), func(cur *Game) bool {
+				if !cur.UpdatedAt.Before(g.UpdatedAt) {
+					return false
+				}
+				*cur = *g
+				return true
+			})
+			return
+		}
+	}
+	defer s.mu.Unlock()
+
+	// A game that isn't cached, or was replaced by the next game.
+	existing, err := s.Store.Load(g.ID)
+	if err != nil {
+		s.Log.Error("load replicated game", "game_id", g.ID, "err", err)
+		return
+	}
+	if existing != nil && !existing.UpdatedAt.Before(g.UpdatedAt) {
+		return
+	}
+	if !cached {
+		if err := s.Store.Save(g); err != nil {
+			s.Log.Error("save replicated game", "game_id", g.ID, "err", err)
+		}
+		return
+	}
+	s.replaceLocked(context.Background(), g.ID, gh, newHandle(g.ID, g, s.Store, s.broker, s.Log))
+}
+
+func writeReadOnly(rw http.ResponseWriter) {
+	writeError(rw, http.StatusServiceUnavailable, "This server is a read-only replica")
+}
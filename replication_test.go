@@ -0,0 +1,203 @@
+package crossclues
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testBootstrapPW = "replication-test"
+
+func postJSON(t *testing.T, url string, body interface{}, out interface{}) int {
+	t.Helper()
+	return postJSONAs(t, url, "", body, out)
+}
+
+// postJSONAs posts body with the session token, if it isn't empty.
+func postJSONAs(t *testing.T, url, token string, body interface{}, out interface{}) int {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("admin", testBootstrapPW)
+	if token != "" {
+		req.Header.Set(sessionHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollowerReplicatesAndPromotes(t *testing.T) {
+	primary := &Server{Store: openStore(t, tempDir(t, "test-primary-*")), SessionSecret: "secret", BootstrapPassword: testBootstrapPW}
+	if err := primary.setup(); err != nil {
+		t.Fatal(err)
+	}
+	primaryHTTP := httptest.NewServer(primary)
+	defer primaryHTTP.Close()
+
+	// Created before the follower connects, so it arrives in the
+	// snapshot.
+	alice := join(t, primaryHTTP.URL, "replicated", "alice")
+	var g Game
+	code := postJSONAs(t, primaryHTTP.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "replicated", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, &g)
+	if code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	follower := &Server{
+		Store:  openStore(t, tempDir(t, "test-follower-*")),
+		Follow: primaryHTTP.URL,
+
+		SessionSecret:     "secret",
+		BootstrapPassword: testBootstrapPW,
+	}
+	if err := follower.setup(); err != nil {
+		t.Fatal(err)
+	}
+	follower.startFollowing()
+	defer follower.stopFollowing()
+	followerHTTP := httptest.NewServer(follower)
+	defer followerHTTP.Close()
+
+	waitFor(t, "the snapshot", func() bool { return follower.getGame("replicated") != nil })
+
+	// A move on the primary is streamed to the follower. Fetching the
+	// game state deals alice her cards.
+	code = postJSONAs(t, primaryHTTP.URL+"/game-state", alice, map[string]interface{}{
+		"game_id": "replicated", "player_id": "alice",
+	}, &g)
+	if code != 200 || len(g.PlayerCards) == 0 {
+		t.Fatalf("/game-state returned %d with cards %v", code, g.PlayerCards)
+	}
+	var idx int
+	for i := range g.PlayerCards {
+		idx = i
+	}
+	guess := map[string]interface{}{"game_id": "replicated", "index": idx, "player_id": "alice"}
+	if code := postJSONAs(t, primaryHTTP.URL+"/guess", alice, guess, nil); code != 200 {
+		t.Fatalf("/guess on the primary returned %d", code)
+	}
+	waitFor(t, "the guess", func() bool {
+		gh := follower.getGame("replicated")
+		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		return gh.g.Revealed[idx]
+	})
+
+	// Watching the game on the follower doesn't write to its store,
+	// which only holds what the primary sends.
+	saved := follower.feed.subscribe()
+	defer follower.feed.unsubscribe(saved)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(followerHTTP.URL, "http")+"/websocket/replicated/alice?session="+alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pushed Game
+	if err := conn.ReadJSON(&pushed); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed.PlayerIDs) != 1 {
+		t.Errorf("follower pushed players %v, want alice", pushed.PlayerIDs)
+	}
+	conn.Close()
+	waitFor(t, "the websocket to close", func() bool {
+		gh := follower.getGame("replicated")
+		defer follower.releaseGame(gh)
+		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		return len(gh.websockets) == 0
+	})
+	select {
+	case b := <-saved:
+		t.Errorf("follower saved a game: %.80s", b)
+	default:
+	}
+
+	// The follower refuses moves until it's promoted.
+	if code := postJSONAs(t, followerHTTP.URL+"/guess", alice, guess, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("/guess on the follower returned %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := postJSON(t, followerHTTP.URL+"/replication/promote", nil, nil); code != 200 {
+		t.Fatalf("/replication/promote returned %d", code)
+	}
+	if follower.isReadOnly() {
+		t.Fatal("follower is still read-only after promotion")
+	}
+	// The card was already played, so this is rejected by the game
+	// rather than by the replica.
+	if code := postJSONAs(t, followerHTTP.URL+"/guess", alice, guess, nil); code != 400 {
+		t.Errorf("/guess on the promoted follower returned %d, want 400", code)
+	}
+	if code := postJSON(t, followerHTTP.URL+"/replication/promote", nil, nil); code != 400 {
+		t.Errorf("promoting a primary returned %d, want 400", code)
+	}
+}
+
+func TestFollowerTimesOutStalledStream(t *testing.T) {
+	defer func(d time.Duration) { followerReadTimeout = d }(followerReadTimeout)
+	followerReadTimeout = 50 * time.Millisecond
+
+	// A primary that stops sending anything, even heartbeats, without
+	// closing the connection.
+	stalled := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("{}\n"))
+		rw.(http.Flusher).Flush()
+		select {
+		case <-stalled:
+		case <-req.Context().Done():
+		}
+	}))
+	defer primary.Close()
+	defer close(stalled)
+
+	follower := &Server{Store: newMemStore()}
+	if err := follower.setup(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- follower.followOnce(context.Background(), primary.URL, testBootstrapPW) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "nothing received") {
+			t.Errorf("followOnce = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower kept waiting on a stalled stream")
+	}
+}
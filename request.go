@@ -0,0 +1,97 @@
+package crossclues
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Body size limits for the JSON endpoints. The checksums of some
+// 15,000 backup files fit in maxCheckpointBodyBytes.
+const (
+	maxRequestBodyBytes    = 4 << 10
+	maxCheckpointBodyBytes = 1 << 20
+
+	// maxWordSetWordBytes is the room each word of a custom word set
+	// gets in a /next-game body: the word, JSON encoded, and a comma.
+	maxWordSetWordBytes = 100
+)
+
+// maxNextGameBodyBytes returns the /next-game body limit, which fits a
+// custom word set of the largest allowed size.
+func (s *Server) maxNextGameBodyBytes() int64 {
+	return maxRequestBodyBytes + int64(s.maxWordSetWords())*maxWordSetWordBytes
+}
+
+// errorResponse is the body of every error returned by the JSON
+// endpoints.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeError responds with a JSON error body.
+func writeError(rw http.ResponseWriter, code int, msg string) {
+	j, _ := json.Marshal(errorResponse{Error: msg})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(code)
+	rw.Write(append(j, '\n'))
+}
+
+// jsonEndpoint wraps h, a handler for POSTed JSON, so it's only
+// called for POST requests with a JSON content type and a body of at
+// most maxBytes. Handlers decode the body with decodeJSON.
+func jsonEndpoint(maxBytes int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			writeError(rw, http.StatusMethodNotAllowed, "Method not allowed; use POST")
+			return
+		}
+		if mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+			writeError(rw, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			return
+		}
+		if req.ContentLength > maxBytes {
+			writeError(rw, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxBytes))
+			return
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+		req.Body.Close()
+		if err != nil {
+			writeError(rw, 400, "Error reading request body")
+			return
+		}
+		if int64(len(b)) > maxBytes {
+			writeError(rw, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxBytes))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		h(rw, req)
+	}
+}
+
+// decodeJSON decodes req's body into v, rejecting unknown fields and
+// anything after the JSON value. On failure it writes a 400 and
+// returns false.
+func decodeJSON(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == io.EOF {
+		err = errors.New("empty request body")
+	} else if _, terr := dec.Token(); err == nil && terr != io.EOF {
+		err = errors.New("unexpected data after the JSON object")
+	}
+	if err != nil {
+		writeError(rw, 400, "Invalid request body: "+strings.TrimPrefix(err.Error(), "json: "))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package crossclues
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONEndpoints(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"get", "GET", "/guess", "", "", http.StatusMethodNotAllowed},
+		{"form", "POST", "/discard", "application/x-www-form-urlencoded", "game_id=a", http.StatusUnsupportedMediaType},
+		{"too large", "POST", "/game-state", "application/json", `{"game_id":"` + strings.Repeat("a", maxRequestBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+		{"unknown field", "POST", "/guess", "application/json", `{"game_id":"a","index":0,"player_id":"p","cheat":true}`, 400},
+		{"trailing data", "POST", "/guess", "application/json", `{"game_id":"a","index":0,"player_id":"p"} {}`, 400},
+		{"wrong type", "POST", "/next-game", "application/json", `{"game_id":"a","hand_size":"two"}`, 400},
+		{"empty", "POST", "/next-game", "application/json", ``, 400},
+		{"not found", "POST", "/guess", "application/json; charset=utf-8", `{"game_id":"missing","index":0,"player_id":"p"}`, 404},
+	} {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body errorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+		if err != nil || body.Error == "" || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: response isn't a JSON error: %+v, %v", tc.name, body, err)
+		}
+	}
+}
+
+func TestNextGameBodyLimit(t *testing.T) {
+	wordSet := func(n int) []string {
+		words := make([]string, n)
+		for i := range words {
+			words[i] = fmt.Sprintf("%s%06d", strings.Repeat("W", 40), i)
+		}
+		return words
+	}
+	for _, tc := range []struct {
+		maxWords, words int
+		want            int
+	}{
+		// Bigger than the default limit, but allowed.
+		{30000, 30000, 200},
+		{30, 30, 200},
+		{30, 200, http.StatusRequestEntityTooLarge},
+	} {
+		s := &Server{Store: newMemStore(), MaxWordSetWords: tc.maxWords}
+		if err := s.setup(); err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(s)
+		alice := join(t, ts.URL, "big-words", "alice")
+		code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+			"game_id": "big-words", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+			"word_set": wordSet(tc.words),
+		}, nil)
+		ts.Close()
+		if code != tc.want {
+			t.Errorf("%d words with a limit of %d: status %d, want %d", tc.words, tc.maxWords, code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package crossclues
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the version stamped on every game record written
+// by this build. Records written before versioning existed have no
+// stamp and are treated as version 0.
+const SchemaVersion = 3
+
+// A migration upgrades a decoded game record by one schema version,
+// editing its top-level JSON fields in place.
+type migration func(record map[string]json.RawMessage) error
+
+// migrations[v] upgrades a record from version v to v+1. To change
+// the persisted format, bump SchemaVersion and append a migration;
+// records are upgraded when they're loaded, or offline by
+// PebbleStore.Migrate.
+var migrations = []migration{
+	// Version 1 introduced the schema_version stamp itself; the
+	// fields are otherwise unchanged.
+	0: func(map[string]json.RawMessage) error { return nil },
+	// Version 2 made game IDs canonical. Older IDs are converted with
+	// legacyGameID; ones it can't convert are kept, and the games
+	// can't be reached until they expire.
+	1: func(record map[string]json.RawMessage) error {
+		var id string
+		if err := json.Unmarshal(record["id"], &id); err != nil {
+			return fmt.Errorf("id: %w", err)
+		}
+		if canonical, ok := legacyGameID(id); ok {
+			b, err := json.Marshal(canonical)
+			if err != nil {
+				return err
+			}
+			record["id"] = b
+		}
+		return nil
+	},
+	// Version 3 stores built-in word sets in binary records by ID.
+	// Older builds would read those games without words, so the
+	// version is bumped for them to refuse the records; the JSON form
+	// is unchanged.
+	2: func(map[string]json.RawMessage) error { return nil },
+}
+
+func init() {
+	if len(migrations) != SchemaVersion {
+		panic(fmt.Sprintf("crossclues: %d migrations registered for schema version %d",
+			len(migrations), SchemaVersion))
+	}
+}
+
+// gameRecord is the JSON form of a persisted Game. Games are stored
+// in the binary encoding, but records written before it existed are
+// JSON, and migrations operate on this form.
+type gameRecord struct {
+	SchemaVersion int `json:"schema_version"`
+	*Game
+}
+
+func encodeGame(g *Game) ([]byte, error) {
+	return marshalGameBinary(g), nil
+}
+
+// encodeGameJSON returns the JSON form of a persisted game, for
+// debugging.
+func encodeGameJSON(g *Game) ([]byte, error) {
+	return json.MarshalIndent(gameRecord{SchemaVersion: SchemaVersion, Game: g}, "", "  ")
+}
+
+func isBinaryRecord(b []byte) bool {
+	return len(b) > 0 && b[0] == binaryRecordMagic
+}
+
+// decodeGame decodes a persisted game, running any migrations needed
+// to bring it up to the current schema version.
+func decodeGame(b []byte) (*Game, error) {
+	return decodeGameWith(b, migrations)
+}
+
+func decodeGameWith(b []byte, ms []migration) (*Game, error) {
+	var version int
+	if isBinaryRecord(b) {
+		g, v, err := unmarshalGameBinary(b)
+		if err != nil {
+			return nil, err
+		}
+		if v == len(ms) {
+			return g, nil
+		}
+		// Run older binary records through the migrations in their
+		// JSON form.
+		version = v
+		b, err = json.Marshal(gameRecord{SchemaVersion: v, Game: g})
+		if err != nil {
+			return nil, fmt.Errorf("marshaling game record: %w", err)
+		}
+	} else {
+		var err error
+		version, err = recordVersion(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if version > len(ms) {
+		return nil, fmt.Errorf("game record has schema version %d, newer than supported version %d",
+			version, len(ms))
+	}
+	if version < len(ms) {
+		var err error
+		b, err = upgradeRecord(b, version, ms)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g := new(Game)
+	if err := json.Unmarshal(b, &gameRecord{Game: g}); err != nil {
+		return nil, fmt.Errorf("Unmarshal game: %w", err)
+	}
+	return g, nil
+}
+
+// recordVersion returns the schema version of an encoded record.
+func recordVersion(b []byte) (int, error) {
+	if isBinaryRecord(b) {
+		v, n := binary.Uvarint(b[1:])
+		if n <= 0 {
+			return 0, errTruncated
+		}
+		return int(v), nil
+	}
+	var stamp struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(b, &stamp); err != nil {
+		return 0, fmt.Errorf("Unmarshal schema version: %w", err)
+	}
+	return stamp.SchemaVersion, nil
+}
+
+// recordUpdatedAt returns when the game in an encoded record was last
+// updated, without decoding the rest of it. No migration has changed
+// updated_at; one that does has to be handled here too.
+func recordUpdatedAt(b []byte) (time.Time, error) {
+	if !isBinaryRecord(b) {
+		var stamp struct {
+			UpdatedAt time.Time `json:"updated_at"`
+		}
+		if err := json.Unmarshal(b, &stamp); err != nil {
+			return time.Time{}, fmt.Errorf("Unmarshal updated_at: %w", err)
+		}
+		return stamp.UpdatedAt, nil
+	}
+	r := binaryReader{buf: b[1:]}
+	if _, err := r.uvarint(); err != nil {
+		return time.Time{}, err
+	}
+	for len(r.buf) > 0 {
+		key, err := r.uvarint()
+		if err != nil {
+			return time.Time{}, err
+		}
+		num, wire := int(key>>3), int(key&7)
+		switch wire {
+		case wireVarint:
+			_, err = r.uvarint()
+		case wireBytes:
+			var payload []byte
+			payload, err = r.bytes()
+			if err == nil && num == fieldUpdatedAt {
+				return readTime(payload)
+			}
+		default:
+			err = fmt.Errorf("field %d has unknown wire type %d", num, wire)
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Time{}, nil
+}
+
+func upgradeRecord(b []byte, from int, ms []migration) ([]byte, error) {
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, fmt.Errorf("Unmarshal game record: %w", err)
+	}
+	for v := from; v < len(ms); v++ {
+		if err := ms[v](record); err != nil {
+			return nil, fmt.Errorf("migrating game record from version %d: %w", v, err)
+		}
+	}
+	record["schema_version"] = json.RawMessage(fmt.Sprint(len(ms)))
+	return json.Marshal(record)
+}
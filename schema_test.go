@@ -0,0 +1,270 @@
+package crossclues
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// testdata/game_v0.json is a game record as written before records
+// carried a schema version.
+func readGoldenV0(t *testing.T) []byte {
+	b, err := ioutil.ReadFile("testdata/game_v0.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func checkGoldenV0(t *testing.T, g *Game) {
+	t.Helper()
+	if g.ID != "golden-fixture" {
+		t.Errorf("ID = %q", g.ID)
+	}
+	if want := time.Date(2021, 1, 2, 3, 14, 5, 0, time.UTC); !g.UpdatedAt.Equal(want) {
+		t.Errorf("UpdatedAt = %s, want %s", g.UpdatedAt, want)
+	}
+	if g.Seed != 7 || g.HandSize != 2 || g.BoardSize != 4 || g.DeckIndex != 2 {
+		t.Errorf("got seed %d, hand size %d, board size %d, deck index %d",
+			g.Seed, g.HandSize, g.BoardSize, g.DeckIndex)
+	}
+	if want := map[int]string{2: "alice", 5: "alice"}; !reflect.DeepEqual(g.PlayerCards, want) {
+		t.Errorf("PlayerCards = %v, want %v", g.PlayerCards, want)
+	}
+	if len(g.WordSet) != 30 || len(g.Words) != 8 || len(g.Deck) != 16 {
+		t.Errorf("got %d words in set, %d on board, %d in deck", len(g.WordSet), len(g.Words), len(g.Deck))
+	}
+}
+
+func TestDecodeGoldenV0(t *testing.T) {
+	g, err := decodeGame(readGoldenV0(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGoldenV0(t, g)
+
+	// Re-encoding stamps the current version and round trips.
+	b, err := encodeGame(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := recordVersion(b); err != nil || v != SchemaVersion {
+		t.Fatalf("recordVersion = %d, %v; want %d", v, err, SchemaVersion)
+	}
+	g2, err := decodeGame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, g2) {
+		t.Errorf("round trip changed the game: %+v != %+v", g2, g)
+	}
+}
+
+func TestMigrationsRunInOrder(t *testing.T) {
+	var ran []int
+	ms := []migration{
+		func(map[string]json.RawMessage) error { ran = append(ran, 0); return nil },
+		func(map[string]json.RawMessage) error { ran = append(ran, 1); return nil },
+		// A rename, like turning "won" into a differently named field
+		// and back, must not lose the value.
+		func(r map[string]json.RawMessage) error {
+			ran = append(ran, 2)
+			r["game_over"] = r["won"]
+			delete(r, "won")
+			return nil
+		},
+		func(r map[string]json.RawMessage) error {
+			ran = append(ran, 3)
+			r["won"] = r["game_over"]
+			delete(r, "game_over")
+			return nil
+		},
+	}
+
+	in := []byte(`{"schema_version":1,"id":"x","won":true}`)
+	g, err := decodeGameWith(in, ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran migrations %v, want %v", ran, want)
+	}
+	if !g.Won {
+		t.Errorf("Won was dropped by the migrations")
+	}
+
+	if _, err := decodeGameWith([]byte(`{"schema_version":5}`), ms); err == nil {
+		t.Errorf("decoding a record newer than the supported version succeeded")
+	}
+}
+
+func TestPebbleStoreMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-migrate-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ps PebbleStore
+	ps.DB, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DB.Close()
+
+	k := mkkey(time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC).Unix(), "golden-fixture")
+	if err := ps.DB.Set(k, readGoldenV0(t), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ps.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("migrated %d games, want 1", n)
+	}
+	v, closer, err := ps.DB.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := recordVersion(v)
+	closer.Close()
+	if err != nil || version != SchemaVersion {
+		t.Errorf("stored record has version %d, %v; want %d", version, err, SchemaVersion)
+	}
+	if !isBinaryRecord(v) {
+		t.Errorf("stored record is still JSON encoded")
+	}
+
+	g, err := ps.Load("golden-fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGoldenV0(t, g)
+
+	if n, err := ps.Migrate(); err != nil || n != 0 {
+		t.Errorf("second Migrate = %d, %v; want nothing to do", n, err)
+	}
+}
+
+func TestLegacyGameIDs(t *testing.T) {
+	for id, want := range map[string]string{
+		"my-game":      "my-game",
+		"MyGame":       "mygame",
+		"My Game!":     "my-game",
+		"  blue  fish": "blue-fish",
+		"café au lait": "caf-au-lait",
+		"ab":           "",
+		"Stats":        "",
+		"???":          "",
+	} {
+		got, ok := legacyGameID(id)
+		if string(got) != want || ok != (want != "") {
+			t.Errorf("legacyGameID(%q) = %q, %v; want %q", id, got, ok, want)
+		}
+	}
+
+	// Games saved under legacy IDs are found by their canonical IDs,
+	// except where a game already has the canonical ID.
+	ps := openStore(t, tempDir(t, "test-legacy-ids-*"))
+	created := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	saveLegacy := func(id string, score int) []byte {
+		t.Helper()
+		g := newGame(id, randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})
+		g.CreatedAt, g.UpdatedAt, g.Score = created, created, score
+		b, err := json.Marshal(gameRecord{SchemaVersion: 1, Game: g})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := mkkey(created.Unix(), id)
+		if err := ps.DB.Set(k, b, nil); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	legacyKey := saveLegacy("My Game", 1)
+	saveLegacy("Taken", 2)
+	saveLegacy("taken", 3)
+
+	g, err := ps.Load("my-game")
+	if err != nil || g == nil || g.ID != "my-game" || g.Score != 1 {
+		t.Fatalf("Load(my-game) = %+v, %v", g, err)
+	}
+	if g, err := ps.Load("taken"); err != nil || g == nil || g.Score != 3 {
+		t.Fatalf("Load(taken) = %+v, %v; want the game saved as taken", g, err)
+	}
+
+	// Saving the game moves it to its canonical key.
+	g.Score = 4
+	if err := ps.Save(g); err != nil {
+		t.Fatal(err)
+	}
+	if _, closer, err := ps.DB.Get(legacyKey); err != pebble.ErrNotFound {
+		if err == nil {
+			closer.Close()
+		}
+		t.Errorf("legacy record is still stored: %v", err)
+	}
+	if g, err := ps.Load("my-game"); err != nil || g == nil || g.Score != 4 {
+		t.Errorf("Load(my-game) after saving = %+v, %v", g, err)
+	}
+
+	// Migrate moves the rest, but not onto a game with the same ID:
+	// games whose canonical IDs are taken are renamed.
+	saveLegacy("Blue Fish", 5)
+	saveLegacy("Red Fish", 6)
+	saveLegacy("Red  Fish!", 7)
+	// Reopen the store, as a new process would, to index the new
+	// record. Only records an older build wrote need it, so forget
+	// that the store was indexed.
+	if err := ps.DB.Delete(indexedKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	ps = &PebbleStore{DB: ps.DB}
+	restored, err := ps.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := restored["taken"]; g == nil || g.Score != 3 {
+		t.Errorf("Restore()[taken] = %+v; want the game saved as taken", g)
+	}
+	if _, err := ps.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range [][]byte{mkkey(created.Unix(), "blue-fish"), mkkey(created.Unix(), "taken-2")} {
+		if _, closer, err := ps.DB.Get(k); err != nil {
+			t.Errorf("%s: %v", k, err)
+		} else {
+			closer.Close()
+		}
+	}
+	for id, score := range map[string]int{"blue-fish": 5, "taken": 3, "taken-2": 2} {
+		if g, err := ps.Load(id); err != nil || g == nil || g.ID != id || g.Score != score {
+			t.Errorf("Load(%s) after Migrate = %+v, %v; want score %d", id, g, err, score)
+		}
+	}
+	scores := make(map[int]bool)
+	for _, id := range []string{"red-fish", "red-fish-2"} {
+		if g, err := ps.Load(id); err != nil || g == nil {
+			t.Errorf("Load(%s) after Migrate = %+v, %v", id, g, err)
+		} else {
+			scores[g.Score] = true
+		}
+	}
+	if !scores[6] || !scores[7] {
+		t.Errorf("after Migrate, red-fish and red-fish-2 have scores %v; want 6 and 7", scores)
+	}
+	restored, err = ps.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 6 {
+		t.Errorf("Restore() after Migrate returned %d games, want 6", len(restored))
+	}
+}
@@ -1,15 +1,18 @@
 package crossclues
 
 import (
-	"crypto/subtle"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"html/template"
 	"io"
-	"log"
+	"io/fs"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,64 +22,215 @@ import (
 	"github.com/jbowens/dictionary"
 )
 
-var closed chan struct{}
+// DefaultRetention is how long a game is kept after its last
+// activity when Server.Retention is unset.
+const DefaultRetention = 24 * time.Hour
 
-func init() {
-	closed = make(chan struct{})
-	close(closed)
-}
+// Defaults for the Server fields of the same names.
+const (
+	DefaultLongPollTimeout = 15 * time.Second
+	DefaultMaxWordSetWords = 10000
+)
+
+// DefaultHSTSMaxAge is the Strict-Transport-Security max age in the
+// default configuration.
+const DefaultHSTSMaxAge = 180 * 24 * time.Hour
 
 type Server struct {
 	Server   http.Server
 	Upgrader websocket.Upgrader
 	Store    Store
 
+	// Broker delivers game events to websockets, long-polls and
+	// other subscribers. Nil means an in-memory broker.
+	Broker Broker
+
+	// Retention is how long a game is kept, both in memory and in
+	// the store, after it was last updated. Zero means DefaultRetention.
+	Retention time.Duration
+
+	// MaxCachedGames bounds the number of games held in memory.
+	// Games beyond it are loaded from the Store on demand. Zero
+	// means DefaultMaxCachedGames.
+	MaxCachedGames int
+
+	// Follow is the URL of a primary server to replicate games from.
+	// If it's set, the server is a read-only follower until it's
+	// promoted.
+	Follow string
+
+	// Cluster, if set, assigns games to nodes. Requests for games
+	// owned by other nodes are forwarded to them, signed with
+	// ClusterSecret, which every node needs.
+	Cluster       Cluster
+	ClusterSecret string
+
+	// Log receives the server's log entries. Nil means info and above
+	// as text on stderr.
+	Log *Logger
+
+	// Tracer, if set, records spans for requests, game updates and
+	// websocket pushes.
+	Tracer *Tracer
+
+	// Webhooks are URLs that receive signed payloads about game
+	// lifecycle events; see WebhookPayload. WebhookSecret signs them
+	// and is required if webhooks are used.
+	Webhooks      []string
+	WebhookSecret string
+	// AllowGameWebhooks lets /next-game requests set a webhook URL
+	// for the game.
+	AllowGameWebhooks bool
+
+	// SessionSecret signs the session tokens players get when they
+	// join a game. Servers sharing games, as replicas or in a
+	// cluster, need the same secret. If it's empty, a random secret
+	// is used, and sessions end when the server restarts.
+	SessionSecret string
+
+	// BootstrapPassword protects the checkpoint, replication and
+	// webhook delivery endpoints, which are disabled without it. A
+	// follower uses it to log in to its primary.
+	BootstrapPassword string
+	// PprofPassword protects /debug/pprof.
+	PprofPassword string
+
+	// LongPollTimeout is how long /game-state waits for a change
+	// before returning the unchanged game. Zero means
+	// DefaultLongPollTimeout.
+	LongPollTimeout time.Duration
+	// MaxWordSetWords bounds custom word sets. Zero means
+	// DefaultMaxWordSetWords.
+	MaxWordSetWords int
+	// AssetsDir overrides the embedded word lists and page template,
+	// and StaticDir the embedded frontend, for development. Empty
+	// means the copies built into the binary.
+	AssetsDir string
+	StaticDir string
+
+	// GameIDWords, if set, is a file of newline separated words to
+	// suggest game IDs from instead of the embedded list.
+	// GameIDEntropy is how many bits of randomness suggested IDs have,
+	// so they're hard to guess. Zero means DefaultGameIDEntropy.
+	GameIDWords   string
+	GameIDEntropy float64
+
+	// TLSCertFile and TLSKeyFile, if set, serve HTTPS and HTTP/2
+	// instead of plain HTTP. The files are reloaded when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// RedirectAddr, if set with TLS, is the address of a plain HTTP
+	// listener that redirects every request to HTTPS.
+	RedirectAddr string
+	// HSTSMaxAge is how long browsers should only use HTTPS for the
+	// server, sent with responses over TLS. Zero sends no
+	// Strict-Transport-Security header.
+	HSTSMaxAge time.Duration
+
+	// AdminCredentials log in to the /admin endpoints, which let
+	// operators inspect and manage games. The bootstrap password is
+	// also accepted, as an admin. Without either, /admin is disabled.
+	AdminCredentials []Credential
+
+	// RateLimits protects the server from clients that send too many
+	// requests or create too many games. The zero value applies no
+	// limits.
+	RateLimits RateLimits
+
 	tpl         *template.Template
 	gameIDWords []string
+	// gameIDWordCount is how many words suggested game IDs have.
+	gameIDWordCount int
+
+	sessionKey []byte
 
 	mu           sync.Mutex
-	games        map[string]*GameHandle
+	games        *gameCache
+	deleting     map[string]bool          // games being deleted from the store
+	loading      map[string]chan struct{} // closed when the game is loaded
 	defaultWords []string
 	mux          *http.ServeMux
 
+	feed          *changeFeed
+	broker        Broker
+	router        *router
+	webhooks      *webhookDispatcher
+	metrics       *metrics
+	limiter       *rateLimiter
+	readOnly      int32 // atomic access; 1 while following a primary
+	stopFollowing context.CancelFunc
+
 	statOpenRequests  int64 // atomic access
 	statTotalRequests int64 // atomic access
+	statGameEvents    int64 // atomic access
 }
 
 type Store interface {
+	// Load returns the game with the given ID, or nil if the store
+	// doesn't have it.
+	Load(id string) (*Game, error)
+	// Save persists the game, replacing any previously saved game
+	// with the same ID.
 	Save(*Game) error
 	Delete(*Game) error
-	Checkpoint(io.Writer) error
+	DeleteExpired(expiry time.Time) error
+	// Checkpoint writes a backup of the store to w, leaving out
+	// files whose checksums are in have.
+	Checkpoint(w io.Writer, have map[string]bool) error
 }
 
 type GameHandle struct {
-	store Store
+	id     string
+	store  Store
+	broker Broker
+	log    *Logger
+
+	// users counts the requests using the handle, which the cache
+	// doesn't evict, so their updates can't race with a second handle
+	// loaded from the store. It's guarded by Server.mu.
+	users int
 
 	mu         sync.Mutex
+	expired    bool // set once the game has been removed by expireGames
 	websockets map[string]*websocket.Conn
-	updated    chan struct{} // closed when the game is updated
-	replaced   chan struct{} // closed when the game has been replaced
 	marshaled  []byte
 	g          *Game
-}
 
-func newHandle(g *Game, s Store) *GameHandle {
-	gh := &GameHandle{
-		store:      s,
-		g:          g,
-		updated:    make(chan struct{}),
-		replaced:   make(chan struct{}),
-		websockets: make(map[string]*websocket.Conn),
-	}
+	// sessions and host of players who joined a placeholder, before
+	// g existed, and when a player last joined. They're only kept in
+	// memory, so the placeholder stays cached until the game is
+	// created or it expires.
+	pendingSessions  map[string]string
+	pendingHost      string
+	pendingHostNonce string
+	pendingSince     time.Time
+}
 
+// newHandle wraps a newly created game and saves it to the store. g
+// is nil for a placeholder players connect to before the game
+// exists.
+func newHandle(id string, g *Game, s Store, b Broker, l *Logger) *GameHandle {
+	gh := loadedHandle(id, g, s, b, l)
 	err := s.Save(g)
 	if err != nil {
-		log.Printf("Unable to write updated game %q to disk: %s\n", gh.g.ID, err)
+		gh.log.Error("unable to write game to disk", "err", err)
 	}
 
 	return gh
 }
 
+// loadedHandle wraps a game that's already in the store.
+func loadedHandle(id string, g *Game, s Store, b Broker, l *Logger) *GameHandle {
+	return &GameHandle{
+		id:         id,
+		store:      s,
+		broker:     b,
+		log:        l.With("game_id", id),
+		g:          g,
+		websockets: make(map[string]*websocket.Conn),
+	}
+}
+
 func (gh *GameHandle) getPlayerIDs() []string {
 	keys := make([]string, len(gh.websockets))
 	i := 0
@@ -87,39 +241,81 @@ func (gh *GameHandle) getPlayerIDs() []string {
 	return keys
 }
 
-func (gh *GameHandle) update(fn func(*Game) bool) {
+func (gh *GameHandle) update(ctx context.Context, fn func(*Game) bool) {
+	ctx, span := startSpan(ctx, "GameHandle.update", "game_id", gh.id)
+	defer span.End()
+	e, ok := gh.apply(ctx, fn)
+	span.SetAttributes("changed", ok)
+	if ok && gh.broker != nil {
+		gh.broker.Publish(e)
+	}
+}
+
+// updateUnsaved is update without saving the game. Read-only
+// followers use it for changes to the handle, like websockets
+// connecting, since their store only holds what the primary sends.
+func (gh *GameHandle) updateUnsaved(ctx context.Context, fn func(*Game) bool) {
+	gh.mu.Lock()
+	if gh.expired || !fn(gh.g) {
+		gh.mu.Unlock()
+		return
+	}
+	gh.marshaled = nil
+	e := gh.eventLocked(ctx, GameUpdated)
+	gh.mu.Unlock()
+	if gh.broker != nil {
+		gh.broker.Publish(e)
+	}
+}
+
+// apply runs fn and saves the game if fn changed it, returning the
+// event to publish once gh.mu is released.
+func (gh *GameHandle) apply(ctx context.Context, fn func(*Game) bool) (GameEvent, bool) {
 	gh.mu.Lock()
 	defer gh.mu.Unlock()
+	if gh.expired {
+		// the game has already been removed from memory and the
+		// store; don't resurrect it on disk.
+		return GameEvent{}, false
+	}
 	ok := fn(gh.g)
 	if !ok {
 		// game wasn't updated
-		return
+		return GameEvent{}, false
 	}
 
 	gh.marshaled = nil
-	ch := gh.updated
-	gh.updated = make(chan struct{})
 
 	// write the updated game to disk
+	_, span := startSpan(ctx, "Store.Save", "game_id", gh.id)
 	err := gh.store.Save(gh.g)
+	span.RecordError(err)
+	span.End()
 	if err != nil {
-		log.Printf("Unable to write updated game %q to disk: %s\n", gh.g.ID, err)
+		gh.log.Error("unable to write updated game to disk", "err", err)
 	}
-
-	close(ch)
+	return gh.eventLocked(ctx, GameUpdated), true
 }
 
-func (gh *GameHandle) gameStateChanged(stateID *string) (updated <-chan struct{}, replaced <-chan struct{}) {
-	if stateID == nil {
-		return closed, nil
+// eventLocked returns an event carrying a snapshot of the game, so
+// subscribers can read it without holding gh.mu. gh.mu must be held.
+func (gh *GameHandle) eventLocked(ctx context.Context, t GameEventType) GameEvent {
+	e := GameEvent{Type: t, GameID: gh.id, PlayerIDs: gh.getPlayerIDs()}
+	e.tracer, _ = ctx.Value(tracerKey{}).(*Tracer)
+	e.trace = spanContextFrom(ctx)
+	if gh.g != nil {
+		e.Game = gh.g.clone()
 	}
+	return e
+}
 
+func (gh *GameHandle) stateID() string {
 	gh.mu.Lock()
 	defer gh.mu.Unlock()
-	if gh.g.StateID() != *stateID {
-		return closed, nil
+	if gh.g == nil {
+		return ""
 	}
-	return gh.updated, gh.replaced
+	return gh.g.StateID()
 }
 
 // MarshalJSON implements the encoding/json.Marshaler interface.
@@ -138,135 +334,289 @@ func (gh *GameHandle) MarshalJSON() ([]byte, error) {
 	return gh.marshaled, err
 }
 
-func (gh *GameHandle) wsReadLoop(playerID string, c *websocket.Conn) {
+// wsReadLoop waits for the websocket to close, then disconnects the
+// player from whichever handle holds the game by then; the next game
+// takes over its websockets.
+func (s *Server) wsReadLoop(gameID, playerID string, c *websocket.Conn, unsubscribe func(), log *Logger) {
 	for {
 		if _, _, err := c.NextReader(); err != nil {
+			unsubscribe()
 			c.Close()
-			gh.update(func(g *Game) bool {
+			atomic.AddInt64(&s.metrics.websockets, -1)
+			log.Debug("websocket closed", "err", err)
+			s.mu.Lock()
+			gh, ok := s.games.get(gameID)
+			s.mu.Unlock()
+			if !ok {
+				return
+			}
+			update := gh.update
+			if s.isReadOnly() {
+				update = gh.updateUnsaved
+			}
+			update(context.Background(), func(g *Game) bool {
+				if gh.websockets[playerID] != c {
+					// the player has since reconnected
+					return false
+				}
 				delete(gh.websockets, playerID)
 				return true
 			})
-			break
+			return
 		}
 	}
 }
 
-func (s *Server) getGame(gameID string) *GameHandle {
+// replaceLocked makes gh the handle for the game, taking over the
+// websockets connected to old, and publishes a GameReplaced event so
+// waiting /game-state requests and websockets see the new game. old
+// may be nil. s.mu must be held.
+func (s *Server) replaceLocked(ctx context.Context, id string, old, gh *GameHandle) {
+	if old != nil {
+		old.mu.Lock()
+		gh.mu.Lock()
+		gh.websockets = old.websockets
+		old.websockets = make(map[string]*websocket.Conn)
+		gh.mu.Unlock()
+		old.mu.Unlock()
+	}
+	s.games.put(id, gh)
+
+	gh.mu.Lock()
+	e := gh.eventLocked(ctx, GameReplaced)
+	gh.mu.Unlock()
+	s.broker.Publish(e)
+}
+
+// getGame returns the handle for gameID like lookupLocked, marked as
+// in use so it stays in memory until the caller passes it to
+// releaseGame.
+func (s *Server) getGame(gameID GameID) *GameHandle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gh := s.lookupLocked(gameID)
+	if gh != nil {
+		gh.users++
+	}
+	return gh
+}
+
+// releaseGame marks a handle from getGame as no longer in use by the
+// caller.
+func (s *Server) releaseGame(gh *GameHandle) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	gh.users--
+	s.games.evict()
+}
 
-	gh, ok := s.games[gameID]
-	if ok {
-		return gh
+// lookupLocked returns the handle for gameID, loading the game from
+// the store if it isn't in memory. It returns nil if the game
+// doesn't exist, has expired or is being deleted. s.mu must be held;
+// it's released while the game is loaded, so other games can be
+// looked up meanwhile, and concurrent lookups of the same game wait
+// for the one loading it.
+func (s *Server) lookupLocked(gameID GameID) *GameHandle {
+	id := string(gameID)
+	for {
+		if gh, ok := s.games.get(id); ok {
+			return gh
+		}
+		if s.deleting[id] {
+			return nil
+		}
+		loaded, ok := s.loading[id]
+		if !ok {
+			break
+		}
+		s.mu.Unlock()
+		<-loaded
+		s.mu.Lock()
 	}
-	return nil
+
+	loaded := make(chan struct{})
+	s.loading[id] = loaded
+	s.mu.Unlock()
+	g, err := s.Store.Load(id)
+	s.mu.Lock()
+	delete(s.loading, id)
+	close(loaded)
+
+	if err != nil {
+		s.Log.Error("unable to load game from disk", "game_id", gameID, "err", err)
+		return nil
+	}
+	if g == nil || g.UpdatedAt.Before(time.Now().Add(-s.retention())) || s.deleting[id] {
+		return nil
+	}
+	gh := loadedHandle(id, g, s.Store, s.broker, s.Log)
+	s.games.put(id, gh)
+	return gh
 }
 
 // POST /game-state
 func (s *Server) handleGameState(rw http.ResponseWriter, req *http.Request) {
 	var body struct {
-		GameID   string  `json:"game_id"`
+		GameID   GameID  `json:"game_id"`
 		StateID  *string `json:"state_id"`
 		PlayerID string  `json:"player_id"`
 	}
-	err := json.NewDecoder(req.Body).Decode(&body)
-	if err != nil {
-		http.Error(rw, "Error decoding request body", 400)
+	if !decodeJSON(rw, req, &body) {
 		return
 	}
 
 	gh := s.getGame(body.GameID)
 	if gh == nil {
-		http.Error(rw, "Game ID not found", 404)
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	defer s.releaseGame(gh)
+	if !s.authorize(rw, req, gh, body.PlayerID) {
 		return
 	}
 
-	gh.update(func(g *Game) bool {
-		err = g.Draw(body.PlayerID)
-		return err == nil
+	if !s.isReadOnly() {
+		var err error
+		gh.update(req.Context(), func(g *Game) bool {
+			if g == nil {
+				err = errGameNotStarted
+				return false
+			}
+			won := g.Won
+			err = g.Draw(body.PlayerID)
+			s.metrics.checkFinished(g, won)
+			return err == nil
+		})
+		if err != nil {
+			writeError(rw, moveErrorCode(err), err.Error())
+			return
+		}
+	}
+
+	// Subscribe before comparing state IDs so that an update in
+	// between isn't missed.
+	changed := make(chan struct{}, 1)
+	unsubscribe := s.broker.Subscribe(string(body.GameID), func(GameEvent) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
 	})
-	if err != nil {
-		http.Error(rw, err.Error(), 400)
+	defer unsubscribe()
+
+	if body.StateID == nil || gh.stateID() != *body.StateID {
+		writeGameForPlayer(rw, gh, body.PlayerID)
 		return
 	}
 
-	updated, replaced := gh.gameStateChanged(body.StateID)
-
 	select {
 	case <-req.Context().Done():
 		return
-	case <-time.After(15 * time.Second):
-		writeGameForPlayer(rw, gh, body.PlayerID, false)
-	case <-updated:
-		writeGameForPlayer(rw, gh, body.PlayerID, false)
-	case <-replaced:
-		gh = s.getGame(body.GameID)
-		writeGameForPlayer(rw, gh, body.PlayerID, false)
+	case <-time.After(s.longPollTimeout()):
+	case <-changed:
+		// the game may have been replaced by the next one
+		if current := s.getGame(body.GameID); current != nil {
+			defer s.releaseGame(current)
+			gh = current
+		}
 	}
+	writeGameForPlayer(rw, gh, body.PlayerID)
 }
 
 // POST /guess
 func (s *Server) handleGuess(rw http.ResponseWriter, req *http.Request) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+
 	var request struct {
-		GameID   string `json:"game_id"`
+		GameID   GameID `json:"game_id"`
 		Index    int    `json:"index"`
 		PlayerID string `json:"player_id"`
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&request); err != nil {
-		http.Error(rw, "Error decoding", 400)
+	if !decodeJSON(rw, req, &request) {
 		return
 	}
 
+	log := loggerFrom(req.Context()).With("game_id", request.GameID, "player_id", request.PlayerID)
 	gh := s.getGame(request.GameID)
 	if gh == nil {
-		http.Error(rw, "Game ID not found", 404)
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	defer s.releaseGame(gh)
+	if !s.authorize(rw, req, gh, request.PlayerID) {
 		return
 	}
 
 	var err error
-	gh.update(func(g *Game) bool {
+	gh.update(req.Context(), func(g *Game) bool {
+		if g == nil {
+			err = errGameNotStarted
+			return false
+		}
+		won := g.Won
 		err = g.Guess(request.Index, request.PlayerID)
+		s.metrics.checkFinished(g, won)
 		return err == nil
 	})
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		log.Info("guess rejected", "index", request.Index, "err", err)
+		writeError(rw, moveErrorCode(err), err.Error())
 		return
 	}
-	writeGameForPlayer(rw, gh, request.PlayerID, true)
+	log.Debug("guess", "index", request.Index)
+	writeGameForPlayer(rw, gh, request.PlayerID)
 }
 
 // POST /discard
 func (s *Server) handleDiscard(rw http.ResponseWriter, req *http.Request) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+
 	var request struct {
-		GameID   string `json:"game_id"`
+		GameID   GameID `json:"game_id"`
 		Index    int    `json:"index"`
 		PlayerID string `json:"player_id"`
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&request); err != nil {
-		http.Error(rw, "Error decoding", 400)
+	if !decodeJSON(rw, req, &request) {
 		return
 	}
 
+	log := loggerFrom(req.Context()).With("game_id", request.GameID, "player_id", request.PlayerID)
 	gh := s.getGame(request.GameID)
 	if gh == nil {
-		http.Error(rw, "Game ID not found", 404)
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	defer s.releaseGame(gh)
+	if !s.authorize(rw, req, gh, request.PlayerID) {
 		return
 	}
 
 	var err error
-	gh.update(func(g *Game) bool {
+	gh.update(req.Context(), func(g *Game) bool {
+		if g == nil {
+			err = errGameNotStarted
+			return false
+		}
+		won := g.Won
 		err = g.Discard(request.PlayerID, request.Index)
+		s.metrics.checkFinished(g, won)
 		return err == nil
 	})
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		log.Info("discard rejected", "index", request.Index, "err", err)
+		writeError(rw, moveErrorCode(err), err.Error())
 		return
 	}
-	writeGameForPlayer(rw, gh, request.PlayerID, true)
+	log.Debug("discard", "index", request.Index)
+	writeGameForPlayer(rw, gh, request.PlayerID)
 }
 
 func (s *Server) handleWebsocket(rw http.ResponseWriter, req *http.Request) {
@@ -277,42 +627,59 @@ func (s *Server) handleWebsocket(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	c, err := s.Upgrader.Upgrade(rw, req, nil)
+	gameID, err := ParseGameID(pathComponents[0])
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		writeError(rw, 400, err.Error())
 		return
 	}
-
-	gameID := pathComponents[0]
 	playerID := pathComponents[1]
 
-	var gh *GameHandle
-	func() {
-		s.mu.Lock()
-		defer s.mu.Unlock()
+	// Players join with /join, which creates a placeholder for games
+	// that haven't started, before connecting.
+	gh := s.getGame(gameID)
+	if gh == nil {
+		writeError(rw, 404, "Game ID not found")
+		return
+	}
+	defer s.releaseGame(gh)
+	if !s.authorize(rw, req, gh, playerID) {
+		return
+	}
 
-		var ok bool
-		gh, ok = s.games[gameID]
-		if !ok {
-			// create a temporary game so they can connect to it
-			gh = newHandle(nil, s.Store)
-			s.games[gameID] = gh
-		}
-	}()
+	c, err := s.Upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
 
-	gh.update(func(g *Game) bool {
+	// Subscribe first, so the update announcing the player is the
+	// first thing sent to them.
+	unsubscribe := s.broker.Subscribe(string(gameID), func(e GameEvent) {
+		pushToWebsocket(c, playerID, e)
+	})
+	update := gh.update
+	if s.isReadOnly() {
+		update = gh.updateUnsaved
+	}
+	update(req.Context(), func(g *Game) bool {
 		gh.websockets[playerID] = c
 		return true
 	})
+	atomic.AddInt64(&s.metrics.websockets, 1)
+	log := loggerFrom(req.Context()).With("game_id", gameID, "player_id", playerID)
+	log.Debug("websocket connected")
 
-	go gh.wsReadLoop(playerID, c)
-
-	sendGameThroughWs(gh)
+	go s.wsReadLoop(string(gameID), playerID, c, unsubscribe, log)
 }
 
 func (s *Server) handleNextGame(rw http.ResponseWriter, req *http.Request) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+
 	var request struct {
-		GameID          string   `json:"game_id"`
+		GameID          GameID   `json:"game_id"`
 		PlayerID        string   `json:"player_id"`
 		WordSet         []string `json:"word_set"`
 		CreateNew       bool     `json:"create_new"`
@@ -320,22 +687,44 @@ func (s *Server) handleNextGame(rw http.ResponseWriter, req *http.Request) {
 		EnforceTimer    bool     `json:"enforce_timer"`
 		HandSize        int      `json:"hand_size"`
 		BoardSize       int      `json:"board_size"`
+		WebhookURL      string   `json:"webhook_url"`
+		// Passcode makes a new game private. Later games in the room
+		// keep the first game's passcode; the host changes it with
+		// /passcode.
+		Passcode string `json:"passcode"`
 	}
 
-	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
-		http.Error(rw, "Error decoding", 400)
+	if !decodeJSON(rw, req, &request) {
+		return
+	}
+	if request.GameID == "" {
+		writeError(rw, 400, "game_id is required")
 		return
 	}
+	if err := validatePasscode(request.Passcode); err != nil {
+		writeError(rw, 400, err.Error())
+		return
+	}
+	if request.WebhookURL != "" {
+		if !s.AllowGameWebhooks {
+			writeError(rw, 400, "Game webhooks aren't enabled on this server")
+			return
+		}
+		if err := validateWebhookURL(request.WebhookURL); err != nil {
+			writeError(rw, 400, err.Error())
+			return
+		}
+	}
 	wordSet := map[string]bool{}
 	for _, w := range request.WordSet {
 		wordSet[strings.TrimSpace(strings.ToUpper(w))] = true
 	}
 	if len(wordSet) > 0 && len(wordSet) < 25 {
-		http.Error(rw, "Need at least 25 words", 400)
+		writeError(rw, 400, "Need at least 25 words")
 		return
 	}
-	if len(wordSet) > 10000 {
-		http.Error(rw, "Too many words in the set.", 400)
+	if len(wordSet) > s.maxWordSetWords() {
+		writeError(rw, 400, "Too many words in the set.")
 		return
 	}
 
@@ -344,13 +733,49 @@ func (s *Server) handleNextGame(rw http.ResponseWriter, req *http.Request) {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 
+		// Players join before starting a game, which creates a
+		// placeholder if it doesn't exist yet.
+		old := s.lookupLocked(request.GameID)
+		if old == nil {
+			writeError(rw, 404, "Game ID not found")
+			return
+		}
+		if !s.authorize(rw, req, old, request.PlayerID) {
+			return
+		}
+		// Copy what's needed of the old game, which requests for it
+		// may be changing.
+		old.mu.Lock()
+		host, hostNonce := old.hostLocked()
+		sessions := old.sessionsLocked()
+		var prev *Game
+		if old.g != nil {
+			copied := *old.g
+			prev = &copied
+		}
+		old.mu.Unlock()
+		if host != "" && host != request.PlayerID {
+			writeError(rw, http.StatusForbidden, "Only the host can start a new game")
+			return
+		}
+		locked := prev != nil && prev.Locked
+
 		words := s.defaultWords
-		if len(wordSet) > 0 {
+		if locked {
+			words = prev.WordSet
+		} else if len(wordSet) > 0 {
 			words = nil
 			for w := range wordSet {
 				words = append(words, w)
 			}
 			sort.Strings(words)
+			max := s.RateLimits.MaxWordSetBytes
+			if max > 0 && s.games.inUseBytes()+customWordSetBytes(words, nil) > max {
+				// Idle games would be evicted to make room, but
+				// games in use can't be.
+				writeTooManyRequests(rw, time.Minute, "Too many custom word sets in use; try again later")
+				return
+			}
 		}
 
 		opts := GameOptions{
@@ -358,37 +783,45 @@ func (s *Server) handleNextGame(rw http.ResponseWriter, req *http.Request) {
 			EnforceTimer:    request.EnforceTimer,
 			HandSize:        request.HandSize,
 			BoardSize:       request.BoardSize,
+			WebhookURL:      request.WebhookURL,
 		}
 
-		var ok bool
-		gh, ok = s.games[request.GameID]
-		if !ok || request.CreateNew || gh == nil {
+		if locked {
+			opts = prev.GameOptions
+		} else if opts.WebhookURL == "" && prev != nil {
+			// the next game keeps reporting to the same place
+			opts.WebhookURL = prev.WebhookURL
+		}
+		var g *Game
+		if request.CreateNew || prev == nil {
 			// no game exists, create for the first time
-			gh = newHandle(newGame(request.GameID, randomState(words, opts.BoardSize), opts), s.Store)
-			s.games[request.GameID] = gh
+			g = newGame(string(request.GameID), randomState(words, opts.BoardSize), opts)
 		} else {
-			replacedCh := gh.replaced
-
-			previousGame := gh.g
-
-			nextState := nextGameState(gh.g.GameState, gh.g.BoardSize)
-			gh = newHandle(newGame(request.GameID, nextState, opts), s.Store)
-			s.games[request.GameID] = gh
-
-			// signal to waiting /game-state goroutines that the
-			// old game was swapped out for a new game.
-			close(replacedCh)
-
-			// Delete the old game from the store. This isn't strictly
-			// necessary, but it helps us reclaim disk space a little more
-			// quickly.
-			err := s.Store.Delete(previousGame)
-			if err != nil {
-				log.Printf("Unable to delete old game %q from disk: %s\n", previousGame.ID, err)
+			// Saving the new game replaces the old one in the store.
+			g = newGame(string(request.GameID), nextGameState(prev.GameState, prev.BoardSize), opts)
+		}
+		// Players who joined stay joined, and the host stays host.
+		g.Sessions = sessions
+		g.Host, g.HostNonce, g.Locked = host, hostNonce, locked
+		if host == "" {
+			g.Host, g.HostNonce = request.PlayerID, randomHex(8)
+		}
+		if prev != nil {
+			g.PasscodeHash = prev.PasscodeHash
+		} else {
+			if request.Passcode != "" {
+				g.PasscodeHash = hashPasscode(request.Passcode)
 			}
 		}
+		gh = newHandle(string(request.GameID), g, s.Store, s.broker, s.Log)
+		s.replaceLocked(req.Context(), string(request.GameID), old, gh)
+		atomic.AddUint64(&s.metrics.gamesCreated, 1)
+		loggerFrom(req.Context()).Info("created game", "game_id", request.GameID, "player_id", request.PlayerID, "next", prev != nil && !request.CreateNew)
 	}()
-	writeGameForPlayer(rw, gh, request.PlayerID, false)
+	if gh == nil {
+		return
+	}
+	writeGameForPlayer(rw, gh, request.PlayerID)
 }
 
 type statsResponse struct {
@@ -397,6 +830,7 @@ type statsResponse struct {
 	GamesCreatedOneHour int   `json:"games_created_1h"`
 	RequestsTotal       int64 `json:"requests_total_process_lifetime"`
 	RequestsInFlight    int64 `json:"requests_in_flight"`
+	GameEventsTotal     int64 `json:"game_events_total_process_lifetime"`
 }
 
 func (s *Server) handleStats(rw http.ResponseWriter, req *http.Request) {
@@ -406,111 +840,285 @@ func (s *Server) handleStats(rw http.ResponseWriter, req *http.Request) {
 	defer s.mu.Unlock()
 
 	var inProgress, createdWithinAnHour int
-	for _, gh := range s.games {
+	s.games.each(func(_ string, gh *GameHandle) {
 		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		if gh.g == nil {
+			return
+		}
 		if gh.g.Won == false && gh.g.anyRevealed() {
 			inProgress++
 		}
 		if hourAgo.Before(gh.g.CreatedAt) {
 			createdWithinAnHour++
 		}
-		gh.mu.Unlock()
-	}
+	})
 	writeJSON(rw, statsResponse{
-		GamesTotal:          len(s.games),
+		GamesTotal:          s.games.len(),
 		GamesInProgress:     inProgress,
 		GamesCreatedOneHour: createdWithinAnHour,
 		RequestsTotal:       atomic.LoadInt64(&s.statTotalRequests),
 		RequestsInFlight:    atomic.LoadInt64(&s.statOpenRequests),
+		GameEventsTotal:     atomic.LoadInt64(&s.statGameEvents),
 	})
 }
 
+// GET /checkpoint returns a full backup. POST /checkpoint with the
+// checksums of files the client already has returns an incremental
+// one.
 func (s *Server) handleCheckpoint(rw http.ResponseWriter, req *http.Request) {
-	err := s.Store.Checkpoint(rw)
+	if req.Method != "GET" {
+		jsonEndpoint(maxCheckpointBodyBytes, s.handleIncrementalCheckpoint)(rw, req)
+		return
+	}
+	s.writeCheckpoint(rw, req, nil)
+}
+
+func (s *Server) handleIncrementalCheckpoint(rw http.ResponseWriter, req *http.Request) {
+	var request struct {
+		Have []string `json:"have"`
+	}
+	if !decodeJSON(rw, req, &request) {
+		return
+	}
+	have := make(map[string]bool, len(request.Have))
+	for _, sum := range request.Have {
+		have[sum] = true
+	}
+	s.writeCheckpoint(rw, req, have)
+}
+
+func (s *Server) writeCheckpoint(rw http.ResponseWriter, req *http.Request, have map[string]bool) {
+	err := s.Store.Checkpoint(rw, have)
 	if err != nil {
-		log.Printf("[ERROR] Write checkpoint %s\n", err)
+		loggerFrom(req.Context()).Error("write checkpoint", "err", err)
+	}
+}
+
+func (s *Server) maxCachedGames() int {
+	if s.MaxCachedGames > 0 {
+		return s.MaxCachedGames
+	}
+	return DefaultMaxCachedGames
+}
+
+func (s *Server) longPollTimeout() time.Duration {
+	if s.LongPollTimeout > 0 {
+		return s.LongPollTimeout
+	}
+	return DefaultLongPollTimeout
+}
+
+func (s *Server) maxWordSetWords() int {
+	if s.MaxWordSetWords > 0 {
+		return s.MaxWordSetWords
+	}
+	return DefaultMaxWordSetWords
+}
+
+func (s *Server) retention() time.Duration {
+	if s.Retention > 0 {
+		return s.Retention
 	}
+	return DefaultRetention
 }
 
-func (s *Server) cleanupOldGames() {
+// isExpired reports whether the handle's game has had no activity
+// since expiry. Placeholder handles have no game; they expire once
+// every websocket has disconnected and nobody has joined since expiry.
+func (gh *GameHandle) isExpired(expiry time.Time) bool {
+	if gh.g == nil {
+		return len(gh.websockets) == 0 && gh.pendingSince.Before(expiry)
+	}
+	return gh.g.UpdatedAt.Before(expiry)
+}
+
+// expireGames removes every game whose last update happened more
+// than the retention period before now, from memory and from the
+// store. The store is swept without the server lock, since it reads
+// every game. Lookups don't load expired games from the store, so
+// none can come back in between, and the store checks each game's
+// UpdatedAt as it deletes it, so a game saved since is kept.
+func (s *Server) expireGames(now time.Time) error {
+	expiry := now.Add(-s.retention())
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	for id, gh := range s.games {
+	s.games.each(func(id string, gh *GameHandle) {
 		gh.mu.Lock()
-		if gh.g.Won == false && gh.g.CreatedAt.Add(3*time.Hour).Before(time.Now()) {
-			delete(s.games, id)
-			log.Printf("Removed completed game %s\n", id)
-		} else if gh.g.CreatedAt.Add(72 * time.Hour).Before(time.Now()) {
-			delete(s.games, id)
-			log.Printf("Removed expired game %s\n", id)
+		defer gh.mu.Unlock()
+		if gh.isExpired(expiry) {
+			gh.expired = true
+			s.games.remove(id)
+			gh.log.Info("removed expired game")
 		}
-		gh.mu.Unlock()
+	})
+	s.mu.Unlock()
+	return s.Store.DeleteExpired(expiry)
+}
+
+func (s *Server) Start() error {
+	if err := s.setup(); err != nil {
+		return err
 	}
+	if s.Follow != "" {
+		s.startFollowing()
+	}
+
+	go func() {
+		for now := range time.Tick(10 * time.Minute) {
+			if err := s.expireGames(now); err != nil {
+				s.Log.Error("expire games", "err", err)
+			}
+		}
+	}()
+
+	if s.TLSCertFile != "" {
+		return s.listenAndServeTLS()
+	}
+	return s.Server.ListenAndServe()
 }
 
-func (s *Server) Start(games map[string]*Game) error {
-	gameIDs, err := dictionary.Load("assets/game-id-words.txt")
+// setup loads the server's assets and builds its handler.
+func (s *Server) setup() error {
+	if s.Log == nil {
+		s.Log = NewLogger(os.Stderr, LevelInfo, false)
+	}
+	assets := s.assets()
+	var gameIDs dictionary.Interface
+	var err error
+	if s.GameIDWords != "" {
+		gameIDs, err = dictionary.Load(s.GameIDWords)
+	} else {
+		gameIDs, err = loadDictionary(assets, "game-id-words.txt")
+	}
 	if err != nil {
 		return err
 	}
-	d, err := dictionary.Load("assets/original.txt")
+	d, err := loadDictionary(assets, "original.txt")
 	if err != nil {
 		return err
 	}
-	s.tpl, err = template.New("index").Parse(tpl)
+	s.tpl, err = template.ParseFS(assets, "index.html")
 	if err != nil {
 		return err
 	}
+	static := s.static()
+	if _, err := fs.Stat(static, "app.js"); err != nil {
+		s.Log.Warn("the frontend isn't built; run frontend/build.sh before building the binary", "err", err)
+	}
+
+	s.sessionKey = []byte(s.SessionSecret)
+	if s.SessionSecret == "" {
+		s.Log.Warn("no session secret is set; players won't be able to resume their sessions after a restart")
+		s.sessionKey = make([]byte, 32)
+		if _, err := rand.Read(s.sessionKey); err != nil {
+			return err
+		}
+	}
 
+	s.metrics = newMetrics()
 	s.mux = http.NewServeMux()
-	s.mux.HandleFunc("/stats", s.handleStats)
-	s.mux.HandleFunc("/next-game", s.handleNextGame)
-	s.mux.HandleFunc("/guess", s.handleGuess)
-	s.mux.HandleFunc("/discard", s.handleDiscard)
-	s.mux.HandleFunc("/game-state", s.handleGameState)
-	s.mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("frontend/dist"))))
-	s.mux.HandleFunc("/", s.handleIndex)
+	s.mux.HandleFunc("/stats", s.instrument("stats", s.handleStats))
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/join", s.instrument("join", jsonEndpoint(maxRequestBodyBytes, s.handleJoin)))
+	s.mux.HandleFunc("/passcode", s.instrument("passcode", jsonEndpoint(maxRequestBodyBytes, s.handlePasscode)))
+	s.mux.HandleFunc("/kick", s.instrument("kick", jsonEndpoint(maxRequestBodyBytes, s.handleKick)))
+	s.mux.HandleFunc("/transfer-host", s.instrument("transfer_host", jsonEndpoint(maxRequestBodyBytes, s.handleTransferHost)))
+	s.mux.HandleFunc("/lock", s.instrument("lock", jsonEndpoint(maxRequestBodyBytes, s.handleLock)))
+	s.mux.HandleFunc("/next-game", s.instrument("next_game", jsonEndpoint(s.maxNextGameBodyBytes(), s.handleNextGame)))
+	s.mux.HandleFunc("/guess", s.instrument("guess", jsonEndpoint(maxRequestBodyBytes, s.handleGuess)))
+	s.mux.HandleFunc("/discard", s.instrument("discard", jsonEndpoint(maxRequestBodyBytes, s.handleDiscard)))
+	s.mux.HandleFunc("/game-state", s.instrument("game_state", jsonEndpoint(maxRequestBodyBytes, s.handleGameState)))
+	s.mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	s.mux.HandleFunc("/", s.instrument("index", s.handleIndex))
 	s.mux.HandleFunc("/websocket/", s.handleWebsocket)
 
-	bootstrapPW := os.Getenv("BOOTSTRAPPW")
-	// If no bootstrap PW is set, don't expose the checkpoint endpoint so we
-	// don't default to open.
+	bootstrapPW := s.BootstrapPassword
+	adminCreds := s.adminCredentials(bootstrapPW)
+	// If no bootstrap PW is set, don't expose the checkpoint or
+	// replication endpoints so we don't default to open.
 	if bootstrapPW != "" {
-		log.Printf("/checkpoint endpoint enabled\n")
+		s.Log.Info("/checkpoint and /replication endpoints enabled")
 		s.mux.Handle("/checkpoint", basicAuth(
 			http.HandlerFunc(s.handleCheckpoint),
-			os.Getenv("BOOTSTRAPPW"),
-			"admin"))
+			"admin", RoleAdmin, adminCreds...))
+		s.mux.Handle("/replication/stream", basicAuth(
+			http.HandlerFunc(s.handleReplicationStream),
+			"admin", RoleAdmin, adminCreds...))
+		s.mux.Handle("/replication/promote", basicAuth(
+			http.HandlerFunc(s.handlePromote),
+			"admin", RoleAdmin, adminCreds...))
+		s.mux.Handle("/webhooks/deliveries", basicAuth(
+			http.HandlerFunc(s.handleWebhookDeliveries),
+			"admin", RoleAdmin, adminCreds...))
 	}
+	s.setupAdmin(adminCreds)
 
-	gameIDs = dictionary.Filter(gameIDs, func(s string) bool { return len(s) >= 3 })
-	s.gameIDWords = gameIDs.Words()
-	for i, w := range s.gameIDWords {
-		s.gameIDWords[i] = strings.ToLower(w)
+	entropy := s.GameIDEntropy
+	if entropy == 0 {
+		entropy = DefaultGameIDEntropy
+	}
+	s.gameIDWords, s.gameIDWordCount, err = gameIDWordsFor(gameIDs.Words(), entropy)
+	if err != nil {
+		return err
 	}
 
-	s.games = make(map[string]*GameHandle)
+	s.games = newGameCache(s.maxCachedGames())
+	s.deleting = make(map[string]bool)
+	s.loading = make(map[string]chan struct{})
+	s.games.sizeOf = s.wordSetBytes
+	s.games.maxBytes = s.RateLimits.MaxWordSetBytes
+	s.limiter = newRateLimiter(s.RateLimits, s.Cluster != nil, s.maxNextGameBodyBytes())
 	s.defaultWords = d.Words()
 	sort.Strings(s.defaultWords)
-	s.Server.Handler = withPProfHandler(s)
+	s.Server.Handler = withPProfHandler(s, s.PprofPassword)
 
 	if s.Store == nil {
 		s.Store = discardStore{}
 	}
-
-	if games != nil {
-		for _, g := range games {
-			s.games[g.ID] = newHandle(g, s.Store)
+	s.feed = newChangeFeed(s.Store, s.Log)
+	s.Store = metricsStore{Store: s.feed, m: s.metrics}
+	if s.Broker == nil {
+		s.Broker = NewMemoryBroker(s.Log)
+	}
+	s.broker = s.Broker
+	s.broker.Subscribe("", func(GameEvent) {
+		atomic.AddInt64(&s.statGameEvents, 1)
+	})
+	if s.Cluster != nil {
+		if s.ClusterSecret == "" {
+			return errors.New("a cluster requires a cluster secret")
 		}
+		s.router = newRouter(s.Cluster, s.ClusterSecret, s.maxNextGameBodyBytes(), s.Log)
+		s.mux.HandleFunc(gameExistsPath, s.instrument("game_exists", s.handleGameExists))
 	}
-
-	go func() {
-		for range time.Tick(10 * time.Minute) {
-			s.cleanupOldGames()
+	if len(s.Webhooks) > 0 || s.AllowGameWebhooks {
+		if s.WebhookSecret == "" {
+			return errors.New("webhooks require a webhook secret")
 		}
-	}()
+		for _, u := range s.Webhooks {
+			if err := validateWebhookURL(u); err != nil {
+				return err
+			}
+		}
+		s.webhooks = newWebhookDispatcher(s.Webhooks, s.WebhookSecret, s.retention(), s.Log)
+		s.broker.Subscribe("", func(e GameEvent) {
+			if e.Type == GameNotice {
+				return
+			}
+			s.webhooks.observe(e, !s.isReadOnly())
+		})
+	}
+	return nil
+}
 
-	return s.Server.ListenAndServe()
+// startFollowing puts the server in read-only mode and starts
+// tailing the primary at s.Follow.
+func (s *Server) startFollowing() {
+	atomic.StoreInt32(&s.readOnly, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopFollowing = cancel
+	go s.follow(ctx, s.Follow, s.BootstrapPassword)
 }
 
 func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -518,17 +1126,57 @@ func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	atomic.AddInt64(&s.statOpenRequests, 1)
 	defer func() { atomic.AddInt64(&s.statOpenRequests, -1) }()
 
+	// Keep the caller's request ID, if any, so one request can be
+	// followed across nodes.
+	requestID := req.Header.Get(requestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = newRequestID()
+		req.Header.Set(requestIDHeader, requestID)
+	}
+	rw.Header().Set(requestIDHeader, requestID)
+	if req.TLS != nil && s.HSTSMaxAge > 0 {
+		rw.Header().Set("Strict-Transport-Security", "max-age="+strconv.FormatInt(int64(s.HSTSMaxAge/time.Second), 10))
+	}
+	ctx := withLogger(req.Context(), s.Log.With("request_id", requestID))
+	ctx = withTracer(withRemoteParent(ctx, req), s.Tracer)
+	req = req.WithContext(ctx)
+
+	if s.router != nil {
+		s.router.authenticateForward(req)
+	}
+	if !s.limiter.allowRequest(rw, req) {
+		return
+	}
+	if s.router != nil && s.router.route(rw, req, s.limiter.clientIP(req)) {
+		return
+	}
+	if !s.limiter.allowGameRequest(rw, req) {
+		return
+	}
+	// Forwarded responses already have these from the node that
+	// served them.
+	setSecurityHeaders(rw.Header())
 	s.mux.ServeHTTP(rw, req)
 }
 
-func withPProfHandler(next http.Handler) http.Handler {
+// instrument wraps the handler h, named name, in a span and records
+// its latency.
+func (s *Server) instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return s.metrics.instrument(name, func(rw http.ResponseWriter, req *http.Request) {
+		ctx, span := startSpan(req.Context(), "http."+name, "http.method", req.Method, "http.path", req.URL.Path)
+		defer span.End()
+		h(rw, req.WithContext(ctx))
+	})
+}
+
+func withPProfHandler(next http.Handler, password string) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	pprofHandler := basicAuth(mux, os.Getenv("PPROFPW"), "admin")
+	pprofHandler := basicAuth(mux, "admin", RoleAdmin, passwordCredential(password))
 
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		if strings.HasPrefix(req.URL.Path, "/debug/pprof") {
@@ -539,49 +1187,66 @@ func withPProfHandler(next http.Handler) http.Handler {
 	})
 }
 
-func basicAuth(handler http.Handler, password, realm string) http.Handler {
-	p := []byte(password)
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, pass, ok := r.BasicAuth()
-		if !ok || subtle.ConstantTimeCompare([]byte(pass), p) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
-			w.WriteHeader(401)
-			io.WriteString(w, "Unauthorized\n")
-			return
-		}
-		handler.ServeHTTP(w, r)
-	})
+func writeGameForPlayer(rw http.ResponseWriter, gh *GameHandle, playerID string) {
+	gh.mu.Lock()
+	if gh.g == nil {
+		gh.mu.Unlock()
+		writeError(rw, moveErrorCode(errGameNotStarted), errGameNotStarted.Error())
+		return
+	}
+	gameCopy := gh.g.ClientCopy(playerID, gh.getPlayerIDs())
+	gh.mu.Unlock()
+	writeJSON(rw, gameCopy)
 }
 
-func writeGameForPlayer(rw http.ResponseWriter, gh *GameHandle, playerID string, notify bool) {
-	playerIDs := gh.getPlayerIDs()
-	gameCopy := gh.g.ClientCopy(playerID, playerIDs)
-	writeJSON(rw, gameCopy)
+// errGameNotStarted is the error for requests about a game players
+// have joined but that nobody has started yet.
+var errGameNotStarted = errors.New("The game hasn't started yet")
 
-	if notify {
-		sendGameThroughWs(gh)
+// moveErrorCode returns the status for an error from a move.
+func moveErrorCode(err error) int {
+	if err == errGameNotStarted {
+		return http.StatusConflict
 	}
+	return 400
 }
 
-func sendGameThroughWs(gh *GameHandle) {
-	playerIDs := gh.getPlayerIDs()
-	for key, val := range gh.websockets {
-		if val == nil {
-			continue
-		}
-
-		gameCopy := Game{}
-		if gh.g != nil {
-			gameCopy = gh.g.ClientCopy(key, playerIDs)
-		} else {
-			gameCopy.PlayerIDs = playerIDs
-		}
-		data, err := json.Marshal(gameCopy)
-		if err == nil {
-			val.WriteMessage(1, data)
-		}
+// pushToWebsocket sends a player their view of the game in e. Each
+// connection has its own subscription, so there's never more than
+// one writer per connection.
+func pushToWebsocket(c *websocket.Conn, playerID string, e GameEvent) {
+	_, span := e.tracer.startWithParent(context.Background(), e.trace, "websocket.push", "game_id", e.GameID, "player_id", playerID)
+	defer span.End()
+
+	var msg interface{}
+	switch {
+	case e.Type == GameNotice:
+		msg = noticeMessage{Notice: e.Notice}
+	case e.Game != nil:
+		msg = e.Game.ClientCopy(playerID, e.PlayerIDs)
+	default:
+		msg = Game{GameClientInfo: GameClientInfo{PlayerIDs: e.PlayerIDs}}
 	}
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = c.WriteMessage(websocket.TextMessage, data)
+	}
+	span.RecordError(err)
+}
+
+// noticeMessage is sent over websockets for GameNotice events, in
+// place of the game.
+type noticeMessage struct {
+	Notice string `json:"notice"`
+}
+
+// closeWebsocket tells the player why their connection is being
+// closed, then closes it. Unlike other writes, it's safe while the
+// connection's subscription may be writing.
+func closeWebsocket(c *websocket.Conn, reason string) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.Close()
 }
 
 func writeBytes(rw http.ResponseWriter, data []byte) {
@@ -592,7 +1257,7 @@ func writeBytes(rw http.ResponseWriter, data []byte) {
 func writeJSON(rw http.ResponseWriter, resp interface{}) {
 	j, err := json.Marshal(resp)
 	if err != nil {
-		http.Error(rw, "unable to marshal response: "+err.Error(), 500)
+		writeError(rw, 500, "unable to marshal response: "+err.Error())
 		return
 	}
 
@@ -0,0 +1,200 @@
+package crossclues
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// memStore is an in-memory Store used to observe what the server
+// persists.
+type memStore struct {
+	discardStore
+	mu    sync.Mutex
+	games map[string]*Game
+}
+
+func newMemStore() *memStore {
+	return &memStore{games: make(map[string]*Game)}
+}
+
+func (ms *memStore) Load(id string) (*Game, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	g, ok := ms.games[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *g
+	return &copied, nil
+}
+
+func (ms *memStore) Save(g *Game) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if g != nil {
+		copied := *g
+		ms.games[g.ID] = &copied
+	}
+	return nil
+}
+
+func (ms *memStore) Delete(g *Game) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if g != nil {
+		delete(ms.games, g.ID)
+	}
+	return nil
+}
+
+func (ms *memStore) DeleteExpired(expiry time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, g := range ms.games {
+		if g.UpdatedAt.Before(expiry) {
+			delete(ms.games, id)
+		}
+	}
+	return nil
+}
+
+func newTestServer(store Store) *Server {
+	return &Server{
+		Store:        store,
+		games:        newGameCache(DefaultMaxCachedGames),
+		deleting:     make(map[string]bool),
+		loading:      make(map[string]chan struct{}),
+		defaultWords: words,
+		broker:       NewMemoryBroker(nil),
+		metrics:      newMetrics(),
+	}
+}
+
+func TestExpireGames(t *testing.T) {
+	store := newMemStore()
+	s := newTestServer(store)
+	s.Retention = time.Hour
+
+	now := time.Now()
+	expiry := now.Add(-s.Retention)
+	updates := map[string]time.Time{
+		"fresh":       now,
+		"at-cutoff":   expiry,
+		"past-cutoff": expiry.Add(-time.Nanosecond),
+		// Won games follow the same rule as games in progress.
+		"won-idle": now.Add(-2 * time.Hour),
+	}
+	for id, updatedAt := range updates {
+		g := newGame(id, randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})
+		// Created long ago, so only last activity should matter.
+		g.CreatedAt = now.Add(-100 * time.Hour)
+		g.UpdatedAt = updatedAt
+		g.Won = id == "won-idle"
+		s.games.put(id, newHandle(id, g, store, nil, nil))
+	}
+
+	// A placeholder created by a websocket with nobody connected
+	// anymore, and one that still has a connection.
+	s.games.put("placeholder-empty", newHandle("placeholder-empty", nil, store, nil, nil))
+	connected := newHandle("placeholder-connected", nil, store, nil, nil)
+	connected.websockets["player"] = &websocket.Conn{}
+	s.games.put("placeholder-connected", connected)
+	// Placeholders players joined recently and too long ago.
+	for id, joined := range map[string]time.Time{"placeholder-joined": now, "placeholder-abandoned": expiry.Add(-time.Nanosecond)} {
+		gh := newHandle(id, nil, store, nil, nil)
+		gh.setSessionLocked("player", "nonce")
+		gh.pendingSince = joined
+		s.games.put(id, gh)
+	}
+
+	if err := s.expireGames(now); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"fresh":                 true,
+		"at-cutoff":             true,
+		"past-cutoff":           false,
+		"won-idle":              false,
+		"placeholder-empty":     false,
+		"placeholder-connected": true,
+		"placeholder-joined":    true,
+		"placeholder-abandoned": false,
+	}
+	for id, kept := range want {
+		if _, ok := s.games.get(id); ok != kept {
+			t.Errorf("game %q in memory = %t, want %t", id, ok, kept)
+		}
+		if _, isGame := updates[id]; !isGame {
+			// placeholders are never saved
+			continue
+		}
+		if _, ok := store.games[id]; ok != kept {
+			t.Errorf("game %q in store = %t, want %t", id, ok, kept)
+		}
+	}
+}
+
+func TestExpiredHandleNotResaved(t *testing.T) {
+	store := newMemStore()
+	s := newTestServer(store)
+
+	g := newGame("idle", randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})
+	g.UpdatedAt = time.Now().Add(-2 * DefaultRetention)
+	gh := newHandle(g.ID, g, store, nil, nil)
+	s.games.put(g.ID, gh)
+
+	if err := s.expireGames(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that looked the handle up before it expired must not
+	// write the game back to the store.
+	gh.update(context.Background(), func(g *Game) bool {
+		g.UpdatedAt = time.Now()
+		return true
+	})
+	if _, ok := store.games[g.ID]; ok {
+		t.Errorf("expired game %q was saved to the store again", g.ID)
+	}
+}
+
+func TestGetGameLoadsEvicted(t *testing.T) {
+	store := newMemStore()
+	s := newTestServer(store)
+	s.games = newGameCache(2)
+
+	opts := GameOptions{BoardSize: DefaultBoardSize, HandSize: 1}
+	for _, id := range []string{"a", "b", "c"} {
+		s.games.put(id, newHandle(id, newGame(id, randomState(words, DefaultBoardSize), opts), store, nil, nil))
+	}
+	if s.games.len() != 2 {
+		t.Fatalf("cache holds %d games, want 2", s.games.len())
+	}
+	if _, ok := s.games.get("a"); ok {
+		t.Fatalf("least recently used game wasn't evicted")
+	}
+
+	gh := s.getGame("a")
+	if gh == nil {
+		t.Fatalf("evicted game wasn't loaded from the store")
+	}
+	if gh.g.ID != "a" {
+		t.Errorf("loaded game %q, want %q", gh.g.ID, "a")
+	}
+	if s.getGame("missing") != nil {
+		t.Errorf("getGame returned a game that doesn't exist")
+	}
+
+	// Games idle past the retention period aren't loaded, even if
+	// they haven't been deleted from the store yet.
+	store.games["b"].UpdatedAt = time.Now().Add(-2 * DefaultRetention)
+	s.games.remove("b")
+	if s.getGame("b") != nil {
+		t.Errorf("getGame loaded an expired game")
+	}
+}
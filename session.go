@@ -0,0 +1,290 @@
+package crossclues
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionHeader carries a player's session token on API requests.
+// Browsers can't set headers on websockets, so they pass it in the
+// session query parameter instead.
+const sessionHeader = "X-Crossclues-Session"
+
+// sessionClaims is the signed content of a session token. Nonce must
+// match the game's Sessions entry for the player, so a token stops
+// working if the player's session is removed, and a token from an
+// expired game doesn't carry over to a new game with the same ID.
+//
+// Host tokens are signed the same way, with Host set, no player ID
+// and the game's HostNonce.
+type sessionClaims struct {
+	GameID   string `json:"g"`
+	PlayerID string `json:"p,omitempty"`
+	Nonce    string `json:"n"`
+	Host     bool   `json:"h,omitempty"`
+}
+
+var errInvalidSession = errors.New("invalid session token")
+
+// signSession returns a token of the form payload.signature, both
+// base64url encoded.
+func (s *Server) signSession(c sessionClaims) string {
+	payload, _ := json.Marshal(c)
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	return enc + "." + base64.RawURLEncoding.EncodeToString(s.sessionMAC(enc))
+}
+
+func (s *Server) sessionMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// parseSession verifies token's signature and returns its claims.
+func (s *Server) parseSession(token string) (sessionClaims, error) {
+	var c sessionClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return c, errInvalidSession
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, s.sessionMAC(parts[0])) {
+		return c, errInvalidSession
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(payload, &c) != nil {
+		return c, errInvalidSession
+	}
+	return c, nil
+}
+
+func sessionToken(req *http.Request) string {
+	if t := req.Header.Get(sessionHeader); t != "" {
+		return t
+	}
+	return req.URL.Query().Get("session")
+}
+
+// sessionNonceLocked returns the nonce of playerID's session, if
+// they've joined. Players can join a placeholder before the game is
+// created, so their sessions are kept on the handle until it is.
+// gh.mu must be held.
+func (gh *GameHandle) sessionNonceLocked(playerID string) (string, bool) {
+	sessions := gh.pendingSessions
+	if gh.g != nil {
+		sessions = gh.g.Sessions
+	}
+	nonce, ok := sessions[playerID]
+	return nonce, ok
+}
+
+// setSessionLocked records the nonce of playerID's session. gh.mu
+// must be held.
+func (gh *GameHandle) setSessionLocked(playerID, nonce string) {
+	if gh.g == nil {
+		if gh.pendingSessions == nil {
+			gh.pendingSessions = make(map[string]string)
+		}
+		gh.pendingSessions[playerID] = nonce
+		gh.pendingSince = time.Now()
+		return
+	}
+	if gh.g.Sessions == nil {
+		gh.g.Sessions = make(map[string]string)
+	}
+	gh.g.Sessions[playerID] = nonce
+}
+
+// deleteSessionLocked ends playerID's session. gh.mu must be held.
+func (gh *GameHandle) deleteSessionLocked(playerID string) {
+	if gh.g == nil {
+		delete(gh.pendingSessions, playerID)
+		return
+	}
+	delete(gh.g.Sessions, playerID)
+}
+
+// sessionsLocked returns a copy of the sessions of the players who
+// have joined. gh.mu must be held.
+func (gh *GameHandle) sessionsLocked() map[string]string {
+	if gh.g != nil {
+		return copySessions(gh.g.Sessions)
+	}
+	return copySessions(gh.pendingSessions)
+}
+
+func copySessions(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// authorize reports whether req carries a session token for playerID
+// in the game held by gh. If it doesn't, it writes a 401 or 403.
+func (s *Server) authorize(rw http.ResponseWriter, req *http.Request, gh *GameHandle, playerID string) bool {
+	token := sessionToken(req)
+	if token == "" {
+		writeError(rw, http.StatusUnauthorized, "Join the game first; no session token")
+		return false
+	}
+	c, err := s.parseSession(token)
+	if err != nil {
+		writeError(rw, http.StatusUnauthorized, "Session token is invalid; join the game again")
+		return false
+	}
+	if c.Host || c.GameID != gh.id || c.PlayerID != playerID {
+		writeError(rw, http.StatusForbidden, "Session token is for another game or player")
+		return false
+	}
+	gh.mu.Lock()
+	nonce, ok := gh.sessionNonceLocked(playerID)
+	gh.mu.Unlock()
+	if !ok || !hmac.Equal([]byte(nonce), []byte(c.Nonce)) {
+		writeError(rw, http.StatusUnauthorized, "Session has ended; join the game again")
+		return false
+	}
+	return true
+}
+
+type joinResponse struct {
+	PlayerID     string `json:"player_id"`
+	SessionToken string `json:"session_token"`
+	// HostToken is given to the host. Presenting it when joining
+	// makes that player the host, e.g. on another device.
+	HostToken string `json:"host_token,omitempty"`
+}
+
+// POST /join
+//
+// handleJoin issues a session token binding a player ID to a game.
+// The first player to join with an ID claims it. Later requests for
+// the same ID must present that player's token, and get it back, so
+// a player keeps their session across page reloads. Joining a private
+// game takes its passcode, except to resume a session or with the
+// host token. The first player to join a game becomes its host.
+func (s *Server) handleJoin(rw http.ResponseWriter, req *http.Request) {
+	if s.isReadOnly() {
+		writeReadOnly(rw)
+		return
+	}
+
+	var request struct {
+		GameID    GameID `json:"game_id"`
+		PlayerID  string `json:"player_id"`
+		Passcode  string `json:"passcode"`
+		HostToken string `json:"host_token"`
+	}
+	if !decodeJSON(rw, req, &request) {
+		return
+	}
+	if request.GameID == "" || request.PlayerID == "" {
+		writeError(rw, 400, "game_id and player_id are required")
+		return
+	}
+	var presentedHost string
+	if request.HostToken != "" {
+		c, err := s.parseSession(request.HostToken)
+		if err != nil || !c.Host || c.GameID != string(request.GameID) {
+			writeError(rw, http.StatusForbidden, "Host token is invalid")
+			return
+		}
+		presentedHost = c.Nonce
+	}
+
+	var gh *GameHandle
+	func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		gh = s.lookupLocked(request.GameID)
+		if gh == nil && s.limiter.allowNewGame(rw, req) {
+			// create a temporary game so they can join it before
+			// it's started
+			gh = newHandle(string(request.GameID), nil, s.Store, s.broker, s.Log)
+			s.games.put(string(request.GameID), gh)
+		}
+		if gh != nil {
+			gh.users++
+		}
+	}()
+	if gh == nil {
+		return
+	}
+	defer s.releaseGame(gh)
+
+	var presented string
+	if token := sessionToken(req); token != "" {
+		c, err := s.parseSession(token)
+		if err == nil && !c.Host && c.GameID == string(request.GameID) && c.PlayerID == request.PlayerID {
+			presented = c.Nonce
+		}
+	}
+
+	var nonce, hostNonce string
+	var taken, resumed, denied bool
+	gh.update(req.Context(), func(g *Game) bool {
+		host, currentHostNonce := gh.hostLocked()
+		// A host token stops working once the host is transferred.
+		claimsHost := presentedHost != "" && hmac.Equal([]byte(presentedHost), []byte(currentHostNonce))
+
+		var changed bool
+		if existing, ok := gh.sessionNonceLocked(request.PlayerID); ok {
+			nonce = existing
+			resumed = hmac.Equal([]byte(existing), []byte(presented))
+			if taken = !resumed; taken {
+				return false
+			}
+		} else {
+			if hash := gh.passcodeHashLocked(); hash != "" && !claimsHost && !checkPasscode(hash, request.Passcode) {
+				denied = true
+				return false
+			}
+			nonce = randomHex(8)
+			gh.setSessionLocked(request.PlayerID, nonce)
+			changed = true
+		}
+		if host == "" || claimsHost && host != request.PlayerID {
+			gh.setHostLocked(request.PlayerID, currentHostNonce)
+			host, currentHostNonce = gh.hostLocked()
+			changed = true
+		}
+		if host == request.PlayerID {
+			hostNonce = currentHostNonce
+		}
+		// nothing to save until a placeholder's game is created
+		return changed && g != nil
+	})
+	switch {
+	case denied:
+		loggerFrom(req.Context()).Info("join denied: wrong passcode", "game_id", request.GameID, "player_id", request.PlayerID)
+		writeError(rw, http.StatusForbidden, "This game is private; the passcode is missing or wrong")
+		return
+	case nonce == "":
+		// the game expired in the meantime
+		writeError(rw, 404, "Game ID not found")
+		return
+	case taken:
+		writeError(rw, http.StatusConflict, "Another player in this game is using that name")
+		return
+	}
+	loggerFrom(req.Context()).Debug("joined", "game_id", request.GameID, "player_id", request.PlayerID, "resumed", resumed, "host", hostNonce != "")
+	resp := joinResponse{
+		PlayerID:     request.PlayerID,
+		SessionToken: s.signSession(sessionClaims{GameID: string(request.GameID), PlayerID: request.PlayerID, Nonce: nonce}),
+	}
+	if hostNonce != "" {
+		resp.HostToken = s.signSession(sessionClaims{GameID: string(request.GameID), Nonce: hostNonce, Host: true})
+	}
+	writeJSON(rw, resp)
+}
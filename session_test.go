@@ -0,0 +1,112 @@
+package crossclues
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// join joins the game on the server at baseURL and returns the
+// player's session token.
+func join(t *testing.T, baseURL, gameID, playerID string) string {
+	t.Helper()
+	var resp joinResponse
+	code := postJSON(t, baseURL+"/join", map[string]interface{}{"game_id": gameID, "player_id": playerID}, &resp)
+	if code != 200 || resp.SessionToken == "" {
+		t.Fatalf("/join as %s returned %d, %+v", playerID, code, resp)
+	}
+	return resp.SessionToken
+}
+
+func TestSessions(t *testing.T) {
+	s := &Server{Store: newMemStore(), SessionSecret: "secret"}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "private", "alice")
+	bob := join(t, ts.URL, "private", "bob")
+	start := map[string]interface{}{"game_id": "private", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize}
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, start, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+
+	// Rejoining needs the player's token, and gets the same one back.
+	aliceJoin := map[string]interface{}{"game_id": "private", "player_id": "alice"}
+	if code := postJSON(t, ts.URL+"/join", aliceJoin, nil); code != http.StatusConflict {
+		t.Errorf("joining as alice without her token returned %d, want 409", code)
+	}
+	var rejoined joinResponse
+	if code := postJSONAs(t, ts.URL+"/join", alice, aliceJoin, &rejoined); code != 200 || rejoined.SessionToken != alice {
+		t.Errorf("rejoining returned %d, %+v", code, rejoined)
+	}
+
+	other := &Server{sessionKey: []byte("other secret")}
+	forged := other.signSession(sessionClaims{GameID: "private", PlayerID: "alice", Nonce: "0000000000000000"})
+	asAlice := map[string]interface{}{"game_id": "private", "player_id": "alice"}
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"garbage", "not-a-token", http.StatusUnauthorized},
+		{"other secret", forged, http.StatusUnauthorized},
+		{"bob's token", bob, http.StatusForbidden},
+		{"alice's token", alice, 200},
+	} {
+		if code := postJSONAs(t, ts.URL+"/game-state", tc.token, asAlice, nil); code != tc.want {
+			t.Errorf("%s: /game-state as alice returned %d, want %d", tc.name, code, tc.want)
+		}
+	}
+
+	// Sessions carry over to the next game.
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{"game_id": "private", "player_id": "alice"}, nil); code != 200 {
+		t.Fatalf("/next-game as alice returned %d", code)
+	}
+	if code := postJSONAs(t, ts.URL+"/game-state", alice, asAlice, nil); code != 200 {
+		t.Errorf("/game-state after the next game returned %d", code)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/websocket/private/alice"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("websocket without a session: %v, %+v; want a 401", err, resp)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?session="+alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestMovesBeforeStart(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// The game page joins, then polls, before the host has started.
+	alice := join(t, ts.URL, "lobby-room", "alice")
+	for _, path := range []string{"/game-state", "/guess", "/discard"} {
+		body := map[string]interface{}{"game_id": "lobby-room", "player_id": "alice"}
+		if code := postJSONAs(t, ts.URL+path, alice, body, nil); code != http.StatusConflict {
+			t.Errorf("%s before the game started returned %d, want 409", path, code)
+		}
+	}
+
+	start := map[string]interface{}{"game_id": "lobby-room", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize}
+	if code := postJSONAs(t, ts.URL+"/next-game", alice, start, nil); code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	var g Game
+	if code := postJSONAs(t, ts.URL+"/game-state", alice, map[string]interface{}{"game_id": "lobby-room", "player_id": "alice"}, &g); code != 200 || g.ID != "lobby-room" {
+		t.Fatalf("/game-state after the start returned %d, game %q", code, g.ID)
+	}
+}
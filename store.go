@@ -1,16 +1,15 @@
 package crossclues
 
 import (
-	"compress/gzip"
-	"encoding/gob"
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/pebble"
@@ -18,27 +17,51 @@ import (
 
 // PebbleStore wraps a *pebble.DB with an implementation of the
 // Store interface, persisting games under a []byte(`/games/`)
-// key prefix.
+// key prefix. Games are also indexed by ID under a
+// []byte(`/game-ids/`) prefix; each index entry holds the key of
+// the game's record.
 type PebbleStore struct {
 	DB *pebble.DB
+	// Log, if set, receives the store's log entries.
+	Log *Logger
+
+	mu      sync.Mutex // serializes writes that read the index
+	indexed bool       // whether the index has been backfilled
 }
 
-// Restore loads all persisted games from storage.
+// Restore loads all persisted games from storage. Where games saved
+// under legacy IDs share a canonical ID, only the one the index
+// points to is loaded, as Load would; the others are logged, and
+// Migrate renames them.
 func (ps *PebbleStore) Restore() (map[string]*Game, error) {
-	iter := ps.DB.NewIter(&pebble.IterOptions{
-		LowerBound: []byte("/games/"),
-		UpperBound: []byte(fmt.Sprintf("/games/%019d", math.MaxInt64)),
-	})
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.backfillIndexLocked(); err != nil {
+		return nil, err
+	}
+
+	iter := ps.DB.NewIter(gamesIterOptions())
 	defer iter.Close()
 
 	games := make(map[string]*Game)
 	for _ = iter.First(); iter.Valid(); iter.Next() {
-		var g Game
-		err := json.Unmarshal(iter.Value(), &g)
+		g, err := decodeGame(iter.Value())
 		if err != nil {
-			return nil, fmt.Errorf("Unmarshal game: %w", err)
+			return nil, err
+		}
+		if id, err := parseKeyID(iter.Key()); err != nil {
+			return nil, err
+		} else if id != g.ID {
+			indexed, err := ps.lookupKey(g.ID)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(indexed, iter.Key()) {
+				ps.Log.Warn("skipping game whose canonical ID is taken", "key", string(iter.Key()), "game_id", g.ID)
+				continue
+			}
 		}
-		games[g.ID] = &g
+		games[g.ID] = g
 	}
 	if err := iter.Error(); err != nil {
 		return nil, fmt.Errorf("restore iter: %w", err)
@@ -46,16 +69,341 @@ func (ps *PebbleStore) Restore() (map[string]*Game, error) {
 	return games, nil
 }
 
-// DeleteExpired deletes all games created before `expiry.`
+// Load returns the game with the given ID, or nil if there isn't
+// one.
+func (ps *PebbleStore) Load(id string) (*Game, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.backfillIndexLocked(); err != nil {
+		return nil, err
+	}
+
+	k, err := ps.lookupKey(id)
+	if err != nil || k == nil {
+		return nil, err
+	}
+	v, closer, err := ps.DB.Get(k)
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("db.Get: %w", err)
+	}
+	defer closer.Close()
+	return decodeGame(v)
+}
+
+// LoadJSON returns the game with the given ID as indented JSON, or
+// nil if there isn't one. Games are stored in a binary encoding;
+// this is for inspecting them.
+func (ps *PebbleStore) LoadJSON(id string) ([]byte, error) {
+	g, err := ps.Load(id)
+	if err != nil || g == nil {
+		return nil, err
+	}
+	return encodeGameJSON(g)
+}
+
+// lookupKey returns the key of the game with the given ID from the
+// index, or nil if it isn't indexed.
+func (ps *PebbleStore) lookupKey(id string) ([]byte, error) {
+	v, closer, err := ps.DB.Get(mkidkey(id))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("db.Get index: %w", err)
+	}
+	defer closer.Close()
+	return append([]byte(nil), v...), nil
+}
+
+// indexedKey marks a store whose games have all been indexed, so
+// the backfill doesn't rescan every record each time a server starts.
+var indexedKey = []byte("/game-ids-backfilled")
+
+// backfillIndexLocked adds index entries for games saved before the
+// index existed. It runs once per store, and after that only checks
+// for indexedKey once per process. ps.mu must be held.
+func (ps *PebbleStore) backfillIndexLocked() error {
+	if ps.indexed {
+		return nil
+	}
+	if _, closer, err := ps.DB.Get(indexedKey); err == nil {
+		closer.Close()
+		ps.indexed = true
+		return nil
+	} else if err != pebble.ErrNotFound {
+		return fmt.Errorf("db.Get index marker: %w", err)
+	}
+
+	iter := ps.DB.NewIter(gamesIterOptions())
+	defer iter.Close()
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	var n int
+	ids := make(map[string]bool)
+	aliases := make(map[string][]byte)
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		id, err := parseKeyID(iter.Key())
+		if err != nil {
+			return err
+		}
+		// If a game was saved more than once under different
+		// creation times, the latest one wins.
+		if err := b.Set(mkidkey(id), iter.Key(), nil); err != nil {
+			return fmt.Errorf("batch.Set: %w", err)
+		}
+		ids[id] = true
+		// Games saved before IDs were canonical are loaded with
+		// their canonical ID, so they're found by it too.
+		if canonical, ok := legacyGameID(id); ok && string(canonical) != id {
+			if other, ok := aliases[string(canonical)]; ok {
+				ps.Log.Warn("games share a canonical ID; run migrate to rename one",
+					"game_id", string(canonical), "key", string(other), "other_key", string(iter.Key()))
+			}
+			aliases[string(canonical)] = append([]byte(nil), iter.Key()...)
+		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("index iter: %w", err)
+	}
+	for id, k := range aliases {
+		if ids[id] {
+			// A game saved with the canonical ID takes precedence.
+			ps.Log.Warn("games share a canonical ID; run migrate to rename one",
+				"game_id", id, "other_key", string(k))
+			continue
+		}
+		if err := b.Set(mkidkey(id), k, nil); err != nil {
+			return fmt.Errorf("batch.Set: %w", err)
+		}
+	}
+	if err := b.Set(indexedKey, nil, nil); err != nil {
+		return fmt.Errorf("batch.Set: %w", err)
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("backfill index: %w", err)
+	}
+	ps.Log.Debug("indexed games by ID", "games", n)
+	ps.indexed = true
+	return nil
+}
+
+// DeleteExpired deletes all games last updated before `expiry`,
+// along with their index entries. Keys are ordered by creation time,
+// so every record has to be read for its UpdatedAt, though nothing
+// else in it is decoded; the deletions are applied in one batch.
+// Records that can't be read are logged and kept, so one bad record
+// doesn't stop every sweep and a newer build can still read them.
 func (ps *PebbleStore) DeleteExpired(expiry time.Time) error {
-	return ps.DB.DeleteRange(
-		mkkey(0, ""),
-		mkkey(expiry.Unix(), ""),
-		nil,
-	)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.backfillIndexLocked(); err != nil {
+		return err
+	}
+
+	iter := ps.DB.NewIter(gamesIterOptions())
+	defer iter.Close()
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	var n int
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		updatedAt, err := recordUpdatedAt(iter.Value())
+		if err != nil {
+			ps.Log.Error("skipping undecodable game record", "key", string(iter.Key()), "err", err)
+			continue
+		}
+		if !updatedAt.Before(expiry) {
+			continue
+		}
+		if err := ps.deleteBatch(b, iter.Key()); err != nil {
+			return err
+		}
+		ps.Log.Debug("deleting expired game", "key", string(iter.Key()), "updated_at", updatedAt)
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("expire iter: %w", err)
+	}
+	if b.Empty() {
+		return nil
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
+	ps.Log.Info("deleted expired games", "games", n, "expiry", expiry)
+	return nil
+}
+
+// Migrate rewrites every game record that's older than
+// SchemaVersion or still JSON encoded in the current format, and
+// returns how many were rewritten. Records whose game IDs were made
+// canonical move to the canonical ID's key, or, if another game has
+// that ID, to a numbered one. Records are migrated on
+// load regardless, so this is only needed to upgrade a database
+// offline.
+func (ps *PebbleStore) Migrate() (int, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.backfillIndexLocked(); err != nil {
+		return 0, err
+	}
+
+	iter := ps.DB.NewIter(gamesIterOptions())
+	defer iter.Close()
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	var migrated int
+	// IDs given to games in b, which lookupKey doesn't see yet.
+	claimed := make(map[string]bool)
+	for _ = iter.First(); iter.Valid(); iter.Next() {
+		version, err := recordVersion(iter.Value())
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", iter.Key(), err)
+		}
+		if version == SchemaVersion && isBinaryRecord(iter.Value()) {
+			continue
+		}
+		g, err := decodeGame(iter.Value())
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", iter.Key(), err)
+		}
+		k, v, err := gameKV(g)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", iter.Key(), err)
+		}
+		if moved, err := ps.moveBatch(b, iter.Key(), k, g.ID); err != nil {
+			return 0, err
+		} else if !moved && !bytes.Equal(iter.Key(), k) {
+			// Another game has the canonical ID, as "Foo" and "foo"
+			// would. Rather than leave this one unreachable, give it
+			// a free ID.
+			if k, v, err = ps.renameBatch(b, iter.Key(), g, claimed); err != nil {
+				return 0, err
+			}
+		} else if !moved {
+			k = iter.Key()
+		}
+		claimed[g.ID] = true
+		if err := b.Set(k, v, nil); err != nil {
+			return 0, fmt.Errorf("batch.Set: %w", err)
+		}
+		migrated++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("migrate iter: %w", err)
+	}
+	if b.Empty() {
+		return 0, nil
+	}
+	if err := b.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return 0, err
+	}
+	return migrated, nil
+}
+
+// moveBatch adds moving the index entry for id from the record at old
+// to the one at k to b, and reports whether it did. Records are only
+// moved if id is indexed to old, so a game stored under a legacy ID
+// doesn't replace another that already has its canonical ID. ps.mu
+// must be held.
+func (ps *PebbleStore) moveBatch(b *pebble.Batch, old, k []byte, id string) (bool, error) {
+	if bytes.Equal(old, k) {
+		return false, nil
+	}
+	indexed, err := ps.lookupKey(id)
+	if err != nil || !bytes.Equal(indexed, old) {
+		return false, err
+	}
+	oldID, err := parseKeyID(old)
+	if err != nil {
+		return false, err
+	}
+	if err := b.Delete(old, nil); err != nil {
+		return false, fmt.Errorf("batch.Delete: %w", err)
+	}
+	if err := b.Delete(mkidkey(oldID), nil); err != nil {
+		return false, fmt.Errorf("batch.Delete index: %w", err)
+	}
+	if err := b.Set(mkidkey(id), k, nil); err != nil {
+		return false, fmt.Errorf("batch.Set index: %w", err)
+	}
+	return true, nil
+}
+
+// renameBatch adds to b moving g, stored at old under a legacy ID
+// whose canonical form another game has, to a free ID. It returns the
+// record's new key and value. ps.mu must be held.
+func (ps *PebbleStore) renameBatch(b *pebble.Batch, old []byte, g *Game, claimed map[string]bool) ([]byte, []byte, error) {
+	oldID, err := parseKeyID(old)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := g.ID
+	for n := 2; ; n++ {
+		suffix := "-" + strconv.Itoa(n)
+		if len(base)+len(suffix) > MaxGameIDLength {
+			base = strings.TrimRight(base[:MaxGameIDLength-len(suffix)], "-_")
+		}
+		id := base + suffix
+		if claimed[id] {
+			continue
+		}
+		indexed, err := ps.lookupKey(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if indexed == nil {
+			g.ID = id
+			break
+		}
+	}
+	k, v, err := gameKV(g)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ps.deleteBatch(b, old); err != nil {
+		return nil, nil, err
+	}
+	if err := b.Set(mkidkey(g.ID), k, nil); err != nil {
+		return nil, nil, fmt.Errorf("batch.Set index: %w", err)
+	}
+	ps.Log.Warn("renamed game whose canonical ID is taken", "legacy_id", oldID, "game_id", g.ID)
+	return k, v, nil
 }
 
-// Save saves the game to persistent storage.
+// sessionSecretKey holds the session secret generated for servers run
+// without one.
+var sessionSecretKey = []byte("/session-secret")
+
+// SessionSecret returns the session secret kept in the store,
+// generating it the first time, so a server run without
+// SESSION_SECRET still recognizes its players after a restart. Games
+// record the sessions of their players, who would otherwise be locked
+// out of their names.
+func (ps *PebbleStore) SessionSecret() (string, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	v, closer, err := ps.DB.Get(sessionSecretKey)
+	if err == nil {
+		defer closer.Close()
+		return string(v), nil
+	} else if err != pebble.ErrNotFound {
+		return "", fmt.Errorf("db.Get session secret: %w", err)
+	}
+	secret := randomHex(32)
+	if err := ps.DB.Set(sessionSecretKey, []byte(secret), &pebble.WriteOptions{Sync: true}); err != nil {
+		return "", fmt.Errorf("db.Set session secret: %w", err)
+	}
+	return secret, nil
+}
+
+// Save saves the game to persistent storage and indexes it by ID. If
+// a game with the same ID but a different creation time was saved
+// before, it's deleted in the same batch.
 func (ps *PebbleStore) Save(g *Game) error {
 	if g == nil {
 		return nil
@@ -66,44 +414,117 @@ func (ps *PebbleStore) Save(g *Game) error {
 		return fmt.Errorf("trySave: %w", err)
 	}
 
-	err = ps.DB.Set(k, v, &pebble.WriteOptions{Sync: true})
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.backfillIndexLocked(); err != nil {
+		return err
+	}
+
+	old, err := ps.lookupKey(g.ID)
+	if err != nil {
+		return err
+	}
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	if old != nil && !bytes.Equal(old, k) {
+		if err := b.Delete(old, nil); err != nil {
+			return fmt.Errorf("batch.Delete: %w", err)
+		}
+		// The old record may have had a legacy ID, indexed too.
+		if oldID, err := parseKeyID(old); err == nil && oldID != g.ID {
+			if err := b.Delete(mkidkey(oldID), nil); err != nil {
+				return fmt.Errorf("batch.Delete index: %w", err)
+			}
+		}
+	}
+	if err := b.Set(k, v, nil); err != nil {
+		return fmt.Errorf("batch.Set: %w", err)
+	}
+	if err := b.Set(mkidkey(g.ID), k, nil); err != nil {
+		return fmt.Errorf("batch.Set index: %w", err)
+	}
+	err = b.Commit(&pebble.WriteOptions{Sync: true})
 	if err != nil {
 		return fmt.Errorf("db.Set: %w", err)
 	}
-	return err
+	return nil
 }
 
-// Delete removes a game from persistent storage.
+// Delete removes a game and its index entry from persistent storage.
 func (ps *PebbleStore) Delete(g *Game) error {
 	if g == nil {
 		return nil
 	}
 
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.backfillIndexLocked(); err != nil {
+		return err
+	}
+
 	k := mkkey(g.CreatedAt.Unix(), g.ID)
-	err := ps.DB.Delete(k, nil)
+	// A game loaded from a record with a legacy ID is stored under
+	// that ID until it's saved.
+	indexed, err := ps.lookupKey(g.ID)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(indexed, []byte(fmt.Sprintf("/games/%019d/", g.CreatedAt.Unix()))) {
+		k = indexed
+	}
+
+	b := ps.DB.NewBatch()
+	defer b.Close()
+	if err := ps.deleteBatch(b, k); err != nil {
+		return err
+	}
+	err = b.Commit(&pebble.WriteOptions{Sync: true})
 	if err != nil {
 		return fmt.Errorf("db.Delete: %w", err)
 	}
 	return nil
 }
 
-type CheckpointFile struct {
-	Name string
-	Data []byte
-}
-
-// Checkpoint returns a serialized represenation of the entire store.
-func (ps *PebbleStore) Checkpoint(w io.Writer) error {
-	// Compact the entire key space. The database tends to be small and there
-	// tends to be a significant number of obsolete keys, so this shouldn't be
-	// too expensive but will reduce the number of bytes we need to send over
-	// the network.
-	err := ps.DB.Compact([]byte{}, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+// deleteBatch adds the deletion of the game stored at k to b, along
+// with its index entries: the one for the ID in k and, if that's a
+// legacy ID, the one for its canonical ID. Index entries are only
+// removed if they still point at k, so deleting a game that has
+// since been replaced leaves the replacement reachable. ps.mu must
+// be held.
+func (ps *PebbleStore) deleteBatch(b *pebble.Batch, k []byte) error {
+	id, err := parseKeyID(k)
 	if err != nil {
 		return err
 	}
+	if err := b.Delete(k, nil); err != nil {
+		return fmt.Errorf("batch.Delete: %w", err)
+	}
+	ids := []string{id}
+	if canonical, ok := legacyGameID(id); ok && string(canonical) != id {
+		ids = append(ids, string(canonical))
+	}
+	for _, id := range ids {
+		indexed, err := ps.lookupKey(id)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(indexed, k) {
+			if err := b.Delete(mkidkey(id), nil); err != nil {
+				return fmt.Errorf("batch.Delete index: %w", err)
+			}
+		}
+	}
+	return nil
+}
 
-	// Create a Pebble checkpoint in a temporary directory.
+// Checkpoint writes a backup stream of the entire store to w,
+// omitting the contents of files whose checksums are in have. See
+// ReadBackup for the format.
+func (ps *PebbleStore) Checkpoint(w io.Writer, have map[string]bool) error {
+	// Create a Pebble checkpoint in a temporary directory. Checkpoints
+	// hard link sstables where they can, and sstables are immutable,
+	// so unchanged files keep their checksums between backups.
 	name, err := ioutil.TempDir("", "checkpoint")
 	if err != nil {
 		return err
@@ -117,42 +538,30 @@ func (ps *PebbleStore) Checkpoint(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-
-	// Write all the files in the checkpoint out over the network.
-	gzipWriter := gzip.NewWriter(w)
-	enc := gob.NewEncoder(gzipWriter)
-	err = filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
-		}
-		b, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		relPath, err := filepath.Rel(name, path)
-		if err != nil {
-			return err
-		}
-		log.Printf("Checkpoint sending file %s (%d bytes)\n", relPath, len(b))
-		return enc.Encode(CheckpointFile{
-			Name: relPath,
-			Data: b,
-		})
-	})
-	if err != nil {
-		return err
-	}
-	return gzipWriter.Close()
+	return writeBackup(w, name, have, ps.Log)
 }
 
 func gameKV(g *Game) (key, value []byte, err error) {
-	value, err = json.Marshal(g)
+	value, err = encodeGame(g)
 	if err != nil {
 		return nil, nil, fmt.Errorf("marshaling GameState: %w", err)
 	}
 	return mkkey(g.CreatedAt.Unix(), g.ID), value, nil
 }
 
+func gamesIterOptions() *pebble.IterOptions {
+	return &pebble.IterOptions{
+		LowerBound: []byte("/games/"),
+		UpperBound: []byte(fmt.Sprintf("/games/%019d", math.MaxInt64)),
+	}
+}
+
+// mkidkey returns the index key for a game ID. Its value is the key
+// of the game's record.
+func mkidkey(id string) []byte {
+	return []byte(fmt.Sprintf("/game-ids/%q", id))
+}
+
 func mkkey(unixSecs int64, id string) []byte {
 	// We could use a binary encoding for keys,
 	// but it's not like we're storing that many
@@ -161,8 +570,23 @@ func mkkey(unixSecs int64, id string) []byte {
 	return []byte(fmt.Sprintf("/games/%019d/%q", unixSecs, id))
 }
 
+// parseKeyID returns the game ID encoded in a key built by mkkey.
+func parseKeyID(k []byte) (string, error) {
+	const prefixLen = len("/games/") + 19 + len("/")
+	if len(k) < prefixLen {
+		return "", fmt.Errorf("malformed game key %q", k)
+	}
+	id, err := strconv.Unquote(string(k[prefixLen:]))
+	if err != nil {
+		return "", fmt.Errorf("malformed game key %q: %w", k, err)
+	}
+	return id, nil
+}
+
 type discardStore struct{}
 
-func (ds discardStore) Save(*Game) error           { return nil }
-func (ds discardStore) Delete(*Game) error         { return nil }
-func (ds discardStore) Checkpoint(io.Writer) error { return nil }
+func (ds discardStore) Load(string) (*Game, error)                  { return nil, nil }
+func (ds discardStore) Save(*Game) error                            { return nil }
+func (ds discardStore) Delete(*Game) error                          { return nil }
+func (ds discardStore) DeleteExpired(time.Time) error               { return nil }
+func (ds discardStore) Checkpoint(io.Writer, map[string]bool) error { return nil }
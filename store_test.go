@@ -1,9 +1,12 @@
 package crossclues
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/jbowens/dictionary"
@@ -21,14 +24,18 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-	gameIDs = dictGameIDs.Words()
+	for _, w := range dictGameIDs.Words() {
+		if id, err := ParseGameID(w); err == nil {
+			gameIDs = append(gameIDs, string(id))
+		}
+	}
 	words = dictWords.Words()
 }
 
 func randomGames(n int) map[string]*Game {
 	games := make(map[string]*Game)
 	for _, w := range gameIDs[:n] {
-		games[w] = newGame(w, randomState(words, DefaultBoardSize), GameOptions{})
+		games[w] = newGame(w, randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})
 	}
 	return games
 }
@@ -91,3 +98,249 @@ func TestPersist(t *testing.T) {
 
 	}
 }
+
+func TestDeleteExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-expire-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ps PebbleStore
+	ps.DB, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DB.Close()
+
+	now := time.Now()
+	expiry := now.Add(-time.Hour)
+
+	// An expired record saved before IDs were canonical, indexed by
+	// both its legacy and canonical IDs.
+	legacy := newGame("Old Game", randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})
+	legacy.CreatedAt, legacy.UpdatedAt = now.Add(-100*time.Hour), now.Add(-72*time.Hour)
+	legacyRecord, err := json.Marshal(gameRecord{SchemaVersion: 1, Game: legacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.DB.Set(mkkey(legacy.CreatedAt.Unix(), legacy.ID), legacyRecord, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	games := randomGames(4)
+	ages := map[string]time.Time{
+		gameIDs[0]: now,                          // fresh
+		gameIDs[1]: expiry,                       // exactly at the cutoff
+		gameIDs[2]: expiry.Add(-time.Nanosecond), // just past the cutoff
+		gameIDs[3]: now.Add(-72 * time.Hour),     // long idle
+	}
+	for id, updatedAt := range ages {
+		g := games[id]
+		// Created long ago, so a policy keyed on CreatedAt would
+		// remove every game.
+		g.CreatedAt = now.Add(-100 * time.Hour)
+		g.UpdatedAt = updatedAt
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A record that can't be decoded doesn't stop the sweep.
+	corrupt := mkkey(now.Add(-200*time.Hour).Unix(), "corrupt")
+	if err := ps.DB.Set(corrupt, []byte("not a game"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ps.DeleteExpired(expiry); err != nil {
+		t.Fatal(err)
+	}
+	for id, updatedAt := range ages {
+		g, err := ps.Load(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := !updatedAt.Before(expiry); (g != nil) != want {
+			t.Errorf("game %q updated at %s: kept = %t, want %t", id, updatedAt, g != nil, want)
+		}
+	}
+	if _, closer, err := ps.DB.Get(corrupt); err != nil {
+		t.Errorf("undecodable record: %v", err)
+	} else {
+		closer.Close()
+	}
+	for _, id := range []string{"Old Game", "old-game"} {
+		if k, err := ps.lookupKey(id); err != nil || k != nil {
+			t.Errorf("index entry for %q after expiry = %q, %v; want none", id, k, err)
+		}
+	}
+}
+
+func TestLoadAndReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-load-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ps PebbleStore
+	ps.DB, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	games := randomGames(3)
+	for _, g := range games {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ps.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-open so the index has to be rebuilt from disk.
+	ps = PebbleStore{}
+	ps.DB, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DB.Close()
+
+	id := gameIDs[0]
+	got, err := ps.Load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || !reflect.DeepEqual(got.Deck, games[id].Deck) {
+		t.Fatalf("Load(%q) = %s, want %s", id, pretty.Sprint(got), pretty.Sprint(games[id]))
+	}
+	if got, err := ps.Load("missing"); err != nil || got != nil {
+		t.Fatalf("Load(missing) = %v, %v", got, err)
+	}
+
+	// Saving a new game under the same ID replaces the old one.
+	next := newGame(id, nextGameState(games[id].GameState, DefaultBoardSize), GameOptions{})
+	next.CreatedAt = games[id].CreatedAt.Add(time.Hour)
+	if err := ps.Save(next); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ps.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != len(games) {
+		t.Errorf("restored %d games, want %d", len(restored), len(games))
+	}
+	got, err = ps.Load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(next.CreatedAt) {
+		t.Errorf("Load(%q) returned the replaced game", id)
+	}
+}
+
+func TestGameIDIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-index-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ps PebbleStore
+	ps.DB, err = pebble.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DB.Close()
+
+	games := randomGames(3)
+	expired, replaced, legacy := games[gameIDs[0]], games[gameIDs[1]], games[gameIDs[2]]
+
+	// A game written before the index existed.
+	k, v, err := gameKV(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.DB.Set(k, v, nil); err != nil {
+		t.Fatal(err)
+	}
+	expired.UpdatedAt = time.Now().Add(-48 * time.Hour)
+	for _, g := range []*Game{expired, replaced} {
+		if err := ps.Save(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := ps.Load(legacy.ID); err != nil || got == nil {
+		t.Fatalf("Load(%q) of unindexed game = %v, %v", legacy.ID, got, err)
+	}
+
+	// Deleting a game that has since been replaced keeps the
+	// replacement reachable.
+	next := newGame(replaced.ID, nextGameState(replaced.GameState, DefaultBoardSize), GameOptions{})
+	next.CreatedAt = replaced.CreatedAt.Add(time.Hour)
+	if err := ps.Save(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Delete(replaced); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ps.Load(replaced.ID); err != nil || got == nil || !got.CreatedAt.Equal(next.CreatedAt) {
+		t.Fatalf("Load(%q) after deleting replaced game = %v, %v", replaced.ID, got, err)
+	}
+
+	if err := ps.DeleteExpired(time.Now().Add(-24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ps.Load(expired.ID); err != nil || got != nil {
+		t.Fatalf("Load(%q) of expired game = %v, %v", expired.ID, got, err)
+	}
+	if _, closer, err := ps.DB.Get(mkidkey(expired.ID)); err != pebble.ErrNotFound {
+		if err == nil {
+			closer.Close()
+		}
+		t.Errorf("index entry for expired game %q wasn't deleted: %v", expired.ID, err)
+	}
+
+	// The backfill is recorded, so reopening the store doesn't
+	// scan the records again.
+	unindexed := newGame("never-indexed", randomState(words, DefaultBoardSize), GameOptions{BoardSize: DefaultBoardSize})
+	if k, v, err = gameKV(unindexed); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.DB.Set(k, v, nil); err != nil {
+		t.Fatal(err)
+	}
+	reopened := PebbleStore{DB: ps.DB}
+	if got, err := reopened.Load(unindexed.ID); err != nil || got != nil {
+		t.Errorf("Load(%q) after reopening = %v, %v; want the store not to be rescanned", unindexed.ID, got, err)
+	}
+}
+
+func TestSessionSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-session-secret-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var secrets []string
+	for i := 0; i < 2; i++ {
+		db, err := pebble.Open(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps := PebbleStore{DB: db}
+		secret, err := ps.SessionSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets = append(secrets, secret)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if secrets[0] == "" || secrets[0] != secrets[1] {
+		t.Errorf("got session secrets %q, want the same one after reopening the store", secrets)
+	}
+}
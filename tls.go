@@ -0,0 +1,142 @@
+package crossclues
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate files are checked
+// for changes.
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves a certificate and key pair from files, and
+// picks up new ones when the files change, such as when they're
+// renewed, without a restart.
+type certReloader struct {
+	certFile, keyFile string
+	log               *Logger
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string, log *Logger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the files if they changed since they were last
+// loaded, and reports whether it did. If they can't be loaded, such
+// as when only one of them has been replaced so far, the previous
+// certificate stays in use.
+func (cr *certReloader) reload() (bool, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+
+	cr.mu.Lock()
+	unchanged := cr.cert != nil && modTimes == cr.modTimes
+	cr.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+	cr.mu.Lock()
+	cr.cert, cr.modTimes = &cert, modTimes
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the files every interval.
+func (cr *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := cr.reload()
+		switch {
+		case err != nil:
+			cr.log.Error("reload TLS certificate", "err", err, "cert_file", cr.certFile)
+		case reloaded:
+			cr.log.Info("reloaded TLS certificate", "cert_file", cr.certFile)
+		}
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, nil
+}
+
+// configureTLS loads the server's certificate and sets up its TLS
+// config. net/http enables HTTP/2 on it when serving TLS.
+func (s *Server) configureTLS() (*certReloader, error) {
+	certs, err := newCertReloader(s.TLSCertFile, s.TLSKeyFile, s.Log)
+	if err != nil {
+		return nil, err
+	}
+	s.Server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	return certs, nil
+}
+
+// listenAndServeTLS serves HTTPS, redirecting plain HTTP requests to
+// it from RedirectAddr if that's set.
+func (s *Server) listenAndServeTLS() error {
+	certs, err := s.configureTLS()
+	if err != nil {
+		return err
+	}
+	go certs.watch(certReloadInterval)
+
+	if s.RedirectAddr != "" {
+		redirect := &http.Server{
+			Addr:              s.RedirectAddr,
+			Handler:           redirectToHTTPS(s.Server.Addr),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil {
+				s.Log.Error("HTTPS redirect listener", "err", err, "addr", s.RedirectAddr)
+			}
+		}()
+	}
+	return s.Server.ListenAndServeTLS("", "")
+}
+
+// redirectToHTTPS redirects requests to the same URL over HTTPS on
+// the port in addr.
+func redirectToHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := (&url.URL{Host: req.Host}).Hostname()
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u := *req.URL
+		u.Scheme, u.Host = "https", host
+		// 308 keeps the method and body of API requests.
+		http.Redirect(rw, req, u.String(), http.StatusPermanentRedirect)
+	})
+}
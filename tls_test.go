@@ -0,0 +1,187 @@
+package crossclues
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for localhost, named
+// name, and its key into dir, and returns the certificate.
+func writeCert(t *testing.T, dir, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := tempDir(t, "tls")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, dir, "first")
+
+	cr, err := newCertReloader(certFile, keyFile, NewLogger(ioutil.Discard, LevelInfo, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servedName := func() string {
+		t.Helper()
+		cert, err := cr.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if got := servedName(); got != "first" {
+		t.Fatalf("serving %q, want first", got)
+	}
+	if reloaded, err := cr.reload(); reloaded || err != nil {
+		t.Fatalf("reload of unchanged files = %v, %v", reloaded, err)
+	}
+
+	// Modification times can be too coarse to see a quick rewrite.
+	later := time.Now().Add(time.Minute)
+	touch := func() {
+		t.Helper()
+		for _, name := range []string{certFile, keyFile} {
+			if err := os.Chtimes(name, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+		later = later.Add(time.Minute)
+	}
+	writeCert(t, dir, "second")
+	touch()
+	if reloaded, err := cr.reload(); !reloaded || err != nil {
+		t.Fatalf("reload of renewed files = %v, %v", reloaded, err)
+	}
+	if got := servedName(); got != "second" {
+		t.Fatalf("serving %q after renewal, want second", got)
+	}
+
+	// A key that doesn't match, as when only the certificate has been
+	// replaced so far, keeps the previous certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch()
+	if reloaded, err := cr.reload(); reloaded || err == nil {
+		t.Fatalf("reload of a broken key = %v, %v; want an error", reloaded, err)
+	}
+	if got := servedName(); got != "second" {
+		t.Fatalf("serving %q after a failed reload, want second", got)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := tempDir(t, "tls")
+	cert := writeCert(t, dir, "crossclues")
+
+	s := &Server{
+		Store:       newMemStore(),
+		TLSCertFile: filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:  filepath.Join(dir, "key.pem"),
+		HSTSMaxAge:  24 * time.Hour,
+	}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.configureTLS(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Server.ServeTLS(ln, "", "")
+	defer s.Server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ProtoMajor != 2 {
+		t.Fatalf("GET /stats returned %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=86400" {
+		t.Fatalf("Strict-Transport-Security is %q, want max-age=86400", got)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, tc := range []struct {
+		addr, host, target, want string
+	}{
+		{":443", "example.com", "/game?x=1", "https://example.com/game?x=1"},
+		{":443", "example.com:80", "/", "https://example.com/"},
+		{":8443", "example.com:8080", "/next-game", "https://example.com:8443/next-game"},
+		{":443", "[::1]:80", "/", "https://[::1]/"},
+	} {
+		req := httptest.NewRequest("POST", tc.target, nil)
+		req.Host = tc.host
+		rw := httptest.NewRecorder()
+		redirectToHTTPS(tc.addr).ServeHTTP(rw, req)
+		if rw.Code != http.StatusPermanentRedirect || rw.Header().Get("Location") != tc.want {
+			t.Errorf("%s on %s: %d to %q, want 308 to %q", tc.host+tc.target, tc.addr, rw.Code, rw.Header().Get("Location"), tc.want)
+		}
+	}
+}
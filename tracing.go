@@ -0,0 +1,306 @@
+package crossclues
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanData is a finished span, as handed to a SpanExporter.
+type SpanData struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string // empty for a root span
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   []SpanAttribute
+	Error        string // empty if the operation succeeded
+}
+
+// SpanAttribute is a key/value annotation on a span.
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanExporter receives spans as they end. ExportSpan is called
+// concurrently and must not block for long.
+type SpanExporter interface {
+	ExportSpan(SpanData)
+}
+
+// Tracer starts spans and hands them to its exporter when they end.
+// A nil *Tracer starts no-op spans, so tracing costs nothing when
+// it's off.
+type Tracer struct {
+	exporter SpanExporter
+}
+
+// NewTracer returns a tracer that exports spans to e.
+func NewTracer(e SpanExporter) *Tracer {
+	return &Tracer{exporter: e}
+}
+
+// spanContext identifies a span so children, possibly in other
+// goroutines or processes, can refer to it.
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+func (sc spanContext) valid() bool { return sc.traceID != "" }
+
+// Span is an operation being timed. Its methods are safe to call on
+// a nil *Span.
+type Span struct {
+	tracer *Tracer
+
+	mu   sync.Mutex
+	data SpanData
+	done bool
+}
+
+type spanKey struct{}
+
+type tracerKey struct{}
+
+// withTracer returns a context whose spans are exported by t.
+func withTracer(ctx context.Context, t *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startSpan begins a span with the tracer in ctx. It's a no-op if
+// ctx has none.
+func startSpan(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	t, _ := ctx.Value(tracerKey{}).(*Tracer)
+	return t.Start(ctx, name, kv...)
+}
+
+// Start begins a span named name as a child of the span in ctx, if
+// any, and returns a context carrying the new span. kv are attribute
+// keys and values.
+func (t *Tracer) Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	return t.startWithParent(ctx, spanContextFrom(ctx), name, kv...)
+}
+
+func (t *Tracer) startWithParent(ctx context.Context, parent spanContext, name string, kv ...interface{}) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	sp := &Span{tracer: t, data: SpanData{
+		TraceID:      parent.traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: parent.spanID,
+		Name:         name,
+		Start:        time.Now(),
+	}}
+	if sp.data.TraceID == "" {
+		sp.data.TraceID = randomHex(16)
+	}
+	sp.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// SetAttributes annotates the span with key/value pairs.
+func (sp *Span) SetAttributes(kv ...interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		sp.data.Attributes = append(sp.data.Attributes, SpanAttribute{fmt.Sprint(kv[i]), logValue(kv[i+1])})
+	}
+}
+
+// RecordError marks the span as failed if err is non-nil.
+func (sp *Span) RecordError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.data.Error = err.Error()
+}
+
+// End finishes the span and exports it. Only the first call has an
+// effect.
+func (sp *Span) End() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	if sp.done {
+		sp.mu.Unlock()
+		return
+	}
+	sp.done = true
+	sp.data.End = time.Now()
+	data := sp.data
+	sp.mu.Unlock()
+	sp.tracer.exporter.ExportSpan(data)
+}
+
+func (sp *Span) context() spanContext {
+	if sp == nil {
+		return spanContext{}
+	}
+	return spanContext{traceID: sp.data.TraceID, spanID: sp.data.SpanID}
+}
+
+// spanContextFrom returns the context of the span in ctx, or of the
+// remote parent put there by withRemoteParent.
+func spanContextFrom(ctx context.Context) spanContext {
+	switch v := ctx.Value(spanKey{}).(type) {
+	case *Span:
+		return v.context()
+	case spanContext:
+		return v
+	}
+	return spanContext{}
+}
+
+// traceparentHeader propagates trace context between nodes, in the
+// W3C Trace Context format.
+const traceparentHeader = "traceparent"
+
+// withRemoteParent returns a context whose spans are children of
+// the span named in req's traceparent header, if it has a valid one.
+func withRemoteParent(ctx context.Context, req *http.Request) context.Context {
+	parts := strings.Split(req.Header.Get(traceparentHeader), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, spanContext{traceID: parts[1], spanID: parts[2]})
+}
+
+// injectTraceparent sets the traceparent header on req so the
+// receiving node continues the trace in ctx.
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	if sc := spanContextFrom(ctx); sc.valid() {
+		req.Header.Set(traceparentHeader, "00-"+sc.traceID+"-"+sc.spanID+"-01")
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// writerExporter serializes spans to an io.Writer, one per line.
+type writerExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	encode func(SpanData) interface{}
+}
+
+func (e *writerExporter) ExportSpan(sd SpanData) {
+	b, err := json.Marshal(e.encode(sd))
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(b, '\n'))
+}
+
+// NewStdoutExporter returns an exporter that writes each span to w as
+// a line of plain JSON, for reading by eye or with jq.
+func NewStdoutExporter(w io.Writer) SpanExporter {
+	return &writerExporter{w: w, encode: func(sd SpanData) interface{} {
+		attrs := make(map[string]interface{}, len(sd.Attributes))
+		for _, a := range sd.Attributes {
+			attrs[a.Key] = a.Value
+		}
+		return struct {
+			TraceID      string                 `json:"trace_id"`
+			SpanID       string                 `json:"span_id"`
+			ParentSpanID string                 `json:"parent_span_id,omitempty"`
+			Name         string                 `json:"name"`
+			Start        time.Time              `json:"start"`
+			DurationMS   float64                `json:"duration_ms"`
+			Attributes   map[string]interface{} `json:"attributes,omitempty"`
+			Error        string                 `json:"error,omitempty"`
+		}{sd.TraceID, sd.SpanID, sd.ParentSpanID, sd.Name, sd.Start,
+			float64(sd.End.Sub(sd.Start)) / float64(time.Millisecond), attrs, sd.Error}
+	}}
+}
+
+// NewOTLPFileExporter returns an exporter that writes each span to w
+// as a line of OTLP/JSON, the format of the OpenTelemetry
+// collector's file exporter, so the file can be loaded by OTLP
+// tooling.
+func NewOTLPFileExporter(w io.Writer) SpanExporter {
+	return &writerExporter{w: w, encode: otlpTraces}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpTraces(sd SpanData) interface{} {
+	attrs := make([]otlpKeyValue, 0, len(sd.Attributes))
+	for _, a := range sd.Attributes {
+		// 64-bit integers are strings in OTLP/JSON.
+		var v map[string]interface{}
+		switch x := a.Value.(type) {
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+		case bool:
+			v = map[string]interface{}{"boolValue": x}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+		}
+		attrs = append(attrs, otlpKeyValue{a.Key, v})
+	}
+	status := map[string]interface{}{}
+	if sd.Error != "" {
+		status["code"] = 2 // STATUS_CODE_ERROR
+		status["message"] = sd.Error
+	}
+	span := map[string]interface{}{
+		"traceId":           sd.TraceID,
+		"spanId":            sd.SpanID,
+		"name":              sd.Name,
+		"kind":              1, // SPAN_KIND_INTERNAL
+		"startTimeUnixNano": strconv.FormatInt(sd.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(sd.End.UnixNano(), 10),
+		"attributes":        attrs,
+		"status":            status,
+	}
+	if sd.ParentSpanID != "" {
+		span["parentSpanId"] = sd.ParentSpanID
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{{"service.name", map[string]interface{}{"stringValue": "crossclues"}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/dfturn/crossclues"},
+				"spans": []interface{}{span},
+			}},
+		}},
+	}
+}
@@ -0,0 +1,159 @@
+package crossclues
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *recordingExporter) ExportSpan(sd SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, sd)
+}
+
+// find returns the spans named name.
+func (e *recordingExporter) find(name string) []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var found []SpanData
+	for _, sd := range e.spans {
+		if sd.Name == name {
+			found = append(found, sd)
+		}
+	}
+	return found
+}
+
+func TestTracing(t *testing.T) {
+	exp := &recordingExporter{}
+	s := &Server{Store: newMemStore(), Tracer: NewTracer(exp)}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "traced", "alice")
+	code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "traced", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, nil)
+	if code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/traced/alice?session="+alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var g Game
+	if err := conn.ReadJSON(&g); err != nil {
+		t.Fatal(err)
+	}
+
+	// Continue a trace started elsewhere.
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	req, err := http.NewRequest("POST", ts.URL+"/game-state", strings.NewReader(`{"game_id":"traced","player_id":"alice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sessionHeader, alice)
+	req.Header.Set(traceparentHeader, "00-"+traceID+"-"+parentID+"-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := conn.ReadJSON(&g); err != nil {
+		t.Fatal(err)
+	}
+
+	var handler, update, save, push SpanData
+	waitFor(t, "spans", func() bool {
+		for _, sd := range exp.find("http.game_state") {
+			handler = sd
+		}
+		for _, sd := range exp.find("GameHandle.update") {
+			if sd.ParentSpanID == handler.SpanID {
+				update = sd
+			}
+		}
+		for _, sd := range exp.find("Store.Save") {
+			if sd.ParentSpanID == update.SpanID {
+				save = sd
+			}
+		}
+		for _, sd := range exp.find("websocket.push") {
+			if sd.ParentSpanID == update.SpanID {
+				push = sd
+			}
+		}
+		return push.SpanID != ""
+	})
+	if handler.TraceID != traceID || handler.ParentSpanID != parentID {
+		t.Errorf("handler span %+v didn't continue trace %s", handler, traceID)
+	}
+	for _, sd := range []SpanData{update, save, push} {
+		if sd.TraceID != traceID {
+			t.Errorf("%s span is in trace %s, want %s", sd.Name, sd.TraceID, traceID)
+		}
+	}
+	if save.SpanID == "" {
+		t.Errorf("no Store.Save span under the update")
+	}
+}
+
+func TestOTLPFileExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer(NewOTLPFileExporter(&buf))
+	_, sp := tr.Start(context.Background(), "op", "count", 3, "ok", true)
+	time.Sleep(time.Millisecond)
+	sp.End()
+	sp.End() // exported once
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("exported %d lines, want 1", len(lines))
+	}
+	var out struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID    string `json:"traceId"`
+					Name       string `json:"name"`
+					Attributes []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &out); err != nil {
+		t.Fatal(err)
+	}
+	span := out.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.Name != "op" || len(span.TraceID) != 32 {
+		t.Errorf("span = %+v", span)
+	}
+	if v := span.Attributes[0].Value["intValue"]; v != "3" {
+		t.Errorf("count attribute = %v, want \"3\"", span.Attributes[0].Value)
+	}
+	if v := span.Attributes[1].Value["boolValue"]; v != true {
+		t.Errorf("ok attribute = %v, want true", span.Attributes[1].Value)
+	}
+}
@@ -0,0 +1,387 @@
+package crossclues
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook event types.
+const (
+	WebhookGameCreated  = "game.created"
+	WebhookGameFinished = "game.finished"
+	WebhookPlayerJoined = "player.joined"
+	WebhookPlayerLeft   = "player.left"
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the request
+// body, keyed with the server's webhook secret, as "sha256=<hex>".
+const webhookSignatureHeader = "X-Crossclues-Signature"
+
+const (
+	webhookAttempts    = 6
+	webhookConcurrency = 16
+	webhookLogLen      = 100
+)
+
+// webhookBackoff is the delay before the first retry. It doubles on
+// each later one. It's a variable so tests can shorten it.
+var webhookBackoff = time.Second
+
+// WebhookPayload is the JSON body POSTed to webhook URLs.
+type WebhookPayload struct {
+	ID         string       `json:"id"`
+	Type       string       `json:"type"`
+	GameID     string       `json:"game_id"`
+	PlayerID   string       `json:"player_id,omitempty"`
+	OccurredAt time.Time    `json:"occurred_at"`
+	Game       *WebhookGame `json:"game,omitempty"`
+}
+
+// WebhookGame summarizes a game in a WebhookPayload. It's nil for
+// players joining or leaving a game that hasn't been created yet.
+type WebhookGame struct {
+	CreatedAt    time.Time `json:"created_at"`
+	BoardSize    int       `json:"board_size"`
+	HandSize     int       `json:"hand_size"`
+	Score        int       `json:"score"`
+	DiscardCount int       `json:"discard_count"`
+	Won          bool      `json:"won"`
+	PlayerIDs    []string  `json:"player_ids"`
+}
+
+// WebhookDelivery records one attempt to deliver a payload.
+type WebhookDelivery struct {
+	PayloadID  string    `json:"payload_id"`
+	Type       string    `json:"type"`
+	GameID     string    `json:"game_id"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// validateWebhookURL checks that u is an absolute http(s) URL.
+func validateWebhookURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an absolute http or https URL", u)
+	}
+	return nil
+}
+
+// internalNetworks are the private and shared address ranges game
+// webhooks may not reach.
+var internalNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicAddressesOnly is a net.Dialer Control function that refuses
+// to connect to loopback, private, link-local and unspecified
+// addresses. Players choose game webhook URLs, so they mustn't reach
+// the server's own network. It sees the resolved address, so it also
+// catches hostnames that resolve to internal addresses.
+func publicAddressesOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("webhook address %s isn't public", host)
+	}
+	for _, n := range internalNetworks {
+		if n.Contains(ip) {
+			return fmt.Errorf("webhook address %s isn't public", host)
+		}
+	}
+	return nil
+}
+
+// newGameWebhookClient returns the client for game webhooks, which
+// only connects to public addresses. It doesn't use a proxy, which
+// would hide the address from the check.
+func newGameWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   publicAddressesOnly,
+	}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// webhookDispatcher turns the broker's game events into webhook
+// deliveries. Events carry whole games, so it remembers what it last
+// saw of each game and compares to find what happened.
+type webhookDispatcher struct {
+	urls       []string
+	secret     []byte
+	retention  time.Duration
+	log        *Logger
+	client     *http.Client
+	gameClient *http.Client  // for game webhooks
+	sem        chan struct{} // bounds concurrent deliveries
+
+	mu         sync.Mutex
+	games      map[string]webhookGameState
+	lastPruned time.Time
+	deliveries []WebhookDelivery // ring buffer of recent attempts
+	next       int
+}
+
+type webhookGameState struct {
+	createdAt time.Time
+	won       bool
+	players   map[string]bool
+	seen      time.Time
+}
+
+func newWebhookDispatcher(urls []string, secret string, retention time.Duration, l *Logger) *webhookDispatcher {
+	return &webhookDispatcher{
+		urls:       urls,
+		secret:     []byte(secret),
+		retention:  retention,
+		log:        l,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		gameClient: newGameWebhookClient(),
+		sem:        make(chan struct{}, webhookConcurrency),
+		games:      make(map[string]webhookGameState),
+		lastPruned: time.Now(),
+	}
+}
+
+// observe records e and, if deliver is set, sends payloads for what
+// changed since the previous event for the game. Followers observe
+// without delivering, since their primary delivers.
+func (d *webhookDispatcher) observe(e GameEvent, deliver bool) {
+	now := time.Now()
+	next := webhookGameState{players: make(map[string]bool), seen: now}
+	for _, id := range e.PlayerIDs {
+		next.players[id] = true
+	}
+	if e.Game != nil {
+		next.createdAt = e.Game.CreatedAt
+		next.won = e.Game.Won
+	}
+
+	d.mu.Lock()
+	prev, seen := d.games[e.GameID]
+	d.games[e.GameID] = next
+	d.pruneLocked(now)
+	d.mu.Unlock()
+
+	if !deliver {
+		return
+	}
+
+	var payloads []WebhookPayload
+	add := func(typ, playerID string) {
+		payloads = append(payloads, WebhookPayload{
+			Type:       typ,
+			GameID:     e.GameID,
+			PlayerID:   playerID,
+			OccurredAt: now,
+			Game:       webhookGame(e),
+		})
+	}
+	newGame := e.Game != nil && !next.createdAt.Equal(prev.createdAt)
+	if newGame && (seen || e.Type == GameReplaced) {
+		add(WebhookGameCreated, "")
+	}
+	if seen && next.won && !prev.won {
+		add(WebhookGameFinished, "")
+	}
+	for _, id := range e.PlayerIDs {
+		if !prev.players[id] {
+			add(WebhookPlayerJoined, id)
+		}
+	}
+	for id := range prev.players {
+		if !next.players[id] {
+			add(WebhookPlayerLeft, id)
+		}
+	}
+
+	for _, p := range payloads {
+		p.ID = newPayloadID()
+		body, err := json.Marshal(p)
+		if err != nil {
+			d.log.Error("marshal webhook payload", "err", err)
+			continue
+		}
+		for _, u := range d.urls {
+			go d.deliver(d.client, p, u, body)
+		}
+		if e.Game != nil && e.Game.WebhookURL != "" {
+			go d.deliver(d.gameClient, p, e.Game.WebhookURL, body)
+		}
+	}
+}
+
+// pruneLocked forgets games that haven't had an event for longer
+// than the retention period; they've been deleted by then. d.mu must
+// be held.
+func (d *webhookDispatcher) pruneLocked(now time.Time) {
+	if now.Sub(d.lastPruned) < d.retention/10 {
+		return
+	}
+	d.lastPruned = now
+	for id, st := range d.games {
+		if now.Sub(st.seen) > d.retention {
+			delete(d.games, id)
+		}
+	}
+}
+
+func webhookGame(e GameEvent) *WebhookGame {
+	if e.Game == nil {
+		return nil
+	}
+	return &WebhookGame{
+		CreatedAt:    e.Game.CreatedAt,
+		BoardSize:    e.Game.BoardSize,
+		HandSize:     e.Game.HandSize,
+		Score:        e.Game.Score,
+		DiscardCount: e.Game.DiscardCount,
+		Won:          e.Game.Won,
+		PlayerIDs:    e.PlayerIDs,
+	}
+}
+
+// deliver POSTs body to u, retrying with exponential backoff on
+// network errors, 429s and 5xx responses. Deliveries run
+// concurrently, so a receiver may see payloads out of order.
+func (d *webhookDispatcher) deliver(client *http.Client, p WebhookPayload, u string, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		rec := WebhookDelivery{
+			PayloadID: p.ID,
+			Type:      p.Type,
+			GameID:    p.GameID,
+			URL:       u,
+			Attempt:   attempt,
+			At:        time.Now(),
+		}
+		// Only hold a slot while posting, so an endpoint that's down
+		// doesn't hold up others while its retries back off.
+		d.sem <- struct{}{}
+		retry, err := d.post(client, u, body, &rec)
+		<-d.sem
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		d.record(rec)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			d.log.Error("webhook delivery failed", "event", p.Type, "game_id", p.GameID, "url", u, "attempts", attempt, "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt. It reports whether a failure is
+// worth retrying.
+func (d *webhookDispatcher) post(client *http.Client, u string, body []byte, rec *WebhookDelivery) (retry bool, err error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Crossclues-Event", rec.Type)
+	req.Header.Set("X-Crossclues-Delivery", rec.PayloadID)
+	req.Header.Set(webhookSignatureHeader, signWebhook(d.secret, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	rec.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func (d *webhookDispatcher) record(rec WebhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.deliveries) < webhookLogLen {
+		d.deliveries = append(d.deliveries, rec)
+		return
+	}
+	d.deliveries[d.next] = rec
+	d.next = (d.next + 1) % webhookLogLen
+}
+
+// recent returns the logged delivery attempts, newest first.
+func (d *webhookDispatcher) recent() []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]WebhookDelivery, 0, len(d.deliveries))
+	for i := 0; i < len(d.deliveries); i++ {
+		j := (d.next - 1 - i + 2*len(d.deliveries)) % len(d.deliveries)
+		out = append(out, d.deliveries[j])
+	}
+	return out
+}
+
+// signWebhook returns the signature header value for body.
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newPayloadID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// GET /webhooks/deliveries
+func (s *Server) handleWebhookDeliveries(rw http.ResponseWriter, req *http.Request) {
+	if s.webhooks == nil {
+		writeJSON(rw, []WebhookDelivery{})
+		return
+	}
+	writeJSON(rw, s.webhooks.recent())
+}
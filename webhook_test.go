@@ -0,0 +1,179 @@
+package crossclues
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebhooks(t *testing.T) {
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	const secret = "hunter2"
+	payloads := make(chan WebhookPayload, 10)
+	var requests int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// The first delivery is retried.
+			rw.WriteHeader(500)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if got, want := req.Header.Get(webhookSignatureHeader), signWebhook([]byte(secret), body); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		var p WebhookPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		payloads <- p
+	}))
+	defer receiver.Close()
+
+	s := &Server{Store: newMemStore(), Webhooks: []string{receiver.URL}, WebhookSecret: secret}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	next := func() WebhookPayload {
+		t.Helper()
+		select {
+		case p := <-payloads:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a webhook")
+			return WebhookPayload{}
+		}
+	}
+
+	alice := join(t, ts.URL, "hooked", "alice")
+	code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "hooked", "player_id": "alice", "hand_size": 2, "board_size": DefaultBoardSize,
+	}, nil)
+	if code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	if p := next(); p.Type != WebhookGameCreated || p.GameID != "hooked" || p.Game == nil {
+		t.Errorf("first webhook = %+v, want %s", p, WebhookGameCreated)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/hooked/alice?session="+alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := next(); p.Type != WebhookPlayerJoined || p.PlayerID != "alice" {
+		t.Errorf("webhook = %+v, want alice joining", p)
+	}
+
+	s.getGame("hooked").update(context.Background(), func(g *Game) bool {
+		g.Score = 7
+		g.Won = true
+		return true
+	})
+	if p := next(); p.Type != WebhookGameFinished || p.Game.Score != 7 {
+		t.Errorf("webhook = %+v, want %s with score 7", p, WebhookGameFinished)
+	}
+
+	conn.Close()
+	if p := next(); p.Type != WebhookPlayerLeft || p.PlayerID != "alice" {
+		t.Errorf("webhook = %+v, want alice leaving", p)
+	}
+
+	log := s.webhooks.recent()
+	last := log[len(log)-1]
+	if last.StatusCode != 500 || last.Attempt != 1 {
+		t.Errorf("oldest logged delivery = %+v, want a failed first attempt", last)
+	}
+}
+
+func TestGameWebhooksDisabled(t *testing.T) {
+	s := &Server{Store: newMemStore()}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	code := postJSON(t, ts.URL+"/next-game", map[string]interface{}{
+		"game_id": "hooked", "player_id": "alice", "webhook_url": "http://internal.example/",
+	}, nil)
+	if code != 400 {
+		t.Errorf("/next-game with a webhook URL returned %d, want 400", code)
+	}
+}
+
+func TestGameWebhooksOnlyReachPublicAddresses(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.216.34:80":     true,
+		"[2606:2800::1]:443":   true,
+		"127.0.0.1:80":         false,
+		"[::1]:80":             false,
+		"0.0.0.0:80":           false,
+		"10.1.2.3:80":          false,
+		"172.20.0.1:80":        false,
+		"192.168.1.1:80":       false,
+		"169.254.169.254:80":   false,
+		"[fd00::1]:80":         false,
+		"[fe80::1]:80":         false,
+		"[::ffff:10.0.0.1]:80": false,
+	} {
+		if err := publicAddressesOnly("tcp", addr, nil); (err == nil) != public {
+			t.Errorf("publicAddressesOnly(%s) = %v, want public = %t", addr, err, public)
+		}
+	}
+
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	var requests int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer receiver.Close()
+
+	s := &Server{Store: newMemStore(), AllowGameWebhooks: true, WebhookSecret: "hunter2"}
+	if err := s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	alice := join(t, ts.URL, "hooked", "alice")
+	code := postJSONAs(t, ts.URL+"/next-game", alice, map[string]interface{}{
+		"game_id": "hooked", "player_id": "alice", "webhook_url": receiver.URL,
+	}, nil)
+	if code != 200 {
+		t.Fatalf("/next-game returned %d", code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.webhooks.recent()) < webhookAttempts && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	recs := s.webhooks.recent()
+	if len(recs) == 0 {
+		t.Fatal("no game webhook deliveries were attempted")
+	}
+	for _, rec := range recs {
+		if !strings.Contains(rec.Error, "isn't public") {
+			t.Errorf("delivery = %+v, want it refused", rec)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("receiver on a loopback address got %d requests", n)
+	}
+}
@@ -2,9 +2,11 @@ package crossclues
 
 import (
 	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"sort"
 	"strings"
 	"sync"
@@ -46,19 +48,55 @@ func (ws *WordSets) Canonicalize(words []string) (wordSetID, []string, error) {
 	}
 	sort.Strings(words)
 
-	// Calculate the word set ID, a hash of the canonicalized word set.
+	// The word set ID is a hash of the canonicalized word set.
+	id := hashWordSet(words)
+	if interned, ok := ws.byID[id]; ok {
+		return id, interned, nil
+	}
+	ws.byID[id] = words
+	return id, words, nil
+}
+
+// hashWordSet returns the ID of words, in the order given.
+func hashWordSet(words []string) wordSetID {
 	h := sha1.New()
 	for _, w := range words {
 		io.WriteString(h, w)
 		h.Write([]byte{0x00})
 	}
-	idBytes := h.Sum(nil)
 	var id wordSetID
-	copy(id[:], idBytes)
+	copy(id[:], h.Sum(nil))
+	return id
+}
 
-	if interned, ok := ws.byID[id]; ok {
-		return id, interned, nil
-	}
-	ws.byID[id] = words
-	return id, words, nil
+var (
+	builtinWordSetsOnce sync.Once
+	builtinWordSets     WordSets
+)
+
+// builtinWordSet returns the built-in word set with the given ID. The
+// built-in sets are the frontend's and the default words, in the
+// canonical form games hold them in. Stored games refer to them by
+// ID instead of repeating every word.
+func builtinWordSet(id wordSetID) ([]string, bool) {
+	builtinWordSetsOnce.Do(func() {
+		var sets map[string][]string
+		if err := json.Unmarshal(embeddedWordSets, &sets); err != nil {
+			panic(fmt.Sprintf("crossclues: embedded word sets: %s", err))
+		}
+		original, err := fs.ReadFile(embeddedAssets, "assets/original.txt")
+		if err != nil {
+			panic(fmt.Sprintf("crossclues: embedded default words: %s", err))
+		}
+		sets[""] = strings.Split(strings.TrimSpace(string(original)), "\n")
+		for name, words := range sets {
+			if _, _, err := builtinWordSets.Canonicalize(words); err != nil {
+				panic(fmt.Sprintf("crossclues: word set %q: %s", name, err))
+			}
+		}
+	})
+	builtinWordSets.mu.Lock()
+	defer builtinWordSets.mu.Unlock()
+	words, ok := builtinWordSets.byID[id]
+	return words, ok
 }